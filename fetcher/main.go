@@ -1,31 +1,91 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"os"
+
+	"net/http"
+	"net/url"
+
+	"strings"
 	"time"
 
 	"github.com/MJDSystems/kilium/kilium"
+	"github.com/MJDSystems/kilium/kiliumapi"
 	"github.com/MJDSystems/kilium/kiliumtmp"
 )
 
+var (
+	listenAddr     = flag.String("listen", "", "Address to serve HTTP on (e.g. :8080).  Nothing is served when empty.")
+	websubCallback = flag.String("websub-callback", "", "Public url for WebSub hubs to call back to.  Requires -listen.")
+	greaderSecret  = flag.String("greader-secret", "", "Secret for signing Google Reader API logins.  The API is only served when set.")
+	apiToken       = flag.String("api-token", "", "Bearer token needed to add or remove feeds through /api/.  Feeds can't be changed there when empty.")
+
+	maxItems    = flag.Int("max-items", kilium.MaximumFeedItems, "How many items feeds keep by default.  0 keeps every item.")
+	maxAge      = flag.Duration("max-age", 0, "How long feeds keep items by default.  0 keeps items forever.")
+	keepStarred = flag.Bool("keep-starred", false, "Whether feeds keep starred items by default, whatever their age or count.")
+
+	node        = flag.Int("node", 0, "This fetcher's node number for item ids, unique among running fetchers (0-255).")
+	idStateFile = flag.String("id-state", "", "File keeping the last second item ids were made in, so restarts never reuse ids.")
+	lease       = flag.Duration("lease", kilium.DefaultFeedLeaseDuration, "How long other fetchers leave a feed this one claimed.")
+
+	logLevel  = flag.String("log-level", "info", "Least important messages to log: debug, info, warn or error.")
+	logFormat = flag.String("log-format", "text", "How to write logs: text, or json for one object per line.")
+)
+
 func main() {
-	idGen := make(chan uint64)
-
-	go func() {
-		start := uint64(time.Now().Unix() << 20)
-		log.Println(start>>20 - uint64(time.Now().Unix()))
-		for {
-			idGen <- start
-			start++
-		}
-	}()
+	flag.Parse()
+	level, err := kilium.ParseLogLevel(*logLevel)
+	if err != nil {
+		log.Fatalln("Bad log level:", *logLevel)
+	}
+	switch *logFormat {
+	case "text":
+		kilium.DefaultLogger = kilium.NewTextLogger(os.Stderr, level)
+	case "json":
+		kilium.DefaultLogger = kilium.NewJSONLogger(os.Stderr, level)
+	default:
+		log.Fatalln("Bad log format:", *logFormat)
+	}
+	kilium.GlobalRetentionPolicy = kilium.RetentionPolicy{MaxItems: *maxItems, MaxAge: *maxAge, KeepStarred: *keepStarred}
+
+	ids, err := kilium.NewIdGenerator(*node, *idStateFile)
+	if err != nil {
+		log.Fatalln("Failed to start the id generator:", err)
+	}
+	idGen := ids.Channel()
 
 	con, err := kilium.GetDatabaseConnection("localhost:10017")
 	if err != nil {
 		log.Panic(err)
 	}
-	master := kilium.NewRssMaster(con, idGen)
-	_ = master
+	config := kilium.DefaultRssMasterConfig()
+	config.LeaseDuration = *lease
+	config.Logger = kilium.DefaultLogger
+	master := kilium.NewRssMasterWithConfig(con, idGen, config)
+	kilium.NewWebhookDispatcher(con, master)
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", http.StripPrefix("/api", kiliumapi.NewServer(con, master, *apiToken)))
+	if *greaderSecret != "" {
+		mux.Handle("/greader/", http.StripPrefix("/greader", kiliumapi.NewGReaderServer(con, []byte(*greaderSecret))))
+	}
+	mux.Handle("/fever/", http.StripPrefix("/fever", kiliumapi.NewFeverServer(con)))
+	mux.Handle("/metrics", kilium.Metrics)
+	if *websubCallback != "" {
+		callback, err := url.Parse(*websubCallback)
+		if err != nil {
+			log.Fatalln("Bad WebSub callback url:", err)
+		}
+		subscriber := kilium.NewWebSubSubscriber(con, master, *callback)
+		mux.Handle(strings.TrimSuffix(callback.Path, "/")+"/", subscriber)
+	}
+	if *listenAddr != "" {
+		go func() {
+			log.Fatalln(http.ListenAndServe(*listenAddr, mux))
+		}()
+	}
 
 	for _, Url := range kiliumtmp.FeedList {
 		master.AddRequestCh <- kilium.AddFeedRequest{Url, make(chan error, 1)}
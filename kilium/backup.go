@@ -0,0 +1,248 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	riak "github.com/tpjg/goriakpbc"
+)
+
+const (
+	ArchiveFormat  = "kilium-archive"
+	ArchiveVersion = 1
+
+	// How many items are loaded at once while exporting.
+	archiveBatchSize = 100
+)
+
+var (
+	NotAnArchive    = errors.New("Not a kilium archive!")
+	StoreNotEmpty   = errors.New("Archives can only be restored into an empty store!")
+	UnknownArchived = errors.New("Archive holds a record for an unknown bucket!")
+)
+
+// The first line of an archive.
+type archiveHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+// Every other line holds one object.  Value is the model as encoding/json writes it.
+type archiveRecord struct {
+	Bucket string          `json:"bucket"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value"`
+}
+
+func writeArchiveRecord(enc *json.Encoder, bucket, key string, model interface{}) error {
+	value, err := json.Marshal(model)
+	if err != nil {
+		return err
+	}
+	return enc.Encode(archiveRecord{bucket, key, value})
+}
+
+// Writes every feed and item to w as JSON Lines, gzipped if compress is set.  Feeds come first, then
+// items newest first.  Users and the search index are not included.
+func ExportArchive(con *riak.Client, w io.Writer, compress bool) error {
+	if compress {
+		gz := gzip.NewWriter(w)
+		if err := exportArchive(con, gz); err != nil {
+			gz.Close()
+			return err
+		}
+		return gz.Close()
+	}
+	return exportArchive(con, w)
+}
+
+func exportArchive(con *riak.Client, w io.Writer) error {
+	buffered := bufio.NewWriter(w)
+	enc := json.NewEncoder(buffered)
+	if err := enc.Encode(archiveHeader{ArchiveFormat, ArchiveVersion}); err != nil {
+		return err
+	}
+
+	feedKeys, err := ListFeedKeys(con)
+	if err != nil {
+		return err
+	}
+	sort.Strings(feedKeys)
+	for _, key := range feedKeys {
+		feed, err := LoadFeed(con, key)
+		if err == FeedNotFound {
+			continue // Removed since it was listed.
+		} else if err != nil {
+			return err
+		}
+		if err := writeArchiveRecord(enc, "feeds", key, feed); err != nil {
+			return err
+		}
+	}
+
+	itemsBucket, err := con.Bucket("items")
+	if err != nil {
+		return err
+	}
+	rawKeys, err := itemsBucket.ListKeys()
+	if err != nil {
+		return err
+	}
+	itemKeys := make(ItemKeyList, 0, len(rawKeys))
+	for _, rawKey := range rawKeys {
+		key, err := ParseItemKey(string(rawKey))
+		if err != nil {
+			return err
+		}
+		itemKeys = append(itemKeys, key)
+	}
+	sort.Sort(sort.Reverse(itemKeys))
+
+	for start := 0; start < len(itemKeys); start += archiveBatchSize {
+		end := start + archiveBatchSize
+		if end > len(itemKeys) {
+			end = len(itemKeys)
+		}
+		items, err := LoadFeedItems(con, itemKeys[start:end])
+		if err != nil {
+			return err
+		}
+		for i, item := range items {
+			if item == nil {
+				continue
+			}
+			if err := writeArchiveRecord(enc, "items", itemKeys[start+i].GetRiakKey(), item); err != nil {
+				return err
+			}
+		}
+	}
+
+	return buffered.Flush()
+}
+
+// Restores an archive written by ExportArchive, compressed or not, keeping every key as it was.  The
+// feeds and items buckets must be empty.  Restored items are added to the search index.
+func ImportArchive(con *riak.Client, r io.Reader) error {
+	buffered := bufio.NewReader(r)
+	// Gzip streams start with 0x1f 0x8b, which JSON never does.
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = buffered
+	}
+
+	for _, name := range []string{"feeds", "items"} {
+		bucket, err := con.Bucket(name)
+		if err != nil {
+			return err
+		}
+		if keys, err := bucket.ListKeys(); err != nil {
+			return err
+		} else if len(keys) != 0 {
+			return StoreNotEmpty
+		}
+	}
+
+	dec := json.NewDecoder(r)
+	var header archiveHeader
+	if err := dec.Decode(&header); err != nil || header.Format != ArchiveFormat {
+		return NotAnArchive
+	} else if header.Version != ArchiveVersion {
+		return fmt.Errorf("Unsupported archive version %d", header.Version)
+	}
+
+	for {
+		var record archiveRecord
+		if err := dec.Decode(&record); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var err error
+		switch record.Bucket {
+		case "feeds":
+			err = importFeed(con, record)
+		case "items":
+			err = importItem(con, record)
+		default:
+			err = UnknownArchived
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to restore %s/%s: %s", record.Bucket, record.Key, err)
+		}
+	}
+}
+
+func importFeed(con *riak.Client, record archiveRecord) error {
+	archived := Feed{}
+	if err := json.Unmarshal(record.Value, &archived); err != nil {
+		return err
+	}
+
+	feed := &Feed{}
+	if err := con.LoadModel(record.Key, feed); err != riak.NotFound {
+		if err == nil {
+			return StoreNotEmpty
+		}
+		return err
+	}
+	model := feed.Model
+	*feed = archived
+	feed.Model = model
+	feed.updateIndexes()
+	return feed.Save()
+}
+
+func importItem(con *riak.Client, record archiveRecord) error {
+	key, err := ParseItemKey(record.Key)
+	if err != nil {
+		return err
+	}
+	archived := FeedItem{}
+	if err := json.Unmarshal(record.Value, &archived); err != nil {
+		return err
+	}
+
+	item := &FeedItem{}
+	if err := con.LoadModel(record.Key, item); err != riak.NotFound {
+		if err == nil {
+			return StoreNotEmpty
+		}
+		return err
+	}
+	model := item.Model
+	*item = archived
+	item.Model = model
+	item.updateIndexes()
+	if err := item.Save(); err != nil {
+		return err
+	}
+	return updateSearchIndex(con, key, nil, item)
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"testing"
+)
+
+func TestArchivedFeedRoundTrip(t *testing.T) {
+	feed := Feed{
+		Url:       *testFeedUrl,
+		Title:     "Archived",
+		LastCheck: time.Unix(1000, 0).UTC(),
+		ItemKeys:  ItemKeyList{genItemKey(20, "B"), genItemKey(10, "A")},
+		Retention: &RetentionPolicy{MaxItems: 5},
+	}
+	value, err := json.Marshal(&feed)
+	if err != nil {
+		t.Fatalf("Failed to marshal feed (%s)", err)
+	}
+
+	loaded := Feed{}
+	if err := json.Unmarshal(value, &loaded); err != nil {
+		t.Fatalf("Failed to unmarshal feed (%s)", err)
+	}
+	if loaded.UrlKey() != feed.UrlKey() || loaded.Title != feed.Title || !loaded.LastCheck.Equal(feed.LastCheck) ||
+		!reflect.DeepEqual(loaded.ItemKeys, feed.ItemKeys) || *loaded.Retention != *feed.Retention {
+		t.Errorf("Feed changed going through JSON (expected, got) (%+v, %+v)", feed, loaded)
+	}
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	url := getUniqueExampleComUrl(t)
+	CreateFeed(t, con, url)
+	feed := MustUpdateFeedTo(t, con, url, "simple", 2)
+
+	for _, compress := range []bool{false, true} {
+		archive := &bytes.Buffer{}
+		if err := ExportArchive(con, archive, compress); err != nil {
+			t.Fatalf("Failed to export (%s)", err)
+		}
+		if compress == strings.HasPrefix(archive.String(), "{") {
+			t.Errorf("Archive compression doesn't match what was asked for (%v)", compress)
+		}
+
+		if err := ImportArchive(con, bytes.NewReader(archive.Bytes())); err != StoreNotEmpty {
+			t.Errorf("Restoring over existing data didn't fail properly (%v)", err)
+		}
+
+		killTestDb(con, t)
+		if err := ImportArchive(con, archive); err != nil {
+			t.Fatalf("Failed to import (%s)", err)
+		}
+
+		loaded := &Feed{}
+		if err := con.LoadModel((&Feed{Url: *url}).UrlKey(), loaded); err != nil {
+			t.Fatalf("Restored feed is missing (%s)", err)
+		} else if !compareParsedToFinalFeed(t, feed, loaded, con) {
+			t.Errorf("Restored feed doesn't match what was backed up (%+v)", loaded)
+		}
+	}
+
+	if err := ImportArchive(con, strings.NewReader("not an archive\n")); err != StoreNotEmpty {
+		t.Errorf("Expected StoreNotEmpty before even reading, got %v", err)
+	}
+	killTestDb(con, t)
+	if err := ImportArchive(con, strings.NewReader(`{"format":"something else"}`)); err != NotAnArchive {
+		t.Errorf("Expected NotAnArchive, got %v", err)
+	}
+}
@@ -0,0 +1,299 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"sort"
+
+	riak "github.com/tpjg/goriakpbc"
+)
+
+// Objects with more siblings than this are reported.  Every write racing another one adds a sibling,
+// so a few are normal, but many means something keeps writing without resolving.
+const SiblingExplosionThreshold = 10
+
+type SiblingExplosion struct {
+	Bucket   string
+	Key      string
+	Siblings int
+}
+
+// What CheckConsistency found, and fixed if it was asked to.
+type ConsistencyReport struct {
+	FeedsChecked int
+	ItemsChecked int
+
+	// Items no feed lists.
+	OrphanedItems ItemKeyList
+	// Keys listed in a feed's ItemKeys whose item is missing, by feed key.
+	DanglingItemKeys map[string]ItemKeyList
+	// Feeds with InsertedItemKeys or DeletedItemKeys left by an update that never finished.
+	UnfinishedFeeds []string
+	// Items a feed lists that aren't in the feed index, by feed key.  Items stored before items were
+	// indexed are like this, and are missed by ItemKeysForFeed and ItemKeysPublishedBetween.
+	UnindexedItems    map[string]ItemKeyList
+	SiblingExplosions []SiblingExplosion
+
+	// Whether the problems above were repaired.
+	Repaired bool
+}
+
+func (r *ConsistencyReport) Consistent() bool {
+	return len(r.OrphanedItems) == 0 && len(r.DanglingItemKeys) == 0 && len(r.UnfinishedFeeds) == 0 &&
+		len(r.UnindexedItems) == 0 && len(r.SiblingExplosions) == 0
+}
+
+// Counts the siblings of every key in parallel, returning those over SiblingExplosionThreshold.
+func findSiblingExplosions(con *riak.Client, bucketName string, keys []string) ([]SiblingExplosion, error) {
+	bucket, err := con.Bucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		key      string
+		siblings int
+		err      error
+	}
+	resultCh := make(chan result)
+	for _, key := range keys {
+		go func(key string) {
+			obj, err := bucket.Get(key)
+			if err == riak.NotFound {
+				// Deleted since it was listed.
+				resultCh <- result{key: key}
+			} else if obj == nil {
+				resultCh <- result{key: key, err: err}
+			} else {
+				resultCh <- result{key: key, siblings: len(obj.Siblings)}
+			}
+		}(key)
+	}
+
+	var explosions []SiblingExplosion
+	var errs []error
+	for i := 0; i < len(keys); i++ {
+		next := <-resultCh
+		if next.err != nil {
+			errs = append(errs, next.err)
+		} else if next.siblings > SiblingExplosionThreshold {
+			explosions = append(explosions, SiblingExplosion{bucketName, next.key, next.siblings})
+		}
+	}
+	if len(errs) != 0 {
+		return nil, MultiError(errs)
+	}
+	sort.Slice(explosions, func(i, j int) bool { return explosions[i].Key < explosions[j].Key })
+	return explosions, nil
+}
+
+// Scans the feeds and items buckets for the damage an update that died part way, or a failed delete,
+// leaves behind.  With repair, unfinished updates are finished, dangling keys are dropped from their
+// feeds, orphaned items are deleted, unindexed items are indexed and exploded objects are resolved and
+// saved.
+//
+// Updates running at the same time look unfinished, so only repair while nothing is fetching.
+func CheckConsistency(con *riak.Client, repair bool) (*ConsistencyReport, error) {
+	report := &ConsistencyReport{DanglingItemKeys: make(map[string]ItemKeyList), UnindexedItems: make(map[string]ItemKeyList)}
+
+	feedKeys, err := ListFeedKeys(con)
+	if err != nil {
+		return nil, err
+	}
+	itemsBucket, err := con.Bucket("items")
+	if err != nil {
+		return nil, err
+	}
+	rawItemKeys, err := itemsBucket.ListKeys()
+	if err != nil {
+		return nil, err
+	}
+	itemKeys := make([]string, len(rawItemKeys))
+	stored := make(map[string]bool, len(rawItemKeys))
+	for i, key := range rawItemKeys {
+		itemKeys[i] = string(key)
+		stored[itemKeys[i]] = true
+	}
+	report.FeedsChecked, report.ItemsChecked = len(feedKeys), len(itemKeys)
+
+	// Every key a feed mentions, even in its unfinished lists, so those items aren't called orphans.
+	listed := make(map[string]bool)
+	for _, feedKey := range feedKeys {
+		feed, err := LoadFeed(con, feedKey)
+		if err == FeedNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if len(feed.InsertedItemKeys) != 0 || len(feed.DeletedItemKeys) != 0 {
+			report.UnfinishedFeeds = append(report.UnfinishedFeeds, feedKey)
+		}
+		for _, lists := range []ItemKeyList{feed.ItemKeys, feed.InsertedItemKeys, feed.DeletedItemKeys} {
+			for _, key := range lists {
+				listed[key.GetRiakKey()] = true
+			}
+		}
+		for _, key := range feed.ItemKeys {
+			if !stored[key.GetRiakKey()] {
+				report.DanglingItemKeys[feedKey] = append(report.DanglingItemKeys[feedKey], key)
+			}
+		}
+
+		// Deleted items are going away, so only the rest need indexing.
+		indexedKeys, err := ItemKeysForFeed(con, feedKey)
+		if err != nil {
+			return nil, err
+		}
+		indexed := make(map[string]bool, len(indexedKeys))
+		for _, key := range indexedKeys {
+			indexed[key.GetRiakKey()] = true
+		}
+		kept := append(append(ItemKeyList{}, feed.ItemKeys...), feed.InsertedItemKeys...)
+		sort.Sort(sort.Reverse(kept))
+		for _, key := range kept {
+			if stored[key.GetRiakKey()] && !indexed[key.GetRiakKey()] {
+				report.UnindexedItems[feedKey] = append(report.UnindexedItems[feedKey], key)
+			}
+		}
+	}
+
+	for _, riakKey := range itemKeys {
+		if listed[riakKey] {
+			continue
+		}
+		key, err := ParseItemKey(riakKey)
+		if err != nil {
+			return nil, err
+		}
+		report.OrphanedItems = append(report.OrphanedItems, key)
+	}
+	sort.Sort(sort.Reverse(report.OrphanedItems))
+
+	for _, scan := range []struct {
+		bucket string
+		keys   []string
+	}{{"feeds", feedKeys}, {"items", itemKeys}} {
+		explosions, err := findSiblingExplosions(con, scan.bucket, scan.keys)
+		if err != nil {
+			return nil, err
+		}
+		report.SiblingExplosions = append(report.SiblingExplosions, explosions...)
+	}
+
+	if repair && !report.Consistent() {
+		if err := repairConsistency(con, report); err != nil {
+			return report, err
+		}
+		report.Repaired = true
+	}
+	return report, nil
+}
+
+func repairConsistency(con *riak.Client, report *ConsistencyReport) error {
+	// Feeds first, as finishing an update deletes items.
+	toRepair := make(map[string]bool)
+	for _, feedKey := range report.UnfinishedFeeds {
+		toRepair[feedKey] = true
+	}
+	for feedKey := range report.DanglingItemKeys {
+		toRepair[feedKey] = true
+	}
+	for _, explosion := range report.SiblingExplosions {
+		if explosion.Bucket == "feeds" {
+			toRepair[explosion.Key] = true
+		}
+	}
+
+	var errs []error
+	for feedKey := range toRepair {
+		if err := repairFeed(con, feedKey, report.DanglingItemKeys[feedKey]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := deleteItems(con, report.OrphanedItems, newSearchIndexBatch()); err != nil {
+		errs = append(errs, err)
+	}
+
+	errCh := make(chan error)
+
+	for feedKey, keys := range report.UnindexedItems {
+		for _, key := range keys {
+			go func(feedKey string, key ItemKey) {
+				errCh <- indexItem(con, feedKey, key)
+			}(feedKey, key)
+		}
+		drainErrorChannelIntoSlice(errCh, &errs, len(keys))
+	}
+
+	// Loading resolves the siblings, and saving stores the result over all of them.
+	for _, explosion := range report.SiblingExplosions {
+		if explosion.Bucket != "items" {
+			continue
+		}
+		item := &FeedItem{}
+		if err := con.LoadModel(explosion.Key, item); err == riak.NotFound {
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+		} else if err := item.Save(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) != 0 {
+		return MultiError(errs)
+	}
+	return nil
+}
+
+// Records which feed the item belongs to, and saves it so its indexes are written.
+func indexItem(con *riak.Client, feedKey string, key ItemKey) error {
+	item := &FeedItem{}
+	if err := con.LoadModel(key.GetRiakKey(), item); err == riak.NotFound {
+		return nil // Deleted since it was found.
+	} else if err != nil {
+		return err
+	}
+	item.Feed = feedKey
+	item.updateIndexes()
+	return item.Save()
+}
+
+// Finishes whatever update the feed was in the middle of, and drops dangling from its ItemKeys.
+func repairFeed(con *riak.Client, feedKey string, dangling ItemKeyList) error {
+	feed, err := LoadFeed(con, feedKey)
+	if err == FeedNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := finishInsertedItems(con, feed); err != nil {
+		return err
+	}
+	sort.Sort(sort.Reverse(feed.ItemKeys))
+	RemoveSliceElements(&feed.ItemKeys, &dangling)
+
+	if err := deleteItems(con, feed.DeletedItemKeys, newSearchIndexBatch()); err != nil {
+		return err
+	}
+	feed.DeletedItemKeys = nil
+
+	return feed.Save()
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"reflect"
+
+	"testing"
+)
+
+func TestCheckConsistency(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	var (
+		inserted ItemKey = genItemKey(60, "C")
+		listed   ItemKey = genItemKey(50, "A")
+		missing  ItemKey = genItemKey(40, "B")
+		deleted  ItemKey = genItemKey(30, "D")
+		orphan   ItemKey = genItemKey(20, "E")
+	)
+	for _, key := range []ItemKey{listed, inserted, deleted, orphan} {
+		mustCreateEmptyItemAt(t, con, key)
+	}
+
+	feed := CreateFeed(t, con, getUniqueExampleComUrl(t))
+	feed.ItemKeys = ItemKeyList{listed, missing}
+	feed.InsertedItemKeys = ItemKeyList{inserted}
+	feed.DeletedItemKeys = ItemKeyList{deleted}
+	if err := feed.Save(); err != nil {
+		t.Fatalf("Failed to save feed (%s)", err)
+	}
+
+	report, err := CheckConsistency(con, false)
+	if err != nil {
+		t.Fatalf("Failed to check consistency (%s)", err)
+	}
+	if report.FeedsChecked != 1 || report.ItemsChecked != 4 {
+		t.Errorf("Wrong number of objects checked (%+v)", report)
+	}
+	if !reflect.DeepEqual(report.OrphanedItems, ItemKeyList{orphan}) {
+		t.Errorf("Wrong orphans found (%v)", report.OrphanedItems)
+	}
+	if !reflect.DeepEqual(report.DanglingItemKeys, map[string]ItemKeyList{feed.UrlKey(): {missing}}) {
+		t.Errorf("Wrong dangling keys found (%v)", report.DanglingItemKeys)
+	}
+	if !reflect.DeepEqual(report.UnfinishedFeeds, []string{feed.UrlKey()}) {
+		t.Errorf("Wrong unfinished feeds found (%v)", report.UnfinishedFeeds)
+	}
+	// The items were stored without a feed, like items from before the feed index.
+	if !reflect.DeepEqual(report.UnindexedItems, map[string]ItemKeyList{feed.UrlKey(): {inserted, listed}}) {
+		t.Errorf("Wrong unindexed items found (%v)", report.UnindexedItems)
+	}
+	if report.Consistent() || report.Repaired {
+		t.Errorf("Report should show problems without repairing them (%+v)", report)
+	}
+
+	if report, err = CheckConsistency(con, true); err != nil {
+		t.Fatalf("Failed to repair (%s)", err)
+	} else if !report.Repaired {
+		t.Errorf("Report doesn't say it repaired anything (%+v)", report)
+	}
+
+	loaded, err := LoadFeed(con, feed.UrlKey())
+	if err != nil {
+		t.Fatalf("Failed to load feed (%s)", err)
+	}
+	if !reflect.DeepEqual(loaded.ItemKeys, ItemKeyList{inserted, listed}) || len(loaded.InsertedItemKeys) != 0 || len(loaded.DeletedItemKeys) != 0 {
+		t.Errorf("Feed wasn't repaired (%+v)", loaded)
+	}
+	if !checkAllItemsDeleted(t, ItemKeyList{deleted, orphan}, con) {
+		t.Error("Deleted and orphaned items weren't removed")
+	}
+	if indexed, err := ItemKeysForFeed(con, feed.UrlKey()); err != nil {
+		t.Fatalf("Failed to list the feed's items (%s)", err)
+	} else if !reflect.DeepEqual(indexed, ItemKeyList{inserted, listed}) {
+		t.Errorf("Items weren't indexed (%v)", indexed)
+	}
+
+	if report, err = CheckConsistency(con, false); err != nil {
+		t.Fatalf("Failed to check consistency (%s)", err)
+	} else if !report.Consistent() {
+		t.Errorf("Still inconsistent after repairing (%+v)", report)
+	}
+}
@@ -32,6 +32,22 @@ func setupBucket(cli *riak.Client, bucketName string) error {
 	return nil
 }
 
+// Deletes key from the named bucket.  A key that is already gone is not an error.
+func deleteObject(cli *riak.Client, bucketName, key string) error {
+	bucket, err := cli.Bucket(bucketName)
+	if err != nil {
+		return err
+	}
+	if obj, err := bucket.Get(key); obj == nil {
+		if err == riak.NotFound {
+			return nil
+		}
+		return err
+	} else {
+		return obj.Destroy()
+	}
+}
+
 func GetDatabaseConnection(addr string) (*riak.Client, error) {
 	cli := riak.NewClientPool(addr, 100)
 	err := cli.Connect()
@@ -50,5 +66,33 @@ func GetDatabaseConnection(addr string) (*riak.Client, error) {
 		return nil, err
 	}
 
+	// Webhook registrations, and their queued deliveries.
+	err = setupBucket(cli, "webhooks")
+	if err != nil {
+		return nil, err
+	}
+
+	err = setupBucket(cli, "webhook_deliveries")
+	if err != nil {
+		return nil, err
+	}
+
+	// Users, and their state for each feed they read.
+	err = setupBucket(cli, "users")
+	if err != nil {
+		return nil, err
+	}
+
+	err = setupBucket(cli, "user_feed_states")
+	if err != nil {
+		return nil, err
+	}
+
+	// The full text search index.
+	err = setupBucket(cli, "search_terms")
+	if err != nil {
+		return nil, err
+	}
+
 	return cli, nil
 }
@@ -81,6 +81,21 @@ func killTestDb(con *riak.Client, t *testing.T) {
 	if err := killBucket(con, "items"); err != nil {
 		t.Fatalf("Failed to kill items feeds (%s)", err)
 	}
+	if err := killBucket(con, "webhooks"); err != nil {
+		t.Fatalf("Failed to kill bucket webhooks (%s)", err)
+	}
+	if err := killBucket(con, "webhook_deliveries"); err != nil {
+		t.Fatalf("Failed to kill bucket webhook_deliveries (%s)", err)
+	}
+	if err := killBucket(con, "users"); err != nil {
+		t.Fatalf("Failed to kill bucket users (%s)", err)
+	}
+	if err := killBucket(con, "user_feed_states"); err != nil {
+		t.Fatalf("Failed to kill bucket user_feed_states (%s)", err)
+	}
+	if err := killBucket(con, "search_terms"); err != nil {
+		t.Fatalf("Failed to kill bucket search_terms (%s)", err)
+	}
 }
 
 func TestBucketsAfterConnect(t *testing.T) {
@@ -22,7 +22,8 @@ import (
 	"net/url"
 
 	"sort"
-	"strconv"
+
+	"time"
 
 	riak "github.com/tpjg/goriakpbc"
 )
@@ -30,9 +31,39 @@ import (
 var FeedNotFound = errors.New("Failed to find feed in riak!")
 
 const (
+	// The default for how many items a feed keeps.  See RetentionPolicy.
 	MaximumFeedItems = 10000
 )
 
+// FeedUpdateResult describes what happened to a single feed as it went through the pipeline.  When
+// Err is set, the feed failed somewhere along the way and only Url is otherwise valid.
+type FeedUpdateResult struct {
+	Url url.URL
+	Err error
+
+	// The feed as it was saved.
+	Model *Feed
+
+	Inserted int // New items, including items re-inserted due to a changed publication date.
+	Updated  int // Existing items whose content changed.
+	Deleted  int // Items removed for any reason other than the feed's retention policy.
+	Evicted  int // Items removed by the feed's retention policy.
+
+	// The keys given to the inserted items, sorted like Feed.ItemKeys.
+	NewItemKeys ItemKeyList
+	// The keys of the updated items, in the order they appeared in the feed.
+	UpdatedItemKeys ItemKeyList
+	// The keys of every removed item, evicted or not.
+	DeletedItemKeys ItemKeyList
+
+	FetchDuration time.Duration
+	Bytes         int
+
+	// Results for pushed content only go as far as publishing item events.  Nothing polled them, so
+	// nothing waits for them.
+	Pushed bool
+}
+
 func drainErrorChannelIntoSlice(errCh <-chan error, errorSlice *[]error, responses int) {
 	for i := 0; i < responses; i++ {
 		err := <-errCh
@@ -42,62 +73,170 @@ func drainErrorChannelIntoSlice(errCh <-chan error, errorSlice *[]error, respons
 	}
 }
 
-func InsertItem(con *riak.Client, itemKey ItemKey, item ParsedFeedItem) error {
+func InsertItem(con *riak.Client, feedKey string, itemKey ItemKey, item ParsedFeedItem) error {
+	batch := newSearchIndexBatch()
+	if err := insertItem(con, feedKey, itemKey, item, nil, batch); err != nil {
+		return err
+	}
+	return batch.write(con)
+}
+
+// Inserts an item that carries the history of the item it replaces.  Its search terms are added to
+// batch, which the caller writes.
+func insertItem(con *riak.Client, feedKey string, itemKey ItemKey, item ParsedFeedItem, revisions []ItemRevision, batch *searchIndexBatch) error {
 	itemModel := FeedItem{
+		Feed: feedKey,
+
 		Title:   item.Title,
 		Author:  item.Author,
 		Content: item.Content,
 		Url:     item.Url,
 		PubDate: item.PubDate,
+
+		Categories: item.Categories,
+
+		Revisions: revisions,
 	}
 	if err := con.LoadModel(itemKey.GetRiakKey(), &itemModel); err != riak.NotFound {
 		return err
-	} else if err = itemModel.Save(); err != nil {
+	}
+	itemModel.updateIndexes()
+	start := time.Now()
+	err := itemModel.Save()
+	observeRiak("insert_item", start, err)
+	if err != nil {
 		return err
 	}
+	batch.add(itemKey, nil, &itemModel)
 	return nil
 }
 
-func UpdateItem(con *riak.Client, itemKey ItemKey, item ParsedFeedItem, itemModel *FeedItem) error {
+func UpdateItem(con *riak.Client, feedKey string, itemKey ItemKey, item ParsedFeedItem, itemModel *FeedItem) error {
+	batch := newSearchIndexBatch()
+	if err := updateItem(con, feedKey, itemKey, item, itemModel, batch); err != nil {
+		return err
+	}
+	return batch.write(con)
+}
+
+// Like UpdateItem, but the search term changes are added to batch, which the caller writes.
+func updateItem(con *riak.Client, feedKey string, itemKey ItemKey, item ParsedFeedItem, itemModel *FeedItem, batch *searchIndexBatch) error {
+	old := &FeedItem{Title: itemModel.Title, Author: itemModel.Author, Content: itemModel.Content}
+
+	// Category changes aren't worth remembering.
+	if itemModel.revisionDiffers(item) {
+		itemModel.addRevision(time.Now())
+	}
 	itemModel.Title = item.Title
 	itemModel.Author = item.Author
 	itemModel.Content = item.Content
+	itemModel.Categories = item.Categories
 	itemModel.Url = item.Url
 	itemModel.PubDate = item.PubDate
+	itemModel.Feed = feedKey
+	itemModel.updateIndexes()
 
-	if err := itemModel.Save(); err != nil {
+	start := time.Now()
+	err := itemModel.Save()
+	observeRiak("update_item", start, err)
+	if err != nil {
 		return err
 	}
+	batch.add(itemKey, old, itemModel)
 	return nil
 }
 
+// Deletes the item, and removes it from the search index.  An item that is already gone is not an
+// error.
+func DeleteItem(con *riak.Client, itemKey ItemKey) error {
+	return deleteItems(con, ItemKeyList{itemKey}, newSearchIndexBatch())
+}
+
+// Deletes the items like DeleteItem.  Their removal from the search index is added to batch, which is
+// then written along with anything already in it before the items themselves go.
+func deleteItems(con *riak.Client, itemKeys ItemKeyList, batch *searchIndexBatch) error {
+	itemModels := make([]*FeedItem, len(itemKeys))
+	errCh := make(chan error)
+	for i, itemKey := range itemKeys {
+		go func(i int, itemKey ItemKey) {
+			itemModel := &FeedItem{}
+			if err := con.LoadModel(itemKey.GetRiakKey(), itemModel); err == riak.NotFound {
+				errCh <- nil
+				return
+			} else if err != nil {
+				errCh <- err
+				return
+			}
+			batch.add(itemKey, itemModel, nil)
+			itemModels[i] = itemModel
+			errCh <- nil
+		}(i, itemKey)
+	}
+	var errs []error
+	drainErrorChannelIntoSlice(errCh, &errs, len(itemKeys))
+	if len(errs) != 0 {
+		return MultiError(errs)
+	}
+
+	if err := batch.write(con); err != nil {
+		return err
+	}
+
+	deleting := 0
+	for _, itemModel := range itemModels {
+		if itemModel == nil {
+			continue
+		}
+		deleting++
+		go func(itemModel *FeedItem) {
+			start := time.Now()
+			err := itemModel.Delete()
+			observeRiak("delete_item", start, err)
+			errCh <- err
+		}(itemModel)
+	}
+	drainErrorChannelIntoSlice(errCh, &errs, deleting)
+	if len(errs) != 0 {
+		return MultiError(errs)
+	}
+	return nil
+}
+
+func categoriesDiffer(l, r []string) bool {
+	if len(l) != len(r) {
+		return true
+	}
+	for i := range l {
+		if l[i] != r[i] {
+			return true
+		}
+	}
+	return false
+}
+
 func itemDiffersFromModel(feedItem ParsedFeedItem, itemModel *FeedItem) bool {
-	return itemModel.Title != feedItem.Title ||
+	return categoriesDiffer(itemModel.Categories, feedItem.Categories) ||
+		itemModel.Title != feedItem.Title ||
 		itemModel.Author != feedItem.Author ||
 		itemModel.Content != feedItem.Content ||
-		itemModel.Url != feedItem.Url ||
-		itemModel.PubDate != feedItem.PubDate
+		itemModel.Url.String() != feedItem.Url.String() ||
+		!itemModel.PubDate.Equal(feedItem.PubDate)
 }
 
-func updateFeed(con *riak.Client, feedUrl url.URL, feedData ParsedFeedData, ids <-chan uint64) (*Feed, error) {
-	feed := &Feed{Url: feedUrl}
-	if err := con.LoadModel(feed.UrlKey(), feed); err == riak.NotFound {
-		return nil, FeedNotFound
-	} else if err != nil {
-		return nil, err
-	}
-	// First clean out inserted item keys.  This handles unfinished previous operations.
+// Moves the feed's InsertedItemKeys into ItemKeys if their items were stored, and drops them otherwise.
+// ItemKeys is left unsorted.
+func finishInsertedItems(con *riak.Client, feed *Feed) error {
 	itemsBucket, err := con.Bucket("items")
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// Note, this insert items without caring about the 10,000 limit.  Of course, any regular inserted
+	// Note, this insert items without caring about the retention policy.  Of course, any regular inserted
 	// item will force the limit back down.
 	for _, itemKey := range feed.InsertedItemKeys {
 		// Does this item exist?
 		if ok, err := itemsBucket.Exists(itemKey.GetRiakKey()); err != nil {
-			return nil, err
+			return err
 		} else if ok {
 			// Yep, so add it to the list.
 			feed.ItemKeys = append(feed.ItemKeys, itemKey)
@@ -105,13 +244,39 @@ func updateFeed(con *riak.Client, feedUrl url.URL, feedData ParsedFeedData, ids
 		// Otherwise non-existent items are dropped.  This is to avoid
 	}
 	feed.InsertedItemKeys = nil
+	return nil
+}
+
+func updateFeed(con *riak.Client, feedUrl url.URL, feedData ParsedFeedData, ids <-chan uint64) (*FeedUpdateResult, error) {
+	return updateLeasedFeed(con, "", feedUrl, feedData, ids)
+}
+
+// Updates a feed claimed for holder, failing with FeedLeased if another node took it over meanwhile.
+// An empty holder updates without checking the lease.
+func updateLeasedFeed(con *riak.Client, holder string, feedUrl url.URL, feedData ParsedFeedData, ids <-chan uint64) (*FeedUpdateResult, error) {
+	feed := &Feed{Url: feedUrl}
+	start := time.Now()
+	err := con.LoadModel(feed.UrlKey(), feed)
+	observeRiak("load_feed", start, err)
+	if err == riak.NotFound {
+		return nil, FeedNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	// First clean out inserted item keys.  This handles unfinished previous operations.
+	if err := finishInsertedItems(con, feed); err != nil {
+		return nil, err
+	}
 
 	// Next update the basic attributes
 	feed.Title = feedData.Title
 	feed.NextCheck = feedData.NextCheckTime
 	feed.LastCheck = feedData.FetchedAt
+	feed.Failures = 0
+	feed.FailuresUpdated = feedData.FetchedAt
+	updateFeedWebSub(feed, feedData)
 	// Also set 2i to appropriate values!
-	feed.Indexes()[NextCheckIndexName] = strconv.FormatInt(feed.NextCheck.Unix(), 10)
+	feed.updateIndexes()
 
 	/* Next find all the feed items to insert/update.  If the item doesn't exist, create it's id and
 	 * mark for insert.  Otherwise mark it for an read/update/store pass.  Make sure to mark for
@@ -122,10 +287,48 @@ func updateFeed(con *riak.Client, feedUrl url.URL, feedData ParsedFeedData, ids
 		ItemKey ItemKey
 		Data    ParsedFeedItem
 		Model   *FeedItem
+		// The history carried over to a re-inserted item.
+		Revisions []ItemRevision
 	}
 	NewItems := make([]ToProcess, 0)
 	UpdatedItems := make([]ToProcess, 0)
 	SeenNewItemKeys := make(map[string]bool)
+	// Anything left over from a previous run is deleted along with whatever this run deletes.
+	deletedCount, evictedCount := len(feed.DeletedItemKeys), 0
+
+	policy := feed.RetentionPolicy()
+	cutoff := policy.cutoff(feedData.FetchedAt)
+	var starred ItemKeyList
+	if policy.KeepStarred {
+		var err error
+		if starred, err = StarredItemKeys(con, feed.UrlKey()); err != nil {
+			return nil, err
+		}
+	}
+	// How many items count towards policy.MaxItems.
+	counted := 0
+	for _, itemKey := range feed.ItemKeys {
+		if !policy.keeps(itemKey, starred) {
+			counted++
+		}
+	}
+	// Stored items that grew too old are left to SweepFeedRetention, as finding them means loading
+	// every item.
+	evict := func(index int) {
+		itemKey := feed.ItemKeys[index]
+		// insert it onto the end of the deleted item list.
+		feed.DeletedItemKeys = append(feed.DeletedItemKeys, itemKey)
+		// If we are updating this key, then remove it from this list.  No need to waste time.
+		for i, item := range UpdatedItems {
+			if item.ItemKey.Equal(itemKey) {
+				UpdatedItems = append(UpdatedItems[:i], UpdatedItems[i+1:]...)
+				break
+			}
+		}
+		feed.ItemKeys.RemoveAt(index)
+		counted--
+		evictedCount++
+	}
 
 	for _, rawItem := range feedData.Items {
 		// Try to find the raw Item in the Item Keys list.
@@ -138,7 +341,10 @@ func updateFeed(con *riak.Client, feedUrl url.URL, feedData ParsedFeedData, ids
 				Model:   &FeedItem{},
 			}
 
-			if err := con.LoadModel(p.ItemKey.GetRiakKey(), p.Model); err != nil {
+			start := time.Now()
+			err := con.LoadModel(p.ItemKey.GetRiakKey(), p.Model)
+			observeRiak("load_item", start, err)
+			if err != nil {
 				return nil, err
 			}
 
@@ -146,38 +352,50 @@ func updateFeed(con *riak.Client, feedUrl url.URL, feedData ParsedFeedData, ids
 			// move it up the chain.  Otherwise, just update the content.  If an item has no pub date,
 			// assume that it has changed if the any part of the item changed.
 			if p.Model.PubDate.Equal(p.Data.PubDate) && !(p.Data.PubDate.IsZero() && itemDiffersFromModel(p.Data, p.Model)) {
-				// Pub dates are the same.  Just modify the item to match what is in the feed.
-				UpdatedItems = append(UpdatedItems, p)
+				// Pub dates are the same.  Just modify the item to match what is in the feed, if
+				// anything actually changed.
+				if itemDiffersFromModel(p.Data, p.Model) {
+					UpdatedItems = append(UpdatedItems, p)
+				}
 			} else {
 				// Pub dates differ.  Delete the item, and re-insert it.
 				feed.DeletedItemKeys = append(feed.DeletedItemKeys, p.ItemKey)
+				if !policy.keeps(p.ItemKey, starred) {
+					counted--
+				}
 				feed.ItemKeys.RemoveAt(index)
+				deletedCount++
 
-				// Delete the model from the to process struct.
+				// Keep the old version in the history, then delete the model from the to process struct.
+				if p.Model.revisionDiffers(p.Data) {
+					p.Model.addRevision(feedData.FetchedAt)
+				}
+				p.Revisions = p.Model.Revisions
 				p.Model = &FeedItem{}
 
-				NewItems = append(NewItems, p) // This gives us the new id.
+				// Unless the new date makes it too old to keep.
+				if !policy.expired(feedData.FetchedAt, p.Data.PubDate, cutoff) {
+					NewItems = append(NewItems, p) // This gives us the new id.
+				}
 			}
-		} else {
-			// Nope, lets insert it!  First, should we knock off an item?  e need to stay below MaximumFeedItems.
-			for (len(feed.ItemKeys)+len(NewItems)) >= MaximumFeedItems && len(feed.ItemKeys) > 0 {
-				// Need to kill an item.  So get the last key
-				lastKey := feed.ItemKeys[len(feed.ItemKeys)-1]
-				// insert it onto the end of the deleted item list.
-				feed.DeletedItemKeys = append(feed.DeletedItemKeys, lastKey)
-				// If we are updating this key, then remove it from this list.  No need to waste
-				// time.
-				for i, item := range UpdatedItems {
-					if item.ItemKey.Equal(lastKey) {
-						UpdatedItems = append(UpdatedItems[:i], UpdatedItems[i+1:]...)
-					}
+		} else if !policy.expired(feedData.FetchedAt, rawItem.PubDate, cutoff) {
+			// Nope, lets insert it, as it isn't already too old to keep!  First, should we knock off an
+			// item?  We need to stay below the policy's MaxItems.
+			for policy.MaxItems > 0 && counted+len(NewItems) >= policy.MaxItems {
+				// Need to kill an item.  So find the last one that isn't kept regardless.
+				last := len(feed.ItemKeys) - 1
+				for ; last >= 0 && policy.keeps(feed.ItemKeys[last], starred); last-- {
 				}
-				// And finally, pop the item
-				feed.ItemKeys = feed.ItemKeys[:len(feed.ItemKeys)-1]
+				if last < 0 {
+					// Only kept items are left, and they don't count towards MaxItems, so the new items
+					// alone fill it.  The check below drops this one.
+					break
+				}
+				evict(last)
 			}
-			// Only insert if there are less then MaximumFeedItems already to be inserted.
+			// Only insert if there are less then MaxItems already to be inserted.
 			// This works since any later item will have been updated after.
-			if len(NewItems) < MaximumFeedItems {
+			if policy.MaxItems <= 0 || len(NewItems) < policy.MaxItems {
 				// Also, make sure we aren't inserting the same item twice.  If it is duplicated, the
 				// second item is guaranteed to be later.  So just drop it.
 				if keyString := string(rawItem.GenericKey); SeenNewItemKeys[keyString] == false {
@@ -201,9 +419,20 @@ func updateFeed(con *riak.Client, feedUrl url.URL, feedData ParsedFeedData, ids
 		feed.InsertedItemKeys = append(feed.InsertedItemKeys, newItem.ItemKey)
 	}
 	sort.Sort(feed.InsertedItemKeys)
+	// Evicting and re-inserting append out of order, and merging siblings needs these sorted like ItemKeys.
+	sort.Sort(sort.Reverse(feed.DeletedItemKeys))
+
+	// Nothing is written before this point, so this is the last chance to back off from a lost lease.
+	if holder != "" {
+		if current, err := LoadFeed(con, feed.UrlKey()); err != nil {
+			return nil, err
+		} else if current.LeaseHolder != holder {
+			return nil, FeedLeased
+		}
+	}
 
 	// Ok, we must save here.  Otherwise planned changes may occur that will not be cleaned up!
-	if err := feed.Save(); err != nil {
+	if err := saveFeed(feed); err != nil {
 		return nil, err
 	}
 
@@ -211,11 +440,32 @@ func updateFeed(con *riak.Client, feedUrl url.URL, feedData ParsedFeedData, ids
 
 	// Good, now implement the change and update the Feed.
 
+	result := &FeedUpdateResult{
+		Url:   feedUrl,
+		Model: feed,
+
+		Inserted: len(NewItems),
+		Updated:  len(UpdatedItems),
+		Deleted:  deletedCount,
+		Evicted:  evictedCount,
+
+		NewItemKeys:     append(ItemKeyList(nil), feed.InsertedItemKeys...),
+		DeletedItemKeys: append(ItemKeyList(nil), feed.DeletedItemKeys...),
+	}
+	sort.Sort(sort.Reverse(result.NewItemKeys))
+	for _, updatedItem := range UpdatedItems {
+		result.UpdatedItemKeys = append(result.UpdatedItemKeys, updatedItem.ItemKey)
+	}
+
+	// The search index changes of the whole update are gathered here, and written once with the
+	// deletes below.
+	batch := newSearchIndexBatch()
+
 	// First add new items
 	for _, newItem := range NewItems {
 		feed.ItemKeys = append(feed.ItemKeys, newItem.ItemKey)
 		go func(newItem ToProcess) {
-			errCh <- InsertItem(con, newItem.ItemKey, newItem.Data)
+			errCh <- insertItem(con, feed.UrlKey(), newItem.ItemKey, newItem.Data, newItem.Revisions, batch)
 		}(newItem)
 	}
 	feed.InsertedItemKeys = nil
@@ -223,55 +473,86 @@ func updateFeed(con *riak.Client, feedUrl url.URL, feedData ParsedFeedData, ids
 	// Now update them.
 	for _, newItem := range UpdatedItems {
 		go func(newItem ToProcess) {
-			errCh <- UpdateItem(con, newItem.ItemKey, newItem.Data, newItem.Model)
+			errCh <- updateItem(con, feed.UrlKey(), newItem.ItemKey, newItem.Data, newItem.Model, batch)
 		}(newItem)
 	}
 
-	// Finally delete items.
-	for _, deleteItemKey := range feed.DeletedItemKeys {
-		go func(toDelete ItemKey) {
-			if obj, err := itemsBucket.Get(toDelete.GetRiakKey()); obj == nil {
-				errCh <- err
-			} else {
-				errCh <- obj.Destroy()
-			}
-		}(deleteItemKey)
-	}
-	deletedItemCount := len(feed.DeletedItemKeys) // Need this to drain the error channel later.
-	// Ok, deleted.  So clear the list
-	feed.DeletedItemKeys = nil
-
 	sort.Sort(sort.Reverse(feed.ItemKeys)) // Just sort this.  TBD: Actually maintain this sort order to avoid this!
 
 	//Now, collect the errors
 	var errs []error
 	drainErrorChannelIntoSlice(errCh, &errs, len(NewItems))
 	drainErrorChannelIntoSlice(errCh, &errs, len(UpdatedItems))
-	drainErrorChannelIntoSlice(errCh, &errs, deletedItemCount)
 	if len(errs) != 0 {
 		return nil, MultiError(errs)
 	}
 
-	if err := feed.Save(); err != nil {
+	// Finally delete items, which also writes the search index.
+	if err := deleteItems(con, feed.DeletedItemKeys, batch); err != nil {
 		return nil, err
 	}
+	// Ok, deleted.  So clear the list
+	feed.DeletedItemKeys = nil
 
-	return feed, nil
+	if err := saveFeed(feed); err != nil {
+		return nil, err
+	}
+
+	return result, nil
 }
 
-type UpdatedModel struct {
-	Url   url.URL
-	Model *Feed
+func saveFeed(feed *Feed) error {
+	start := time.Now()
+	err := feed.Save()
+	observeRiak("save_feed", start, err)
+	return err
+}
+
+func UpdateFeed(con *riak.Client, idGenerator <-chan uint64, in <-chan FeedParserOut, out chan<- FeedUpdateResult, errChan chan<- FeedError) {
+	updateFeeds(con, idGenerator, in, out, errChan, RssMasterConfig{Logger: DefaultLogger})
 }
 
-func UpdateFeed(con *riak.Client, idGenerator <-chan uint64, in <-chan FeedParserOut, out chan<- UpdatedModel, errChan chan<- FeedError) {
+// Stores what comes out of the parser.  Feeds are updated as config.Node, which must hold their lease
+// for polled content.  Pushed content claims the lease here, and is dropped if another node holds it, as
+// that node's poll will find the same content.  Without a Node, leases aren't checked.
+func updateFeeds(con *riak.Client, idGenerator <-chan uint64, in <-chan FeedParserOut, out chan<- FeedUpdateResult, errChan chan<- FeedError, config RssMasterConfig) {
+	logger := config.Logger
 	for {
 		if next, ok := <-in; ok {
-			model, err := updateFeed(con, next.Url, next.Data, idGenerator)
-			if err != nil {
-				errChan <- FeedError{err, next.Url}
+			feedLogger := logger
+			if next.Pushed {
+				feedLogger = logger.With(LogField{"pushed", true})
+			}
+
+			start := time.Now()
+			var result *FeedUpdateResult
+			var err error
+			if next.Pushed && config.Node != "" {
+				_, err = ClaimFeed(con, (&Feed{Url: next.Url}).UrlKey(), config.Node, start, config.LeaseDuration)
+			}
+			if err == nil {
+				result, err = updateLeasedFeed(con, config.Node, next.Url, next.Data, idGenerator)
+			}
+			if err == FeedLeased && next.Pushed {
+				feedLogger.Log(LogInfo, "Dropped content pushed to a feed leased to another node", FeedField(next.Url))
+			} else if err != nil {
+				storeErr := StoreError{err}
+				feedLogger.Log(LogWarn, "Failed to store feed", FeedField(next.Url), StageField(StoreStage), ErrorField(storeErr), RetryableField(storeErr))
+				// Failed pushes have already been logged, and nothing is waiting to hear about them.
+				if !next.Pushed {
+					errChan <- FeedError{storeErr, next.Url}
+				}
 			} else {
-				out <- UpdatedModel{next.Url, model}
+				feedLogger.Log(LogDebug, "Updated feed", FeedField(next.Url), StageField(StoreStage), ItemCountField(result.Inserted), DurationField(time.Since(start)),
+					LogField{"updated", result.Updated}, LogField{"deleted", result.Deleted}, LogField{"evicted", result.Evicted})
+				result.FetchDuration = next.FetchDuration
+				result.Bytes = next.Bytes
+				result.Pushed = next.Pushed
+				itemsMetric.Add(float64(result.Inserted), "inserted")
+				itemsMetric.Add(float64(result.Updated), "updated")
+				itemsMetric.Add(float64(result.Deleted), "deleted")
+				itemsMetric.Add(float64(result.Evicted), "evicted")
+				out <- *result
 			}
 		} else {
 			break
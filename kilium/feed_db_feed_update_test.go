@@ -227,10 +227,11 @@ func TestSingleFeedInsert(t *testing.T) {
 
 	feedModel := CreateFeed(t, con, url)
 
-	updatedFeed, err := updateFeed(con, *url, *feed, testIdGenerator)
+	result, err := updateFeed(con, *url, *feed, testIdGenerator)
 	if err != nil {
-		t.Errorf("Failed to update simple single feed (%s)!", err)
+		t.Fatalf("Failed to update simple single feed (%s)!", err)
 	}
+	updatedFeed := result.Model
 
 	// Finally, load the feed again and verify properties!
 	loadFeed := &Feed{}
@@ -303,6 +304,49 @@ func TestFeedUpdateWithChangingPubDates(t *testing.T) {
 	}
 }
 
+func TestFeedUpdateResultCounts(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	url := getUniqueExampleComUrl(t)
+
+	CreateFeed(t, con, url)
+
+	feed := fixFeedForMerging(getFeedDataFor(t, "simple", 0))
+	result, err := updateFeed(con, *url, *feed, testIdGenerator)
+	if err != nil {
+		t.Fatalf("Failed to insert simple single feed (%s)!", err)
+	}
+	if result.Inserted != 3 || result.Updated != 0 || result.Deleted != 0 || result.Evicted != 0 {
+		t.Errorf("Unexpected counts after first insert (%+v)", result)
+	}
+	if !reflect.DeepEqual(result.NewItemKeys, result.Model.ItemKeys) {
+		t.Errorf("New item keys don't match the feed's keys (%v vs %v)", result.NewItemKeys, result.Model.ItemKeys)
+	}
+
+	// Item 1 and 3 change in place, item 2 has no date so it is moved to the top.
+	feed = fixFeedForMerging(getFeedDataFor(t, "simple", 1))
+	result, err = updateFeed(con, *url, *feed, testIdGenerator)
+	if err != nil {
+		t.Fatalf("Failed to update simple single feed (%s)!", err)
+	}
+	if result.Inserted != 1 || result.Updated != 2 || result.Deleted != 1 || result.Evicted != 0 {
+		t.Errorf("Unexpected counts after update (%+v)", result)
+	}
+	if len(result.NewItemKeys) != 1 || !result.NewItemKeys[0].Equal(result.Model.ItemKeys[0]) {
+		t.Errorf("Re-inserted item isn't the newest item (%v vs %v)", result.NewItemKeys, result.Model.ItemKeys)
+	}
+
+	// Nothing changed, so nothing should be touched.
+	result, err = updateFeed(con, *url, *feed, testIdGenerator)
+	if err != nil {
+		t.Fatalf("Failed to update simple single feed (%s)!", err)
+	}
+	if result.Inserted != 0 || result.Updated != 0 || result.Deleted != 0 || result.Evicted != 0 {
+		t.Errorf("Unexpected counts after an unchanged update (%+v)", result)
+	}
+}
+
 func GenerateParsedFeed(rand *rand.Rand) (out ParsedFeedData) {
 	out = ParsedFeedData{}
 	if titleOut, ok := quick.Value(reflect.TypeOf(out.Title), rand); ok {
@@ -0,0 +1,217 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	riak "github.com/tpjg/goriakpbc"
+)
+
+type PageDirection int
+
+const (
+	// Towards smaller keys, or further down ItemKeys.
+	Older PageDirection = iota
+	// Towards bigger keys, or back up ItemKeys.
+	Newer
+)
+
+// A page of a feed's items, newest first.  Items matches Keys, except items that have gone missing
+// are left out of both.
+type ItemPage struct {
+	Keys  ItemKeyList
+	Items []*FeedItem
+
+	// Cursors for the neighbouring pages.  They are nil when there is nothing more in that direction.
+	Older ItemKey
+	Newer ItemKey
+}
+
+// Loads the feed stored at key, which is the feed's UrlKey.
+func LoadFeed(con *riak.Client, key string) (*Feed, error) {
+	feed := &Feed{}
+	start := time.Now()
+	err := con.LoadModel(key, feed)
+	observeRiak("load_feed", start, err)
+	if err == riak.NotFound {
+		return nil, FeedNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return feed, nil
+}
+
+// Lists the keys of every stored feed.  This lists the whole bucket, so it is not cheap.
+func ListFeedKeys(con *riak.Client) ([]string, error) {
+	bucket, err := con.Bucket("feeds")
+	if err != nil {
+		return nil, err
+	}
+	keys, err := bucket.ListKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, len(keys))
+	for i, key := range keys {
+		ret[i] = string(key)
+	}
+	return ret, nil
+}
+
+// Loads every item in keys in parallel.  The returned slice matches keys, with nil in place of any item
+// that no longer exists.
+func LoadFeedItems(con *riak.Client, keys ItemKeyList) ([]*FeedItem, error) {
+	items := make([]*FeedItem, len(keys))
+	errCh := make(chan error)
+
+	for i, key := range keys {
+		go func(i int, key ItemKey) {
+			item := &FeedItem{}
+			start := time.Now()
+			err := con.LoadModel(key.GetRiakKey(), item)
+			observeRiak("load_item", start, err)
+			if err == riak.NotFound {
+				errCh <- nil
+			} else if err != nil {
+				errCh <- err
+			} else {
+				items[i] = item
+				errCh <- nil
+			}
+		}(i, key)
+	}
+
+	var errs []error
+	drainErrorChannelIntoSlice(errCh, &errs, len(keys))
+	if len(errs) != 0 {
+		return nil, MultiError(errs)
+	}
+	return items, nil
+}
+
+// Returns up to limit keys older or newer than cursor, in the list's (descending) order.  The cursor
+// itself is never included, and doesn't need to be in the list.  A nil cursor starts from the newest
+// end when going Older, and the oldest end when going Newer.  The result shares the list's storage.
+func (list ItemKeyList) Page(cursor ItemKey, direction PageDirection, limit int) ItemKeyList {
+	if direction == Older {
+		start := 0
+		if cursor != nil {
+			// The list is descending, so this finds the first key smaller than the cursor.
+			start = sort.Search(len(list), func(i int) bool { return list[i].Less(cursor) })
+		}
+		end := start + limit
+		if end > len(list) {
+			end = len(list)
+		}
+		return list[start:end]
+	}
+
+	end := len(list)
+	if cursor != nil {
+		// First key that isn't bigger than the cursor.
+		end = sort.Search(len(list), func(i int) bool { return !cursor.Less(list[i]) })
+	}
+	start := end - limit
+	if start < 0 {
+		start = 0
+	}
+	return list[start:end]
+}
+
+// Loads a page of feed's items older or newer than cursor.  See ItemKeyList.Page for how the cursor
+// works.  The items are loaded in parallel.
+func LoadItemPage(con *riak.Client, feed *Feed, cursor ItemKey, direction PageDirection, limit int) (*ItemPage, error) {
+	keys := feed.ItemKeys.Page(cursor, direction, limit)
+
+	items, err := LoadFeedItems(con, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &ItemPage{}
+	for i, item := range items {
+		if item != nil {
+			page.Keys = append(page.Keys, keys[i])
+			page.Items = append(page.Items, item)
+		}
+	}
+
+	if len(keys) != 0 {
+		// The cursors come from the keys, not the loaded items, so missing items don't shift pages.
+		if first := keys[0]; len(feed.ItemKeys.Page(first, Newer, 1)) != 0 {
+			page.Newer = first
+		}
+		if last := keys[len(keys)-1]; len(feed.ItemKeys.Page(last, Older, 1)) != 0 {
+			page.Older = last
+		}
+	} else if cursor != nil {
+		// Ran off the end, so the only way is back.
+		if direction == Older && len(feed.ItemKeys.Page(cursor, Newer, 1)) != 0 {
+			page.Newer = cursor
+		} else if direction == Newer && len(feed.ItemKeys.Page(cursor, Older, 1)) != 0 {
+			page.Older = cursor
+		}
+	}
+
+	return page, nil
+}
+
+// Turns riak keys from an index query into a sorted key list.
+func itemKeysFromIndex(riakKeys []string) (ItemKeyList, error) {
+	keys := make(ItemKeyList, 0, len(riakKeys))
+	for _, riakKey := range riakKeys {
+		key, err := ParseItemKey(riakKey)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	sort.Sort(sort.Reverse(keys))
+	return keys, nil
+}
+
+// Finds every stored item of the feed through the feed index, newest first.  Unlike the feed's
+// ItemKeys, this includes items being inserted or deleted, but not items stored before the index
+// until CheckConsistency repairs them.
+func ItemKeysForFeed(con *riak.Client, feedKey string) (ItemKeyList, error) {
+	bucket, err := con.Bucket("items")
+	if err != nil {
+		return nil, err
+	}
+	riakKeys, err := bucket.IndexQuery(ItemFeedIndexName, feedKey)
+	if err != nil {
+		return nil, err
+	}
+	return itemKeysFromIndex(riakKeys)
+}
+
+// Finds every stored item published between start and end, inclusive, newest first by key.
+func ItemKeysPublishedBetween(con *riak.Client, start, end time.Time) (ItemKeyList, error) {
+	bucket, err := con.Bucket("items")
+	if err != nil {
+		return nil, err
+	}
+	riakKeys, err := bucket.IndexQueryRange(ItemPubDateIndexName, strconv.FormatInt(start.Unix(), 10), strconv.FormatInt(end.Unix(), 10))
+	if err != nil {
+		return nil, err
+	}
+	return itemKeysFromIndex(riakKeys)
+}
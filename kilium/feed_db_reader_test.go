@@ -0,0 +1,210 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"strconv"
+	"time"
+
+	"testing"
+)
+
+func TestLoadFeedItems(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	keys := ItemKeyList{
+		NewItemKey(3, makeHash("Load 3"+key_uniquer)),
+		NewItemKey(2, makeHash("Load 2 - DNE"+key_uniquer)),
+		NewItemKey(1, makeHash("Load 1"+key_uniquer)),
+	}
+	if err := InsertItem(con, "", keys[0], ParsedFeedItem{Title: "Three"}); err != nil {
+		t.Fatalf("Failed to insert item (%s)", err)
+	}
+	if err := InsertItem(con, "", keys[2], ParsedFeedItem{Title: "One"}); err != nil {
+		t.Fatalf("Failed to insert item (%s)", err)
+	}
+
+	items, err := LoadFeedItems(con, keys)
+	if err != nil {
+		t.Fatalf("Failed to load items (%s)", err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("Expected 3 results, got %v", len(items))
+	}
+	if items[0] == nil || items[0].Title != "Three" || items[1] != nil || items[2] == nil || items[2].Title != "One" {
+		t.Errorf("Loaded items don't match their keys (%+v)", items)
+	}
+
+	if _, err := LoadFeed(con, "Not a feed"); err != FeedNotFound {
+		t.Errorf("Loading a missing feed didn't give FeedNotFound (%v)", err)
+	}
+}
+
+func TestItemKeyListPage(t *testing.T) {
+	list := ItemKeyList{genItemKey(9, "A"), genItemKey(7, "A"), genItemKey(5, "A"), genItemKey(3, "A"), genItemKey(1, "A")}
+
+	checkPage := func(name string, page ItemKeyList, want ...int64) {
+		if len(page) != len(want) {
+			t.Errorf("%s: expected %v keys, got %v", name, len(want), len(page))
+			return
+		}
+		for i, id := range want {
+			if !page[i].Equal(genItemKey(id, "A")) {
+				t.Errorf("%s: expected key %v at %v, got %v", name, id, i, page[i])
+			}
+		}
+	}
+
+	checkPage("Newest", list.Page(nil, Older, 2), 9, 7)
+	checkPage("Oldest", list.Page(nil, Newer, 2), 3, 1)
+	checkPage("Older than 7", list.Page(genItemKey(7, "A"), Older, 2), 5, 3)
+	checkPage("Newer than 3", list.Page(genItemKey(3, "A"), Newer, 2), 7, 5)
+	// Cursors that aren't in the list still work, for items removed since the page was loaded.
+	checkPage("Older than 6", list.Page(genItemKey(6, "A"), Older, 2), 5, 3)
+	checkPage("Newer than 6", list.Page(genItemKey(6, "A"), Newer, 5), 9, 7)
+	checkPage("Older than 1", list.Page(genItemKey(1, "A"), Older, 2))
+	checkPage("Newer than 9", list.Page(genItemKey(9, "A"), Newer, 2))
+	checkPage("Past the end", list.Page(genItemKey(0, "A"), Newer, 10), 9, 7, 5, 3, 1)
+	checkPage("Empty", ItemKeyList{}.Page(nil, Older, 2))
+}
+
+func TestLoadItemPage(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	feed := &Feed{}
+	for id := 5; id > 0; id-- {
+		key := NewItemKey(uint64(id), makeHash("Page "+strconv.Itoa(id)+key_uniquer))
+		feed.ItemKeys = append(feed.ItemKeys, key)
+		// Leave a hole at 3.
+		if id != 3 {
+			if err := InsertItem(con, "", key, ParsedFeedItem{Title: strconv.Itoa(id)}); err != nil {
+				t.Fatalf("Failed to insert item (%s)", err)
+			}
+		}
+	}
+
+	page, err := LoadItemPage(con, feed, nil, Older, 2)
+	if err != nil {
+		t.Fatalf("Failed to load first page (%s)", err)
+	}
+	if len(page.Items) != 2 || page.Items[0].Title != "5" || page.Newer != nil || !page.Older.Equal(feed.ItemKeys[1]) {
+		t.Errorf("Wrong first page (%+v)", page)
+	}
+
+	page, err = LoadItemPage(con, feed, page.Older, Older, 2)
+	if err != nil {
+		t.Fatalf("Failed to load second page (%s)", err)
+	}
+	if len(page.Items) != 1 || page.Items[0].Title != "2" || !page.Newer.Equal(feed.ItemKeys[2]) || !page.Older.Equal(feed.ItemKeys[3]) {
+		t.Errorf("Wrong second page (%+v)", page)
+	}
+
+	page, err = LoadItemPage(con, feed, page.Older, Older, 2)
+	if err != nil {
+		t.Fatalf("Failed to load last page (%s)", err)
+	}
+	if len(page.Items) != 1 || page.Items[0].Title != "1" || page.Older != nil {
+		t.Errorf("Wrong last page (%+v)", page)
+	}
+
+	page, err = LoadItemPage(con, feed, page.Newer, Newer, 2)
+	if err != nil {
+		t.Fatalf("Failed to page back (%s)", err)
+	}
+	if len(page.Keys) != 1 || !page.Keys[0].Equal(feed.ItemKeys[3]) || !page.Newer.Equal(feed.ItemKeys[2]) {
+		t.Errorf("Wrong page going back (%+v)", page)
+	}
+}
+
+func TestItemKeyListFindId(t *testing.T) {
+	list := ItemKeyList{genItemKey(9, "A"), genItemKey(7, "B"), genItemKey(5, "C")}
+
+	for i, id := range []uint64{9, 7, 5} {
+		if found := list.FindId(id); found != i {
+			t.Errorf("Found id %v at %v, expected %v", id, found, i)
+		}
+	}
+	for _, id := range []uint64{10, 8, 1} {
+		if found := list.FindId(id); found != -1 {
+			t.Errorf("Found missing id %v at %v", id, found)
+		}
+	}
+}
+
+func TestFirstItemKeyAt(t *testing.T) {
+	at := time.Unix(1000, 0)
+	first := FirstItemKeyAt(at)
+
+	before := NewItemKey(1000<<IdTimestampShift-1, []byte("A"))
+	after := NewItemKey(1000<<IdTimestampShift, []byte("A"))
+	if !before.Less(first) || !first.Less(after) {
+		t.Errorf("Key for %v doesn't split the keys around it (%v)", at, first)
+	}
+	if !IdTimestamp(after.Id()).Equal(at) {
+		t.Errorf("Wrong timestamp for id (%v)", IdTimestamp(after.Id()))
+	}
+}
+
+func TestItemIndexQueries(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	keys := ItemKeyList{
+		NewItemKey(3, makeHash("Index 3"+key_uniquer)),
+		NewItemKey(2, makeHash("Index 2"+key_uniquer)),
+		NewItemKey(1, makeHash("Index 1"+key_uniquer)),
+	}
+	dates := []time.Time{
+		time.Date(2013, 7, 3, 0, 0, 0, 0, time.UTC),
+		time.Date(2013, 7, 2, 0, 0, 0, 0, time.UTC),
+		time.Date(2013, 7, 1, 0, 0, 0, 0, time.UTC),
+	}
+	feeds := []string{"IndexFeedA", "IndexFeedB", "IndexFeedA"}
+	for i, key := range keys {
+		if err := InsertItem(con, feeds[i], key, ParsedFeedItem{Title: "Indexed", PubDate: dates[i]}); err != nil {
+			t.Fatalf("Failed to insert item (%s)", err)
+		}
+	}
+
+	if found, err := ItemKeysForFeed(con, "IndexFeedA"); err != nil {
+		t.Errorf("Failed to query by feed (%s)", err)
+	} else if len(found) != 2 || !found[0].Equal(keys[0]) || !found[1].Equal(keys[2]) {
+		t.Errorf("Wrong items for feed (%v)", found)
+	}
+
+	if found, err := ItemKeysPublishedBetween(con, dates[2], dates[1]); err != nil {
+		t.Errorf("Failed to query by date (%s)", err)
+	} else if len(found) != 2 || !found[0].Equal(keys[1]) || !found[1].Equal(keys[2]) {
+		t.Errorf("Wrong items for dates (%v)", found)
+	}
+
+	// Updates keep the indexes current.
+	model := &FeedItem{}
+	if err := con.LoadModel(keys[1].GetRiakKey(), model); err != nil {
+		t.Fatalf("Failed to load item (%s)", err)
+	}
+	if err := UpdateItem(con, "IndexFeedB", keys[1], ParsedFeedItem{Title: "Indexed", PubDate: dates[0]}, model); err != nil {
+		t.Fatalf("Failed to update item (%s)", err)
+	}
+	if found, err := ItemKeysPublishedBetween(con, dates[2], dates[1]); err != nil {
+		t.Errorf("Failed to query by date (%s)", err)
+	} else if len(found) != 1 || !found[0].Equal(keys[2]) {
+		t.Errorf("Wrong items for dates after update (%v)", found)
+	}
+}
@@ -282,7 +282,8 @@ func TestFeedItemResolving(t *testing.T) {
 
 	url, _ := url.Parse("http://example.com/story_up_1")
 	Item := FeedItem{
-		Url: *url,
+		Feed: "ConflictFeed",
+		Url:  *url,
 
 		Title:   "First Title",
 		Author:  "Author 1",
@@ -322,7 +323,15 @@ func TestFeedItemResolving(t *testing.T) {
 	load := FeedItem{}
 	if err := con.LoadModel("ConflictItem", &load); err != nil {
 		t.Fatalf("Failed to load conflict model  (%s)", err)
-	} else if compareItems(Item, load) == false {
-		t.Errorf("Resolved model does not match latest update (old, new) (%v, %v)", Item, load)
+	} else {
+		// Only the first sibling knew its feed, which should be kept anyways.
+		Item.Feed = "ConflictFeed"
+		if compareItems(Item, load) == false {
+			t.Errorf("Resolved model does not match latest update (old, new) (%v, %v)", Item, load)
+		}
+		if load.Indexes()[ItemFeedIndexName] != "ConflictFeed" ||
+			load.Indexes()[ItemPubDateIndexName] != strconv.FormatInt(Item.PubDate.Unix(), 10) {
+			t.Errorf("Resolved model's indexes are wrong (%v)", load.Indexes())
+		}
 	}
 }
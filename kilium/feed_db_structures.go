@@ -23,6 +23,7 @@ import (
 	"encoding/base64"
 
 	"net/url"
+	"sort"
 	"strconv"
 	"time"
 
@@ -41,25 +42,77 @@ type Feed struct {
 
 	NextCheck time.Time `riak:"next_check"`
 
+	// How many polls in a row failed, which sets how long the next check is put off.  See
+	// recordFeedFailure.
+	Failures        int       `riak:"failures"`
+	FailuresUpdated time.Time `riak:"failures_updated"`
+
+	// WebSub details.  Hub and Topic come from the feed itself, and are empty if no hub is advertised.
+	Hub   url.URL `riak:"hub"`
+	Topic url.URL `riak:"topic"`
+	// The rest is the subscription's state, which changes independently of the feed's content.
+	WebSubSecret       string    `riak:"websub_secret"`
+	WebSubLeaseExpires time.Time `riak:"websub_lease_expires"`
+	WebSubRenewAt      time.Time `riak:"websub_renew_at"`
+	WebSubUpdated      time.Time `riak:"websub_updated"`
+
+	// The feed's own retention policy.  Feeds without one use GlobalRetentionPolicy.
+	Retention        *RetentionPolicy `riak:"retention"`
+	RetentionUpdated time.Time        `riak:"retention_updated"`
+
+	// The node polling the feed, and until when.  See ClaimFeed.
+	LeaseHolder  string    `riak:"lease_holder"`
+	LeaseExpires time.Time `riak:"lease_expires"`
+	LeaseUpdated time.Time `riak:"lease_updated"`
+
 	riak.Model `riak:"feeds"`
 }
 
 type FeedItem struct {
+	// The UrlKey of the feed the item belongs to.  Items stored before this was kept don't have it.
+	Feed string `riak:"feed"`
+
 	Title   string `riak:"title"`
 	Author  string `riak:"author"`
 	Content string `riak:"content"`
 
+	Categories []string `riak:"categories"`
+
 	Url url.URL `riak:"url"`
 
 	PubDate time.Time `riak:"publication_date"`
 
+	// Earlier versions of the item, oldest first.  At most MaximumItemRevisions are kept.
+	Revisions []ItemRevision `riak:"revisions"`
+
 	riak.Model `riak:"items"`
 }
 
-const NextCheckIndexName = "next_check_int"
+const (
+	NextCheckIndexName = "next_check_int"
+	// Only set on feeds with a hub.
+	WebSubRenewIndexName = "websub_renew_int"
+
+	ItemFeedIndexName    = "feed_bin"
+	ItemPubDateIndexName = "publication_date_int"
+)
 
 type ItemKey []byte
 
+// Ids are the unix time they were made at, shifted up by IdTimestampShift, with a counter below.  See
+// IdGenerator for what the counter holds.
+const IdTimestampShift = 20
+
+// The time id was made at.
+func IdTimestamp(id uint64) time.Time {
+	return time.Unix(int64(id>>IdTimestampShift), 0)
+}
+
+// The smallest key that could be made at t, so every key made before t sorts below it.
+func FirstItemKeyAt(t time.Time) ItemKey {
+	return NewItemKey(uint64(t.Unix())<<IdTimestampShift, nil)
+}
+
 func NewItemKey(id uint64, rawId []byte) ItemKey {
 	buf := &bytes.Buffer{}
 
@@ -107,10 +160,20 @@ func (key ItemKey) IsRawItemId(id []byte) bool {
 	return bytes.Compare(key[9:], id) == 0
 }
 
+// The id the key was made with.
+func (key ItemKey) Id() uint64 {
+	return binary.BigEndian.Uint64(key)
+}
+
 func (key ItemKey) GetRiakKey() string {
 	return base64.URLEncoding.EncodeToString(key)
 }
 
+// The inverse of GetRiakKey.
+func ParseItemKey(riakKey string) (ItemKey, error) {
+	return base64.URLEncoding.DecodeString(riakKey)
+}
+
 type ItemKeyList []ItemKey
 
 func (list *ItemKeyList) Append(key Comparable) {
@@ -150,10 +213,30 @@ func (list ItemKeyList) FindRawItemId(id []byte) int {
 	return -1
 }
 
+// Finds the key made with id.  Ids are unique, and the list is sorted by them, so this is a binary
+// search.
+func (list ItemKeyList) FindId(id uint64) int {
+	i := sort.Search(len(list), func(i int) bool { return list[i].Id() <= id })
+	if i < len(list) && list[i].Id() == id {
+		return i
+	}
+	return -1
+}
+
 func (f *Feed) UrlKey() string {
 	return base64.URLEncoding.EncodeToString(makeHash(f.Url.String()))
 }
 
+// Sets the 2i entries, which all just mirror data fields.
+func (f *Feed) updateIndexes() {
+	f.Indexes()[NextCheckIndexName] = strconv.FormatInt(f.NextCheck.Unix(), 10)
+	if f.Hub.String() != "" {
+		f.Indexes()[WebSubRenewIndexName] = strconv.FormatInt(f.WebSubRenewAt.Unix(), 10)
+	} else {
+		delete(f.Indexes(), WebSubRenewIndexName)
+	}
+}
+
 func (f *Feed) Resolve(siblingsCount int) error {
 	// First get the siblings!
 	siblingsI, err := f.Siblings(&Feed{})
@@ -168,11 +251,37 @@ func (f *Feed) Resolve(siblingsCount int) error {
 	for i := 0; i < siblingsCount; i++ {
 		// Resolve regular feed details.  Basically, take the latest version!
 		// If this is the first object, it will have a zero time of year 1st.  If a feed is claiming
-		// be older then that, well it just won't work.
-		if i == 0 || siblings[i].LastCheck.After(f.LastCheck) {
+		// be older then that, well it just won't work.  Failures put the next check off without
+		// checking, so on ties the later next check wins.
+		if i == 0 || siblings[i].LastCheck.After(f.LastCheck) ||
+			(siblings[i].LastCheck.Equal(f.LastCheck) && siblings[i].NextCheck.After(f.NextCheck)) {
 			f.Title = siblings[i].Title
 			f.LastCheck = siblings[i].LastCheck
 			f.NextCheck = siblings[i].NextCheck
+			f.Hub = siblings[i].Hub
+			f.Topic = siblings[i].Topic
+		}
+		// The subscription state is updated separately, so it gets its own timestamp.
+		if i == 0 || siblings[i].WebSubUpdated.After(f.WebSubUpdated) {
+			f.WebSubSecret = siblings[i].WebSubSecret
+			f.WebSubLeaseExpires = siblings[i].WebSubLeaseExpires
+			f.WebSubRenewAt = siblings[i].WebSubRenewAt
+			f.WebSubUpdated = siblings[i].WebSubUpdated
+		}
+		if i == 0 || siblings[i].FailuresUpdated.After(f.FailuresUpdated) {
+			f.Failures = siblings[i].Failures
+			f.FailuresUpdated = siblings[i].FailuresUpdated
+		}
+		if i == 0 || siblings[i].RetentionUpdated.After(f.RetentionUpdated) {
+			f.Retention = siblings[i].Retention
+			f.RetentionUpdated = siblings[i].RetentionUpdated
+		}
+		// Racing claims must resolve the same way on every node, so ties go to the smallest holder.
+		if i == 0 || siblings[i].LeaseUpdated.After(f.LeaseUpdated) ||
+			(siblings[i].LeaseUpdated.Equal(f.LeaseUpdated) && siblings[i].LeaseHolder < f.LeaseHolder) {
+			f.LeaseHolder = siblings[i].LeaseHolder
+			f.LeaseExpires = siblings[i].LeaseExpires
+			f.LeaseUpdated = siblings[i].LeaseUpdated
 		}
 
 		// for the item lists, merge and de-dup using insert slice sort!
@@ -184,8 +293,7 @@ func (f *Feed) Resolve(siblingsCount int) error {
 	RemoveSliceElements(&f.InsertedItemKeys, &f.DeletedItemKeys)
 	RemoveSliceElements(&f.ItemKeys, &f.DeletedItemKeys)
 
-	// Since this index just matches a data field, just use that.
-	f.Indexes()[NextCheckIndexName] = strconv.FormatInt(f.NextCheck.Unix(), 10)
+	f.updateIndexes()
 
 	return nil
 }
@@ -198,19 +306,39 @@ func (f *FeedItem) Resolve(siblingsCount int) error {
 	}
 	siblings := siblingsI.([]FeedItem)
 
+	f.Feed = ""
+	f.Revisions = nil
 	for i := 0; i < siblingsCount; i++ {
+		f.Revisions = mergeItemRevisions(f.Revisions, siblings[i].Revisions)
+
+		// Items never move between feeds, so any sibling that knows the feed is right.
+		if f.Feed == "" {
+			f.Feed = siblings[i].Feed
+		}
+
 		// Feed items are simple.  What ever claims is the latest update wins.  This should come from
 		// the feed when possible.  Otherwise it is generated by the system, but should still be ok.
 		if i == 0 || siblings[i].PubDate.After(f.PubDate) {
 			f.Title = siblings[i].Title
 			f.Author = siblings[i].Author
 			f.Content = siblings[i].Content
+			f.Categories = siblings[i].Categories
 			f.Url = siblings[i].Url
 			f.PubDate = siblings[i].PubDate
 		}
 	}
 
-	///@todo: I need to merge indexes here.  Currently I can't though due to library restrictions.
+	// Rather than merging the siblings' indexes, just recalculate them.
+	f.updateIndexes()
 
 	return nil
 }
+
+func (f *FeedItem) updateIndexes() {
+	if f.Feed != "" {
+		f.Indexes()[ItemFeedIndexName] = f.Feed
+	} else {
+		delete(f.Indexes(), ItemFeedIndexName)
+	}
+	f.Indexes()[ItemPubDateIndexName] = strconv.FormatInt(f.PubDate.Unix(), 10)
+}
@@ -24,6 +24,7 @@ import (
 	"net/http"
 	"net/url"
 
+	"strconv"
 	"time"
 )
 
@@ -31,8 +32,16 @@ type RawFeed struct {
 	Data      []byte
 	Url       url.URL
 	FetchedAt time.Time
+
+	// How long the request took, from sending it until the body was fully read.
+	FetchDuration time.Duration
+
+	// Set for content a WebSub hub pushed, rather than content the pipeline fetched.
+	Pushed bool
 }
 
+// Any error from the pipeline, with the feed it happened to.  Err is a FetchError, ParseError or
+// StoreError when it came from one of the stages.
 type FeedError struct {
 	Err error
 	Url url.URL
@@ -42,15 +51,47 @@ func (e FeedError) Error() string {
 	return fmt.Sprintf("Error while dealing with url %s: %s", e.Url.String(), e.Err)
 }
 
+func (e FeedError) Unwrap() error {
+	return e.Err
+}
+
+func (e FeedError) Stage() PipelineStage {
+	if pipelineErr := AsPipelineError(e.Err); pipelineErr != nil {
+		return pipelineErr.Stage()
+	}
+	return UnknownStage
+}
+
+// Errors from outside the stages are assumed to pass.
+func (e FeedError) Retryable() bool {
+	if pipelineErr := AsPipelineError(e.Err); pipelineErr != nil {
+		return pipelineErr.Retryable()
+	}
+	return true
+}
+
 func FeedFetcher(in <-chan url.URL, out chan<- RawFeed, errChan chan<- FeedError) {
+	feedFetcher(in, out, errChan, DefaultLogger)
+}
+
+func feedFetcher(in <-chan url.URL, out chan<- RawFeed, errChan chan<- FeedError, logger Logger) {
+	fail := func(Url url.URL, err FetchError) {
+		logger.Log(LogWarn, "Failed to fetch feed", FeedField(Url), StageField(FetchStage), ErrorField(err), RetryableField(err))
+		errChan <- FeedError{err, Url}
+	}
 	for {
 		if next, ok := <-in; ok {
+			start := time.Now()
 			resp, err := http.Get(next.String())
 			if err != nil {
-				errChan <- FeedError{err, next}
+				fetchesMetric.Inc("error")
+				fail(next, FetchError{Err: err})
 				continue
-			} else if resp.StatusCode != 200 {
-				errChan <- FeedError{fmt.Errorf("Failed to successfully retrieve item, error code %v", resp.StatusCode), next}
+			}
+			fetchesMetric.Inc(strconv.Itoa(resp.StatusCode))
+			if resp.StatusCode != 200 {
+				resp.Body.Close()
+				fail(next, FetchError{StatusCode: resp.StatusCode})
 				continue
 			}
 
@@ -58,9 +99,13 @@ func FeedFetcher(in <-chan url.URL, out chan<- RawFeed, errChan chan<- FeedError
 			resp.Body.Close()
 
 			if err != nil {
-				errChan <- FeedError{err, next}
+				fail(next, FetchError{Err: err})
 			} else {
-				out <- RawFeed{content, next, time.Now()}
+				fetchedAt := time.Now()
+				fetchDurationMetric.Observe(fetchedAt.Sub(start).Seconds())
+				fetchBytesMetric.Add(float64(len(content)))
+				logger.Log(LogDebug, "Fetched feed", FeedField(next), StageField(FetchStage), DurationField(fetchedAt.Sub(start)), LogField{"bytes", len(content)})
+				out <- RawFeed{Data: content, Url: next, FetchedAt: fetchedAt, FetchDuration: fetchedAt.Sub(start)}
 			}
 		} else {
 			break
@@ -0,0 +1,83 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"errors"
+	"time"
+
+	riak "github.com/tpjg/goriakpbc"
+)
+
+// How long a node has to poll a feed it claimed before other nodes may take it over.
+const DefaultFeedLeaseDuration = 10 * time.Minute
+
+var FeedLeased = errors.New("Feed is leased to another node!")
+
+// Whether a node other than holder has a running lease on the feed.
+func (f *Feed) LeasedToOther(holder string, now time.Time) bool {
+	return f.LeaseHolder != "" && f.LeaseHolder != holder && f.LeaseExpires.After(now)
+}
+
+// Claims the feed for holder until now+duration, so nodes sharing the polling don't all fetch it.
+// Fails with FeedLeased while another node's lease runs, but expired leases are simply taken over.
+//
+// Claims made at the same time end up as siblings, so the claim is read back after saving.  Riak
+// doesn't say when siblings are complete, though, so a node reading back before another's claim lands
+// sees only its own, and two nodes can both come away holding the feed.  Resolving picks the same
+// winner everywhere once both claims are in, so updateFeed reads the lease again before saving and
+// gives up with FeedLeased if it lost.
+func ClaimFeed(con *riak.Client, feedKey, holder string, now time.Time, duration time.Duration) (*Feed, error) {
+	feed, err := LoadFeed(con, feedKey)
+	if err != nil {
+		return nil, err
+	}
+	if feed.LeasedToOther(holder, now) {
+		return nil, FeedLeased
+	}
+
+	feed.LeaseHolder = holder
+	feed.LeaseExpires = now.Add(duration)
+	feed.LeaseUpdated = now
+	feed.updateIndexes()
+	if err := feed.Save(); err != nil {
+		return nil, err
+	}
+
+	if feed, err = LoadFeed(con, feedKey); err != nil {
+		return nil, err
+	}
+	if feed.LeaseHolder != holder {
+		return nil, FeedLeased
+	}
+	return feed, nil
+}
+
+// Ends holder's lease on the feed at now, so other nodes can claim it straight away.  Leases taken over
+// by other nodes are left alone.
+func releaseFeed(con *riak.Client, feedKey, holder string, now time.Time) error {
+	feed, err := LoadFeed(con, feedKey)
+	if err != nil {
+		return err
+	}
+	if feed.LeaseHolder != holder {
+		return nil
+	}
+	feed.LeaseExpires = now
+	feed.LeaseUpdated = now
+	return feed.Save()
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"time"
+
+	"testing"
+)
+
+func TestFeedLeasedToOther(t *testing.T) {
+	now := time.Unix(1000, 0)
+	feed := &Feed{}
+	if feed.LeasedToOther("a", now) {
+		t.Error("Unleased feed counts as leased")
+	}
+
+	feed.LeaseHolder, feed.LeaseExpires = "a", now.Add(time.Minute)
+	if feed.LeasedToOther("a", now) {
+		t.Error("Holder's own lease counts against it")
+	}
+	if !feed.LeasedToOther("b", now) {
+		t.Error("Running lease doesn't count against other nodes")
+	}
+	if feed.LeasedToOther("b", now.Add(time.Minute)) {
+		t.Error("Expired lease still counts")
+	}
+}
+
+func TestClaimFeed(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	feedKey := CreateFeed(t, con, getUniqueExampleComUrl(t)).UrlKey()
+	now := time.Now()
+
+	if feed, err := ClaimFeed(con, feedKey, "a", now, time.Minute); err != nil {
+		t.Fatalf("Failed to claim feed (%s)", err)
+	} else if feed.LeaseHolder != "a" || !feed.LeaseExpires.Equal(now.Add(time.Minute)) {
+		t.Errorf("Claim wasn't recorded (%+v)", feed)
+	}
+
+	if _, err := ClaimFeed(con, feedKey, "b", now.Add(time.Second), time.Minute); err != FeedLeased {
+		t.Errorf("Claiming a leased feed didn't fail properly (%v)", err)
+	}
+	if _, err := ClaimFeed(con, feedKey, "a", now.Add(time.Second), time.Minute); err != nil {
+		t.Errorf("Holder failed to renew its own lease (%s)", err)
+	}
+	if feed, err := ClaimFeed(con, feedKey, "b", now.Add(2*time.Minute), time.Minute); err != nil {
+		t.Errorf("Failed to take over an expired lease (%s)", err)
+	} else if feed.LeaseHolder != "b" {
+		t.Errorf("Expired lease wasn't taken over (%+v)", feed)
+	}
+
+	if _, err := ClaimFeed(con, "missing", "a", now, time.Minute); err != FeedNotFound {
+		t.Errorf("Expected FeedNotFound, got %v", err)
+	}
+}
+
+func TestUpdateLeasedFeed(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	url := getUniqueExampleComUrl(t)
+	feedKey := CreateFeed(t, con, url).UrlKey()
+	now := time.Now()
+	if _, err := ClaimFeed(con, feedKey, "a", now, time.Minute); err != nil {
+		t.Fatalf("Failed to claim feed (%s)", err)
+	}
+
+	if _, err := updateLeasedFeed(con, "b", *url, *makeRetentionFeed("lost", 1, now), testIdGenerator); err != FeedLeased {
+		t.Errorf("Update without the lease didn't fail properly (%v)", err)
+	}
+	if feed, err := LoadFeed(con, feedKey); err != nil {
+		t.Fatalf("Failed to load feed (%s)", err)
+	} else if len(feed.ItemKeys) != 0 || len(feed.InsertedItemKeys) != 0 {
+		t.Errorf("Update without the lease wrote to the feed (%+v)", feed)
+	}
+
+	if result, err := updateLeasedFeed(con, "a", *url, *makeRetentionFeed("held", 1, now), testIdGenerator); err != nil {
+		t.Errorf("Holder failed to update its feed (%s)", err)
+	} else if result.Inserted != 1 {
+		t.Errorf("Holder's update was lost (%+v)", result)
+	}
+}
+
+func TestFeedLeaseResolving(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	claimed := time.Date(2013, 7, 1, 0, 0, 0, 0, time.UTC)
+	for _, holder := range []string{"b", "a", "c"} {
+		entry := Feed{Url: *testFeedUrl, LeaseHolder: holder, LeaseExpires: claimed.Add(time.Minute), LeaseUpdated: claimed}
+		if err := con.NewModel("ConflictFeed", &entry); err != nil {
+			t.Fatalf("Failed to create model (%s)", err)
+		}
+		if err := entry.Save(); err != nil {
+			t.Fatalf("Failed to save claim (%s)", err)
+		}
+	}
+
+	load := Feed{}
+	if err := con.LoadModel("ConflictFeed", &load); err != nil {
+		t.Fatalf("Failed to load conflict model (%s)", err)
+	} else if load.LeaseHolder != "a" {
+		t.Errorf("Tied claims should go to the smallest holder, got %q", load.LeaseHolder)
+	}
+}
@@ -0,0 +1,337 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"container/heap"
+	"errors"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"time"
+
+	riak "github.com/tpjg/goriakpbc"
+)
+
+const (
+	// How often the scheduler reads the next check index, and how far ahead it looks.
+	SchedulerRefreshInterval = time.Minute
+	// Feeds that failed in a way that should pass are tried again after this long, doubling with each
+	// failure in a row.
+	FailedFeedRetryDelay = 5 * time.Minute
+	// The longest a failed feed waits.  Feeds that failed in a way that won't pass on its own, like a
+	// 404 or a broken feed, wait this long straight away.
+	MaximumFailedFeedRetryDelay = 6 * time.Hour
+
+	DefaultSchedulerJitter     = 30 * time.Second
+	DefaultMaxOutstandingFeeds = 10
+)
+
+type scheduledFeed struct {
+	key   string
+	due   time.Time
+	index int
+}
+
+// A heap of feeds, soonest due first.
+type feedQueue []*scheduledFeed
+
+func (q feedQueue) Len() int           { return len(q) }
+func (q feedQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+func (q feedQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *feedQueue) Push(x interface{}) {
+	feed := x.(*scheduledFeed)
+	feed.index = len(*q)
+	*q = append(*q, feed)
+}
+
+func (q *feedQueue) Pop() interface{} {
+	old := *q
+	feed := old[len(old)-1]
+	*q = old[:len(old)-1]
+	feed.index = -1
+	return feed
+}
+
+// Sends feeds into the pipeline as they come due, instead of in batches.  Due times come from the next
+// check index, which is re-read every SchedulerRefreshInterval, and get up to config.Jitter added so
+// feeds due together don't all go at once.  At most config.MaxOutstanding feeds are in the pipeline at
+// a time; the rest wait their turn.
+type feedScheduler struct {
+	con    *riak.Client
+	config RssMasterConfig
+
+	inputCh  chan<- url.URL
+	outputCh <-chan FeedUpdateResult
+
+	queue       feedQueue
+	queued      map[string]*scheduledFeed
+	outstanding map[string]bool
+	// When this node last swept each feed for retention.
+	swept map[string]time.Time
+
+	rand *rand.Rand
+}
+
+func newFeedScheduler(con *riak.Client, config RssMasterConfig, inputCh chan<- url.URL, outputCh <-chan FeedUpdateResult) *feedScheduler {
+	if config.MaxOutstanding <= 0 {
+		config.MaxOutstanding = DefaultMaxOutstandingFeeds
+	}
+	if config.Logger == nil {
+		config.Logger = DefaultLogger
+	}
+	return &feedScheduler{
+		con:    con,
+		config: config,
+
+		inputCh:  inputCh,
+		outputCh: outputCh,
+
+		queued:      make(map[string]*scheduledFeed),
+		outstanding: make(map[string]bool),
+		swept:       make(map[string]time.Time),
+
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *feedScheduler) jitter() time.Duration {
+	if s.config.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(s.rand.Int63n(int64(s.config.Jitter)))
+}
+
+// Queues the feed for due, or moves it up if it is already queued for later.  Feeds in the pipeline
+// are left alone.
+func (s *feedScheduler) schedule(key string, due time.Time) {
+	if s.outstanding[key] {
+		return
+	}
+	if feed, ok := s.queued[key]; ok {
+		if due.Before(feed.due) {
+			feed.due = due
+			heap.Fix(&s.queue, feed.index)
+		}
+		return
+	}
+	feed := &scheduledFeed{key: key, due: due}
+	s.queued[key] = feed
+	heap.Push(&s.queue, feed)
+}
+
+// Queues every feed due before the next refresh that isn't already known.
+func (s *feedScheduler) refresh(now time.Time) error {
+	bucket, err := s.con.Bucket("feeds")
+	if err != nil {
+		return err
+	}
+	// See RssMasterPollFeeds for where this number comes from.
+	keys, err := bucket.IndexQueryRange(NextCheckIndexName, "-62135596800", strconv.FormatInt(now.Add(SchedulerRefreshInterval).Unix(), 10))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, key := range keys {
+		if s.outstanding[key] || s.queued[key] != nil {
+			continue
+		}
+		feed, err := LoadFeed(s.con, key)
+		if err == FeedNotFound {
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		due := feed.NextCheck
+		if due.Before(now) {
+			due = now
+		}
+		s.schedule(key, due.Add(s.jitter()))
+	}
+
+	if len(errs) != 0 {
+		return MultiError(errs)
+	}
+	return nil
+}
+
+// Sends every due feed it can into the pipeline.
+func (s *feedScheduler) dispatch(now time.Time) {
+	for s.queue.Len() != 0 && !s.queue[0].due.After(now) && len(s.outstanding) < s.config.MaxOutstanding {
+		key := heap.Pop(&s.queue).(*scheduledFeed).key
+		delete(s.queued, key)
+
+		feed, err := ClaimFeed(s.con, key, s.config.Node, now, s.config.LeaseDuration)
+		if err == FeedNotFound {
+			delete(s.swept, key)
+			continue
+		} else if err == FeedLeased {
+			// Another node has it.  Check back once its lease would be up.
+			s.schedule(key, now.Add(s.config.LeaseDuration+s.jitter()))
+			continue
+		} else if err != nil {
+			s.config.Logger.Log(LogWarn, "Failed to claim feed", LogField{"key", key}, ErrorField(err))
+			s.schedule(key, now.Add(FailedFeedRetryDelay+s.jitter()))
+			continue
+		} else if feed.NextCheck.After(now) {
+			// Polled since it was queued.
+			s.schedule(key, feed.NextCheck.Add(s.jitter()))
+			continue
+		}
+
+		s.config.Logger.Log(LogDebug, "Polling feed", FeedField(feed.Url), LogField{"overdue", now.Sub(feed.NextCheck)})
+		s.outstanding[key] = true
+
+		// Sweeping while the feed is claimed and outstanding keeps it from racing an update.
+		sweep := now.Sub(s.swept[key]) >= RetentionSweepInterval
+		if sweep {
+			s.swept[key] = now
+		}
+		go func(feed *Feed, sweep bool) {
+			if sweep {
+				s.sweep(feed, now)
+			}
+			s.inputCh <- feed.Url
+		}(feed, sweep)
+	}
+}
+
+// Removes the items the claimed feed's retention policy no longer keeps.  Failures are only logged, as
+// the next sweep will try again.
+func (s *feedScheduler) sweep(feed *Feed, now time.Time) {
+	if removed, err := sweepFeedRetention(s.con, feed, now); err != nil {
+		s.config.Logger.Log(LogWarn, "Failed to sweep retention", FeedField(feed.Url), ErrorField(err))
+	} else if removed != 0 {
+		s.config.Logger.Log(LogInfo, "Retention removed items", FeedField(feed.Url), ItemCountField(removed))
+	}
+}
+
+// How long to wait before polling a feed that just failed with err, for the failures-th time in a row.
+// Errors that don't come from a pipeline stage are treated as retryable.
+func failedFeedRetryDelay(err error, failures int) time.Duration {
+	if pipelineErr := AsPipelineError(err); pipelineErr != nil && !pipelineErr.Retryable() {
+		return MaximumFailedFeedRetryDelay
+	}
+	delay := FailedFeedRetryDelay
+	for i := 1; i < failures && delay < MaximumFailedFeedRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > MaximumFailedFeedRetryDelay {
+		delay = MaximumFailedFeedRetryDelay
+	}
+	return delay
+}
+
+// Counts another failure of the feed, and puts its next check off by the backoff for err.  The count
+// and the next check are stored with the feed, so the backoff holds across restarts and on other
+// nodes.  Returns how long the feed waits, and how many times in a row it has failed.
+func recordFeedFailure(con *riak.Client, feedKey string, err error, now time.Time) (time.Duration, int, error) {
+	feed, loadErr := LoadFeed(con, feedKey)
+	if loadErr != nil {
+		return 0, 0, loadErr
+	}
+
+	feed.Failures++
+	feed.FailuresUpdated = now
+	delay := failedFeedRetryDelay(err, feed.Failures)
+	feed.NextCheck = now.Add(delay)
+	feed.updateIndexes()
+	if saveErr := feed.Save(); saveErr != nil {
+		return 0, 0, saveErr
+	}
+	return delay, feed.Failures, nil
+}
+
+func (s *feedScheduler) finish(result FeedUpdateResult, now time.Time) {
+	key := (&Feed{Url: result.Url}).UrlKey()
+	delete(s.outstanding, key)
+
+	// Successful feeds have a new next check, which the index will bring back in time.  The pipeline
+	// stages have already logged why a feed failed.
+	if errors.Is(result.Err, FeedLeased) {
+		// Another node took the feed over mid-update.  Check back once its lease would be up.
+		s.schedule(key, now.Add(s.config.LeaseDuration+s.jitter()))
+	} else if result.Err != nil {
+		delay, failures, err := recordFeedFailure(s.con, key, result.Err, now)
+		if err == FeedNotFound {
+			return
+		} else if err != nil {
+			// Retry from here at least, even though other nodes won't know to wait.
+			s.config.Logger.Log(LogWarn, "Failed to record feed failure", FeedField(result.Url), ErrorField(err))
+			delay = FailedFeedRetryDelay
+		}
+		s.config.Logger.Log(LogDebug, "Retrying feed later", FeedField(result.Url), LogField{"failures", failures}, LogField{"delay", delay})
+		s.schedule(key, now.Add(delay+s.jitter()))
+	} else {
+		s.config.Logger.Log(LogInfo, "Polled feed", FeedField(result.Url), ItemCountField(result.Inserted), DurationField(result.FetchDuration))
+	}
+}
+
+func (s *feedScheduler) updateMetrics(now time.Time) {
+	overdue := 0
+	for _, feed := range s.queue {
+		if feed.due.Before(now) {
+			overdue++
+		}
+	}
+	scheduledFeedsMetric.Set(float64(s.queue.Len()))
+	outstandingFeedsMetric.Set(float64(len(s.outstanding)))
+	overdueFeedsMetric.Set(float64(overdue))
+}
+
+func (s *feedScheduler) run() {
+	refreshTick := time.NewTicker(SchedulerRefreshInterval)
+	defer refreshTick.Stop()
+	if err := s.refresh(time.Now()); err != nil {
+		s.config.Logger.Log(LogError, "Failed to refresh feed schedule", ErrorField(err))
+	}
+
+	for {
+		s.dispatch(time.Now())
+		s.updateMetrics(time.Now())
+
+		// Only wake up for the next feed if there is room for it.
+		var dueCh <-chan time.Time
+		var timer *time.Timer
+		if s.queue.Len() != 0 && len(s.outstanding) < s.config.MaxOutstanding {
+			timer = time.NewTimer(s.queue[0].due.Sub(time.Now()))
+			dueCh = timer.C
+		}
+
+		select {
+		case <-dueCh:
+		case <-refreshTick.C:
+			if err := s.refresh(time.Now()); err != nil {
+				s.config.Logger.Log(LogError, "Failed to refresh feed schedule", ErrorField(err))
+			}
+		case result := <-s.outputCh:
+			s.finish(result, time.Now())
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
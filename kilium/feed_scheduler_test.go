@@ -0,0 +1,200 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"container/heap"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"testing"
+)
+
+func TestFeedSchedulerQueue(t *testing.T) {
+	s := newFeedScheduler(nil, RssMasterConfig{}, nil, nil)
+	now := time.Unix(1000, 0)
+
+	s.schedule("c", now.Add(3*time.Minute))
+	s.schedule("a", now.Add(time.Minute))
+	s.schedule("b", now.Add(2*time.Minute))
+	// Later times don't push a feed back, earlier ones bring it forward.
+	s.schedule("a", now.Add(time.Hour))
+	s.schedule("c", now)
+	// Feeds in the pipeline aren't queued again.
+	s.outstanding["d"] = true
+	s.schedule("d", now)
+
+	for i, key := range []string{"c", "a", "b"} {
+		if s.queue.Len() == 0 {
+			t.Fatalf("Queue ran out after %d feeds", i)
+		}
+		if next := heap.Pop(&s.queue).(*scheduledFeed); next.key != key {
+			t.Errorf("Feed %d out of the queue should be %q, got %q", i, key, next.key)
+		}
+	}
+	if s.queue.Len() != 0 {
+		t.Errorf("Queue has extra feeds (%v)", s.queue)
+	}
+}
+
+func TestFeedSchedulerJitter(t *testing.T) {
+	s := newFeedScheduler(nil, RssMasterConfig{Jitter: time.Second}, nil, nil)
+	for i := 0; i < 100; i++ {
+		if jitter := s.jitter(); jitter < 0 || jitter >= time.Second {
+			t.Fatalf("Jitter out of range (%v)", jitter)
+		}
+	}
+
+	s = newFeedScheduler(nil, RssMasterConfig{}, nil, nil)
+	if jitter := s.jitter(); jitter != 0 {
+		t.Errorf("Jitter without any configured (%v)", jitter)
+	}
+}
+
+func TestFeedSchedulerRetriesFailures(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	s := newFeedScheduler(con, RssMasterConfig{}, nil, nil)
+	now := time.Unix(1000, 0)
+
+	failed, succeeded := CreateFeed(t, con, getUniqueExampleComUrl(t)).Url, CreateFeed(t, con, getUniqueExampleComUrl(t)).Url
+	for _, Url := range []url.URL{failed, succeeded} {
+		s.outstanding[(&Feed{Url: Url}).UrlKey()] = true
+	}
+
+	s.finish(FeedUpdateResult{Url: failed, Err: errors.New("Test failure")}, now)
+	s.finish(FeedUpdateResult{Url: succeeded}, now)
+
+	if len(s.outstanding) != 0 {
+		t.Errorf("Finished feeds are still outstanding (%v)", s.outstanding)
+	}
+	if s.queue.Len() != 1 || s.queue[0].key != (&Feed{Url: failed}).UrlKey() || !s.queue[0].due.Equal(now.Add(FailedFeedRetryDelay)) {
+		t.Errorf("Only the failed feed should be queued for a retry (%v)", s.queue)
+	}
+
+	// Other nodes, and this one after a restart, find the feed put off as well.
+	if feed, err := LoadFeed(con, (&Feed{Url: failed}).UrlKey()); err != nil {
+		t.Fatalf("Failed to load feed (%s)", err)
+	} else if feed.Failures != 1 || !feed.NextCheck.Equal(now.Add(FailedFeedRetryDelay)) {
+		t.Errorf("Failure wasn't stored with the feed (%+v)", feed)
+	} else if feed.Indexes()[NextCheckIndexName] != strconv.FormatInt(now.Add(FailedFeedRetryDelay).Unix(), 10) {
+		t.Errorf("Next check index wasn't moved (%v)", feed.Indexes())
+	}
+}
+
+func TestFeedSchedulerWaitsOutLostLeases(t *testing.T) {
+	s := newFeedScheduler(nil, RssMasterConfig{LeaseDuration: time.Minute}, nil, nil)
+	now := time.Unix(1000, 0)
+	key := (&Feed{Url: *testFeedUrl}).UrlKey()
+
+	// There is no connection, so this only works if losing the lease isn't stored as a failure.
+	s.outstanding[key] = true
+	s.finish(FeedUpdateResult{Url: *testFeedUrl, Err: FeedError{StoreError{FeedLeased}, *testFeedUrl}}, now)
+	if s.queue.Len() != 1 || !s.queue[0].due.Equal(now.Add(time.Minute)) {
+		t.Errorf("Feed should wait out the other node's lease (%v)", s.queue)
+	}
+}
+
+func TestFeedSchedulerBacksOff(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	now := time.Unix(1000, 0)
+	Url := *getUniqueExampleComUrl(t)
+	key := CreateFeed(t, con, &Url).UrlKey()
+
+	// A fresh scheduler for every failure, as the count has to come back from the feed.
+	retry := func(err error) time.Duration {
+		s := newFeedScheduler(con, RssMasterConfig{}, nil, nil)
+		s.outstanding[key] = true
+		s.finish(FeedUpdateResult{Url: Url, Err: FeedError{err, Url}}, now)
+		due := heap.Pop(&s.queue).(*scheduledFeed).due
+		delete(s.queued, key)
+		return due.Sub(now)
+	}
+
+	timeout := FetchError{StatusCode: 503}
+	for i, expected := range []time.Duration{FailedFeedRetryDelay, 2 * FailedFeedRetryDelay, 4 * FailedFeedRetryDelay} {
+		if delay := retry(timeout); delay != expected {
+			t.Errorf("Failure %v should wait %v, not %v", i+1, expected, delay)
+		}
+	}
+	if delay := retry(ParseError{Err: errors.New("Bad feed")}); delay != MaximumFailedFeedRetryDelay {
+		t.Errorf("Errors that won't pass should wait %v, not %v", MaximumFailedFeedRetryDelay, delay)
+	}
+
+	// Succeeding starts the backoff over.
+	if _, err := updateFeed(con, Url, ParsedFeedData{FetchedAt: now}, testIdGenerator); err != nil {
+		t.Fatalf("Failed to update feed (%s)", err)
+	}
+	if delay := retry(timeout); delay != FailedFeedRetryDelay {
+		t.Errorf("Backoff didn't start over after succeeding (waited %v)", delay)
+	}
+
+	if delay := failedFeedRetryDelay(timeout, 100); delay != MaximumFailedFeedRetryDelay {
+		t.Errorf("Backoff should stop at %v, not %v", MaximumFailedFeedRetryDelay, delay)
+	}
+}
+
+func TestFeedSchedulerDispatch(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	Url := getUniqueExampleComUrl(t)
+	if err := RssMasterHandleAddRequest(con, *Url); err != nil {
+		t.Fatalf("Failed to create fresh new feed! (%s)", err)
+	}
+
+	inputCh := make(chan url.URL, 1)
+	config := DefaultRssMasterConfig()
+	config.Jitter = 0
+	s := newFeedScheduler(con, config, inputCh, nil)
+
+	now := time.Now()
+	if err := s.refresh(now); err != nil {
+		t.Fatalf("Failed to refresh (%s)", err)
+	}
+	if s.queue.Len() != 1 {
+		t.Fatalf("Due feed wasn't queued (%v)", s.queue)
+	}
+
+	s.dispatch(now)
+	select {
+	case sent := <-inputCh:
+		if sent != *Url {
+			t.Errorf("Wrong feed sent (%v)", sent)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Due feed wasn't sent")
+	}
+	if !s.outstanding[(&Feed{Url: *Url}).UrlKey()] {
+		t.Error("Sent feed isn't outstanding")
+	}
+	if !s.swept[(&Feed{Url: *Url}).UrlKey()].Equal(now) {
+		t.Error("Sent feed wasn't swept for retention")
+	}
+
+	// While it is out, refreshing doesn't queue it again.
+	if err := s.refresh(now); err != nil {
+		t.Fatalf("Failed to refresh (%s)", err)
+	} else if s.queue.Len() != 0 {
+		t.Errorf("Outstanding feed was queued again (%v)", s.queue)
+	}
+}
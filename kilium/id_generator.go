@@ -0,0 +1,152 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Ids are laid out, from the most significant bit down, as:
+ *
+ *	63-53  zero, until the year 2242
+ *	52-20  unix time in seconds (IdTimestampShift)
+ *	19-12  node, so several fetchers never make the same id (IdNodeBits)
+ *	11-0   sequence within the second (IdSequenceBits)
+ *
+ * Ids made before nodes existed just had a counter below the timestamp, so they still sort by time
+ * against these.  A node making more than 1<<IdSequenceBits ids in a second borrows the next second,
+ * running a little ahead of the clock until it catches up.  The clock going backwards is handled the
+ * same way: ids keep coming from the last second used, so they never go backwards either.
+ */
+const (
+	IdNodeBits     = 8
+	IdSequenceBits = 12
+
+	MaximumIdNode = 1<<IdNodeBits - 1
+)
+
+var InvalidIdNode = errors.New("Id node out of range!")
+
+type IdGenerator struct {
+	node uint64
+	// Where the last second used is kept, so a restart never reuses it.  Empty if not kept.
+	stateFile string
+
+	lock     sync.Mutex
+	second   uint64
+	sequence uint64
+
+	now func() time.Time
+}
+
+// Makes a generator for node, which must be unique among the running fetchers.  With a stateFile the
+// last second used survives restarts, even if the clock moves back in between.  Without one, the
+// generator starts in the second after the current one, so a restart within a second is still safe.
+func NewIdGenerator(node int, stateFile string) (*IdGenerator, error) {
+	if node < 0 || node > MaximumIdNode {
+		return nil, InvalidIdNode
+	}
+	g := &IdGenerator{node: uint64(node), stateFile: stateFile, now: time.Now}
+
+	g.second = uint64(g.now().Unix())
+	if stateFile != "" {
+		if saved, err := ioutil.ReadFile(stateFile); err == nil {
+			second, err := strconv.ParseUint(strings.TrimSpace(string(saved)), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			if second > g.second {
+				g.second = second
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	// Mark the starting second used up, so the first id comes from the one after.
+	g.sequence = 1 << IdSequenceBits
+
+	return g, nil
+}
+
+// The next id.  An error means the state file couldn't be saved, though the id is still good for as
+// long as this process runs.
+func (g *IdGenerator) Next() (uint64, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	var err error
+	if now := uint64(g.now().Unix()); now > g.second {
+		g.second, g.sequence = now, 0
+		err = g.save()
+	} else if g.sequence == 1<<IdSequenceBits {
+		g.second, g.sequence = g.second+1, 0
+		err = g.save()
+	}
+
+	id := g.second<<IdTimestampShift | g.node<<IdSequenceBits | g.sequence
+	g.sequence++
+	return id, err
+}
+
+func (g *IdGenerator) save() error {
+	if g.stateFile == "" {
+		return nil
+	}
+
+	// Write then rename, so a crash never leaves half a file.
+	tmp, err := ioutil.TempFile(filepath.Dir(g.stateFile), filepath.Base(g.stateFile))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(strconv.FormatUint(g.second, 10) + "\n"); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), g.stateFile)
+}
+
+// Feeds ids into a channel, as NewRssMaster wants them.
+func (g *IdGenerator) Channel() <-chan uint64 {
+	ch := make(chan uint64)
+	go func() {
+		for {
+			id, err := g.Next()
+			if err != nil {
+				DefaultLogger.Log(LogError, "Failed to save id generator state", ErrorField(err))
+			}
+			ch <- id
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"testing"
+)
+
+func newTestIdGenerator(t *testing.T, node int, stateFile string, clock *time.Time) *IdGenerator {
+	g, err := NewIdGenerator(node, stateFile)
+	if err != nil {
+		t.Fatalf("Failed to make id generator (%s)", err)
+	}
+	g.now = func() time.Time { return *clock }
+	return g
+}
+
+func mustNextId(t *testing.T, g *IdGenerator) uint64 {
+	id, err := g.Next()
+	if err != nil {
+		t.Fatalf("Failed to make id (%s)", err)
+	}
+	return id
+}
+
+func TestIdGeneratorLayout(t *testing.T) {
+	clock := time.Now().Add(time.Minute)
+	g := newTestIdGenerator(t, 5, "", &clock)
+
+	id := mustNextId(t, g)
+	if !IdTimestamp(id).Equal(clock.Truncate(time.Second)) {
+		t.Errorf("Id has the wrong time (expected, got) (%v, %v)", clock.Truncate(time.Second), IdTimestamp(id))
+	}
+	if node := id >> IdSequenceBits & MaximumIdNode; node != 5 {
+		t.Errorf("Id has the wrong node (%v)", node)
+	}
+	if next := mustNextId(t, g); next != id+1 {
+		t.Errorf("Ids in the same second should count up (%v, %v)", id, next)
+	}
+
+	if _, err := NewIdGenerator(MaximumIdNode+1, ""); err != InvalidIdNode {
+		t.Errorf("Expected InvalidIdNode, got %v", err)
+	}
+}
+
+func TestIdGeneratorNeverGoesBackwards(t *testing.T) {
+	clock := time.Now().Add(time.Minute)
+	g := newTestIdGenerator(t, 0, "", &clock)
+
+	last := mustNextId(t, g)
+	check := func() {
+		id := mustNextId(t, g)
+		if id <= last {
+			t.Fatalf("Id went backwards (%v after %v)", id, last)
+		}
+		last = id
+	}
+
+	// Use up the second, which borrows from the next one.
+	for i := 0; i < 1<<IdSequenceBits+10; i++ {
+		check()
+	}
+	if !IdTimestamp(last).After(clock) {
+		t.Errorf("Running out of sequence didn't borrow the next second (%v)", IdTimestamp(last))
+	}
+
+	clock = clock.Add(-time.Hour)
+	check()
+	clock = clock.Add(2 * time.Hour)
+	check()
+	if !IdTimestamp(last).Equal(clock.Truncate(time.Second)) {
+		t.Errorf("Generator didn't catch up with the clock (%v)", IdTimestamp(last))
+	}
+}
+
+func TestIdGeneratorStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kilium-ids")
+	if err != nil {
+		t.Fatalf("Failed to make temporary directory (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "ids")
+
+	clock := time.Now().Add(time.Hour)
+	last := mustNextId(t, newTestIdGenerator(t, 0, stateFile, &clock))
+
+	// A restart with the clock set back still carries on from where the last run was.
+	clock = time.Now()
+	if id := mustNextId(t, newTestIdGenerator(t, 0, stateFile, &clock)); id <= last {
+		t.Errorf("Restarted generator reused old ids (%v after %v)", id, last)
+	}
+}
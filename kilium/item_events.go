@@ -0,0 +1,209 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"net/url"
+
+	"sync"
+)
+
+type ItemEventType int
+
+const (
+	NewItem ItemEventType = iota
+	UpdatedItem
+	DeletedItem
+)
+
+func (t ItemEventType) String() string {
+	switch t {
+	case NewItem:
+		return "new"
+	case UpdatedItem:
+		return "updated"
+	case DeletedItem:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+type ItemEvent struct {
+	Type    ItemEventType
+	FeedUrl url.URL
+	ItemKey ItemKey
+}
+
+// What a subscription does when an event arrives and its buffer is already full.
+type OverflowPolicy int
+
+const (
+	// Throw away the event that didn't fit.
+	DropNewest OverflowPolicy = iota
+	// Throw away the oldest buffered event to make room.
+	DropOldest
+	// Wait for the subscriber to make room.  This stalls the pipeline until it does, so only use
+	// this for consumers that must see every event.
+	Block
+)
+
+type ItemSubscription struct {
+	// Closed once the subscription is removed from its bus.
+	Events <-chan ItemEvent
+
+	events chan ItemEvent
+	policy OverflowPolicy
+
+	// Closed first on unsubscribe, so a blocked publisher lets go of lock.
+	done     chan struct{}
+	doneOnce sync.Once
+
+	lock    sync.Mutex
+	closed  bool
+	dropped uint64
+}
+
+// The number of events this subscription has lost to its overflow policy.
+func (s *ItemSubscription) Dropped() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.dropped
+}
+
+func (s *ItemSubscription) deliver(event ItemEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	switch s.policy {
+	case Block:
+		select {
+		case s.events <- event:
+		case <-s.done:
+		}
+	case DropOldest:
+		for {
+			select {
+			case s.events <- event:
+				return
+			default:
+			}
+			// Full, so make some room.  The subscriber may have emptied the buffer in the meantime,
+			// in which case nothing is lost.
+			select {
+			case <-s.events:
+				s.dropped++
+			default:
+				if cap(s.events) == 0 {
+					// Unbuffered, and nobody is waiting.  There is nothing older to drop.
+					s.dropped++
+					return
+				}
+			}
+		}
+	default:
+		select {
+		case s.events <- event:
+		default:
+			s.dropped++
+		}
+	}
+}
+
+func (s *ItemSubscription) close() {
+	s.doneOnce.Do(func() { close(s.done) })
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+}
+
+// ItemEventBus fans out item events to any number of subscribers.  Each subscriber has its own
+// buffer and overflow policy, so a slow subscriber only hurts itself unless it asks to Block.
+type ItemEventBus struct {
+	lock        sync.Mutex
+	subscribers []*ItemSubscription
+}
+
+func NewItemEventBus() *ItemEventBus {
+	return &ItemEventBus{}
+}
+
+func (b *ItemEventBus) Subscribe(bufferSize int, policy OverflowPolicy) *ItemSubscription {
+	events := make(chan ItemEvent, bufferSize)
+	sub := &ItemSubscription{
+		Events: events,
+
+		events: events,
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+
+	b.lock.Lock()
+	b.subscribers = append(b.subscribers, sub)
+	b.lock.Unlock()
+
+	return sub
+}
+
+func (b *ItemEventBus) Unsubscribe(sub *ItemSubscription) {
+	b.lock.Lock()
+	for i, next := range b.subscribers {
+		if next == sub {
+			b.subscribers = append(b.subscribers[:i], b.subscribers[i+1:]...)
+			break
+		}
+	}
+	b.lock.Unlock()
+
+	sub.close()
+}
+
+func (b *ItemEventBus) Publish(event ItemEvent) {
+	// Copy the subscribers so a blocking subscriber doesn't hold up (un)subscribing.
+	b.lock.Lock()
+	subscribers := make([]*ItemSubscription, len(b.subscribers))
+	copy(subscribers, b.subscribers)
+	b.lock.Unlock()
+
+	for _, sub := range subscribers {
+		sub.deliver(event)
+	}
+}
+
+// Publishes an event for every item touched by a successful feed update.  Failed results are ignored.
+func (b *ItemEventBus) PublishResult(result FeedUpdateResult) {
+	if result.Err != nil {
+		return
+	}
+	for _, key := range result.DeletedItemKeys {
+		b.Publish(ItemEvent{Type: DeletedItem, FeedUrl: result.Url, ItemKey: key})
+	}
+	for _, key := range result.UpdatedItemKeys {
+		b.Publish(ItemEvent{Type: UpdatedItem, FeedUrl: result.Url, ItemKey: key})
+	}
+	// Publish oldest first, so subscribers see items in the order they were given ids.
+	for i := len(result.NewItemKeys) - 1; i >= 0; i-- {
+		b.Publish(ItemEvent{Type: NewItem, FeedUrl: result.Url, ItemKey: result.NewItemKeys[i]})
+	}
+}
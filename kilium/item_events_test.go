@@ -0,0 +1,123 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"time"
+
+	"testing"
+)
+
+func publishTestEvents(bus *ItemEventBus, count int) {
+	for i := 0; i < count; i++ {
+		bus.Publish(ItemEvent{Type: NewItem, ItemKey: genItemKey(int64(i), "Event")})
+	}
+}
+
+func receivedEventIds(t *testing.T, sub *ItemSubscription, count int) (ids []int64) {
+	for i := 0; i < count; i++ {
+		select {
+		case event := <-sub.Events:
+			ids = append(ids, int64(event.ItemKey[7]))
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for event %v", i)
+		}
+	}
+	return
+}
+
+func TestItemEventBusDropNewest(t *testing.T) {
+	bus := NewItemEventBus()
+	sub := bus.Subscribe(2, DropNewest)
+
+	publishTestEvents(bus, 4)
+
+	if ids := receivedEventIds(t, sub, 2); ids[0] != 0 || ids[1] != 1 {
+		t.Errorf("Expected the first events to be kept, got %v", ids)
+	}
+	if sub.Dropped() != 2 {
+		t.Errorf("Expected 2 dropped events, got %v", sub.Dropped())
+	}
+}
+
+func TestItemEventBusDropOldest(t *testing.T) {
+	bus := NewItemEventBus()
+	sub := bus.Subscribe(2, DropOldest)
+
+	publishTestEvents(bus, 4)
+
+	if ids := receivedEventIds(t, sub, 2); ids[0] != 2 || ids[1] != 3 {
+		t.Errorf("Expected the last events to be kept, got %v", ids)
+	}
+	if sub.Dropped() != 2 {
+		t.Errorf("Expected 2 dropped events, got %v", sub.Dropped())
+	}
+
+	// An unbuffered subscriber with nobody listening can't keep anything.
+	unbuffered := bus.Subscribe(0, DropOldest)
+	publishTestEvents(bus, 1)
+	if unbuffered.Dropped() != 1 {
+		t.Errorf("Expected the unbuffered event to be dropped, got %v", unbuffered.Dropped())
+	}
+}
+
+func TestItemEventBusBlock(t *testing.T) {
+	bus := NewItemEventBus()
+	sub := bus.Subscribe(1, Block)
+	other := bus.Subscribe(10, DropNewest)
+
+	done := make(chan bool)
+	go func() {
+		publishTestEvents(bus, 3)
+		done <- true
+	}()
+
+	if ids := receivedEventIds(t, sub, 3); ids[0] != 0 || ids[1] != 1 || ids[2] != 2 {
+		t.Errorf("Expected every event in order, got %v", ids)
+	}
+	<-done
+	if sub.Dropped() != 0 || other.Dropped() != 0 {
+		t.Errorf("Events were dropped (%v, %v)", sub.Dropped(), other.Dropped())
+	}
+}
+
+func TestItemEventBusUnsubscribeReleasesPublisher(t *testing.T) {
+	bus := NewItemEventBus()
+	sub := bus.Subscribe(0, Block)
+
+	done := make(chan bool)
+	go func() {
+		publishTestEvents(bus, 1)
+		done <- true
+	}()
+
+	// Give the publisher a chance to block.
+	time.Sleep(10 * time.Millisecond)
+	bus.Unsubscribe(sub)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publisher stayed blocked after unsubscribing")
+	}
+	if _, ok := <-sub.Events; ok {
+		t.Error("Events channel wasn't closed after unsubscribing")
+	}
+
+	// Publishing with nobody around should be harmless.
+	publishTestEvents(bus, 1)
+}
@@ -0,0 +1,264 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// How many earlier versions of an item are kept.
+const MaximumItemRevisions = 10
+
+// Diffs bigger than this many word pairs just replace everything that changed, instead of finding
+// the smallest set of changes.  The table takes eight bytes a pair, so this keeps it near 2MB.
+const maximumDiffCells = 250000
+
+var RevisionOutOfRange = errors.New("No such revision!")
+
+// An earlier version of an item.
+type ItemRevision struct {
+	Title   string
+	Author  string
+	Content string
+	Url     url.URL
+	PubDate time.Time
+
+	// When the publisher replaced this version.
+	Replaced time.Time
+}
+
+func (f *FeedItem) currentRevision() ItemRevision {
+	return ItemRevision{
+		Title:   f.Title,
+		Author:  f.Author,
+		Content: f.Content,
+		Url:     f.Url,
+		PubDate: f.PubDate,
+	}
+}
+
+// Pushes the item's current content onto its history, forgetting the oldest revisions if there are
+// too many.
+func (f *FeedItem) addRevision(replaced time.Time) {
+	revision := f.currentRevision()
+	revision.Replaced = replaced
+
+	f.Revisions = append(f.Revisions, revision)
+	if len(f.Revisions) > MaximumItemRevisions {
+		f.Revisions = f.Revisions[len(f.Revisions)-MaximumItemRevisions:]
+	}
+}
+
+// Urls and times are compared by value, like ItemRevision.equal.
+func (f *FeedItem) revisionDiffers(item ParsedFeedItem) bool {
+	return f.Title != item.Title ||
+		f.Author != item.Author ||
+		f.Content != item.Content ||
+		f.Url.String() != item.Url.String() ||
+		!f.PubDate.Equal(item.PubDate)
+}
+
+// Compares by value, since decoded times and urls carry pointers that == would compare instead.
+func (r ItemRevision) equal(other ItemRevision) bool {
+	return r.Title == other.Title &&
+		r.Author == other.Author &&
+		r.Content == other.Content &&
+		r.Url.String() == other.Url.String() &&
+		r.PubDate.Equal(other.PubDate) &&
+		r.Replaced.Equal(other.Replaced)
+}
+
+// Merges the siblings' histories, oldest first, dropping duplicates.
+func mergeItemRevisions(x, y []ItemRevision) []ItemRevision {
+	merged := append(append([]ItemRevision{}, x...), y...)
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].Replaced.Before(merged[j].Replaced) })
+
+	ret := merged[:0]
+	for _, revision := range merged {
+		if len(ret) != 0 && ret[len(ret)-1].equal(revision) {
+			continue
+		}
+		ret = append(ret, revision)
+	}
+	if len(ret) > MaximumItemRevisions {
+		ret = ret[len(ret)-MaximumItemRevisions:]
+	}
+	return ret
+}
+
+// Returns revision n, counting from the oldest kept.  The current content is revision
+// len(f.Revisions).
+func (f *FeedItem) Revision(n int) (ItemRevision, error) {
+	if n < 0 || n > len(f.Revisions) {
+		return ItemRevision{}, RevisionOutOfRange
+	} else if n == len(f.Revisions) {
+		return f.currentRevision(), nil
+	}
+	return f.Revisions[n], nil
+}
+
+type DiffOp int
+
+const (
+	DiffEqual DiffOp = iota
+	DiffInsert
+	DiffDelete
+)
+
+func (op DiffOp) String() string {
+	switch op {
+	case DiffInsert:
+		return "insert"
+	case DiffDelete:
+		return "delete"
+	}
+	return "equal"
+}
+
+type DiffChunk struct {
+	Op   DiffOp
+	Text string
+}
+
+// What changed between two revisions.
+type RevisionDiff struct {
+	Title   []DiffChunk
+	Author  []DiffChunk
+	Content []DiffChunk
+
+	OldUrl, NewUrl         url.URL
+	OldPubDate, NewPubDate time.Time
+}
+
+// Splits text into words and the space between them, so the pieces join back into the text.
+func diffTokens(text string) []string {
+	var tokens []string
+	start, inSpace := 0, false
+	for i, r := range text {
+		space := unicode.IsSpace(r)
+		if i != start && space != inSpace {
+			tokens = append(tokens, text[start:i])
+			start = i
+		}
+		inSpace = space
+	}
+	if start < len(text) {
+		tokens = append(tokens, text[start:])
+	}
+	return tokens
+}
+
+func appendDiffChunk(chunks []DiffChunk, op DiffOp, text string) []DiffChunk {
+	if len(chunks) != 0 && chunks[len(chunks)-1].Op == op {
+		chunks[len(chunks)-1].Text += text
+		return chunks
+	}
+	return append(chunks, DiffChunk{op, text})
+}
+
+// Diffs two texts word by word.
+func DiffText(old, updated string) []DiffChunk {
+	oldTokens, newTokens := diffTokens(old), diffTokens(updated)
+
+	// Common ends don't need the expensive part.
+	prefix := 0
+	for prefix < len(oldTokens) && prefix < len(newTokens) && oldTokens[prefix] == newTokens[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(oldTokens)-prefix && suffix < len(newTokens)-prefix &&
+		oldTokens[len(oldTokens)-1-suffix] == newTokens[len(newTokens)-1-suffix] {
+		suffix++
+	}
+
+	var chunks []DiffChunk
+	if prefix != 0 {
+		chunks = appendDiffChunk(chunks, DiffEqual, strings.Join(oldTokens[:prefix], ""))
+	}
+
+	a, b := oldTokens[prefix:len(oldTokens)-suffix], newTokens[prefix:len(newTokens)-suffix]
+	if len(a)*len(b) > maximumDiffCells {
+		chunks = appendDiffChunk(chunks, DiffDelete, strings.Join(a, ""))
+		chunks = appendDiffChunk(chunks, DiffInsert, strings.Join(b, ""))
+	} else {
+		// lcs[i][j] is the longest common subsequence of a[i:] and b[j:].
+		lcs := make([][]int, len(a)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				if a[i] == b[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else if lcs[i+1][j] >= lcs[i][j+1] {
+					lcs[i][j] = lcs[i+1][j]
+				} else {
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+
+		i, j := 0, 0
+		for i < len(a) || j < len(b) {
+			switch {
+			case i < len(a) && j < len(b) && a[i] == b[j]:
+				chunks = appendDiffChunk(chunks, DiffEqual, a[i])
+				i++
+				j++
+			case j < len(b) && (i == len(a) || lcs[i][j+1] > lcs[i+1][j]):
+				chunks = appendDiffChunk(chunks, DiffInsert, b[j])
+				j++
+			default:
+				chunks = appendDiffChunk(chunks, DiffDelete, a[i])
+				i++
+			}
+		}
+	}
+
+	if suffix != 0 {
+		chunks = appendDiffChunk(chunks, DiffEqual, strings.Join(oldTokens[len(oldTokens)-suffix:], ""))
+	}
+	return chunks
+}
+
+// Diffs revision from against revision to.  See Revision for how they are numbered.
+func (f *FeedItem) DiffRevisions(from, to int) (*RevisionDiff, error) {
+	old, err := f.Revision(from)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := f.Revision(to)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RevisionDiff{
+		Title:   DiffText(old.Title, updated.Title),
+		Author:  DiffText(old.Author, updated.Author),
+		Content: DiffText(old.Content, updated.Content),
+
+		OldUrl:     old.Url,
+		NewUrl:     updated.Url,
+		OldPubDate: old.PubDate,
+		NewPubDate: updated.PubDate,
+	}, nil
+}
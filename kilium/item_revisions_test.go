@@ -0,0 +1,184 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"testing"
+)
+
+func TestDiffText(t *testing.T) {
+	chunks := DiffText("the quick brown fox jumps", "the slow brown fox leaps")
+	expected := []DiffChunk{
+		{DiffEqual, "the "},
+		{DiffDelete, "quick"},
+		{DiffInsert, "slow"},
+		{DiffEqual, " brown fox "},
+		{DiffDelete, "jumps"},
+		{DiffInsert, "leaps"},
+	}
+	if !reflect.DeepEqual(chunks, expected) {
+		t.Errorf("Wrong diff (expected, got) (%v, %v)", expected, chunks)
+	}
+
+	if chunks := DiffText("same", "same"); !reflect.DeepEqual(chunks, []DiffChunk{{DiffEqual, "same"}}) {
+		t.Errorf("Unchanged text should be one equal chunk, got %v", chunks)
+	}
+	if chunks := DiffText("", "new"); !reflect.DeepEqual(chunks, []DiffChunk{{DiffInsert, "new"}}) {
+		t.Errorf("New text should be one insert, got %v", chunks)
+	}
+}
+
+func TestDiffTextRebuildsBothSides(t *testing.T) {
+	old, updated := "a b c d e f g", "x a c d y f g z"
+	var rebuiltOld, rebuiltNew string
+	for _, chunk := range DiffText(old, updated) {
+		if chunk.Op != DiffInsert {
+			rebuiltOld += chunk.Text
+		}
+		if chunk.Op != DiffDelete {
+			rebuiltNew += chunk.Text
+		}
+	}
+	if rebuiltOld != old || rebuiltNew != updated {
+		t.Errorf("Diff doesn't rebuild its sides (%q, %q)", rebuiltOld, rebuiltNew)
+	}
+}
+
+func TestAddRevisionIsBounded(t *testing.T) {
+	item := &FeedItem{}
+	for i := 0; i < MaximumItemRevisions+5; i++ {
+		item.Title = strconv.Itoa(i)
+		item.addRevision(time.Unix(int64(i), 0))
+	}
+
+	if len(item.Revisions) != MaximumItemRevisions {
+		t.Fatalf("Expected %d revisions, got %d", MaximumItemRevisions, len(item.Revisions))
+	}
+	if item.Revisions[0].Title != "5" || item.Revisions[MaximumItemRevisions-1].Title != strconv.Itoa(MaximumItemRevisions+4) {
+		t.Errorf("The oldest revisions should be dropped, got %v", item.Revisions)
+	}
+}
+
+func TestMergeItemRevisions(t *testing.T) {
+	a := ItemRevision{Title: "a", Replaced: time.Unix(1, 0)}
+	b := ItemRevision{Title: "b", Replaced: time.Unix(2, 0)}
+	c := ItemRevision{Title: "c", Replaced: time.Unix(3, 0)}
+
+	merged := mergeItemRevisions([]ItemRevision{a, c}, []ItemRevision{a, b})
+	expected := []ItemRevision{a, b, c}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("Wrong merge (expected, got) (%v, %v)", expected, merged)
+	}
+
+	// Siblings decode into different pointers, which mustn't keep duplicates apart.
+	withUrl := ItemRevision{Title: "d", Url: url.URL{Scheme: "http", Host: "example.com", User: url.User("me")}, Replaced: time.Unix(4, 0)}
+	decoded := withUrl
+	decoded.Url.User = url.User("me")
+	decoded.Replaced = decoded.Replaced.In(time.FixedZone("EST", -5*60*60))
+	if merged := mergeItemRevisions([]ItemRevision{withUrl}, []ItemRevision{decoded}); len(merged) != 1 {
+		t.Errorf("Duplicate revisions weren't merged (%v)", merged)
+	}
+}
+
+func TestRevisionDiffersComparesUrlsByValue(t *testing.T) {
+	item := &FeedItem{Title: "a", Url: url.URL{Scheme: "http", Host: "example.com", User: url.User("me")}, PubDate: time.Unix(1, 0)}
+	parsed := ParsedFeedItem{Title: "a", Url: item.Url, PubDate: time.Unix(1, 0).In(time.FixedZone("EST", -5*60*60))}
+	parsed.Url.User = url.User("me")
+	if item.revisionDiffers(parsed) {
+		t.Errorf("Equal urls and dates were taken for a change")
+	}
+	if itemDiffersFromModel(parsed, item) {
+		t.Errorf("Equal urls and dates were taken for a change to the item")
+	}
+
+	parsed.Url.Host = "example.org"
+	if !item.revisionDiffers(parsed) {
+		t.Errorf("A changed url wasn't noticed")
+	}
+}
+
+func TestDiffTextGivesUpOnHugeChanges(t *testing.T) {
+	old := strings.Repeat("a ", maximumDiffCells)
+	updated := strings.Repeat("b ", 2)
+	expected := []DiffChunk{{DiffDelete, strings.TrimSuffix(old, " ")}, {DiffInsert, strings.TrimSuffix(updated, " ")}, {DiffEqual, " "}}
+	if chunks := DiffText(old, updated); !reflect.DeepEqual(chunks, expected) {
+		t.Errorf("Huge diff wasn't replaced whole (%d chunks)", len(chunks))
+	}
+}
+
+func TestDiffRevisions(t *testing.T) {
+	item := &FeedItem{Title: "Old title", Content: "some text"}
+	item.addRevision(time.Unix(1, 0))
+	item.Title = "New title"
+
+	diff, err := item.DiffRevisions(0, 1)
+	if err != nil {
+		t.Fatalf("Failed to diff (%s)", err)
+	}
+	expected := []DiffChunk{{DiffDelete, "Old"}, {DiffInsert, "New"}, {DiffEqual, " title"}}
+	if !reflect.DeepEqual(diff.Title, expected) {
+		t.Errorf("Wrong title diff (expected, got) (%v, %v)", expected, diff.Title)
+	}
+	if !reflect.DeepEqual(diff.Content, []DiffChunk{{DiffEqual, "some text"}}) {
+		t.Errorf("Content shouldn't change, got %v", diff.Content)
+	}
+
+	if _, err := item.DiffRevisions(0, 2); err != RevisionOutOfRange {
+		t.Errorf("Expected RevisionOutOfRange, got %v", err)
+	}
+}
+
+func TestUpdateItemKeepsRevisions(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	key := NewItemKey(1<<IdTimestampShift, []byte("revisions"))
+	if err := InsertItem(con, "", key, ParsedFeedItem{Title: "First"}); err != nil {
+		t.Fatalf("Failed to insert item (%s)", err)
+	}
+
+	update := func(item ParsedFeedItem) *FeedItem {
+		model := &FeedItem{}
+		if err := con.LoadModel(key.GetRiakKey(), model); err != nil {
+			t.Fatalf("Failed to load item (%s)", err)
+		}
+		if err := UpdateItem(con, "", key, item, model); err != nil {
+			t.Fatalf("Failed to update item (%s)", err)
+		}
+		if err := con.LoadModel(key.GetRiakKey(), model); err != nil {
+			t.Fatalf("Failed to load item (%s)", err)
+		}
+		return model
+	}
+
+	model := update(ParsedFeedItem{Title: "Second"})
+	if len(model.Revisions) != 1 || model.Revisions[0].Title != "First" || model.Revisions[0].Replaced.IsZero() {
+		t.Errorf("Expected the first version to be kept, got %v", model.Revisions)
+	}
+
+	// Only the categories changed, which isn't a new revision.
+	model = update(ParsedFeedItem{Title: "Second", Categories: []string{"news"}})
+	if len(model.Revisions) != 1 {
+		t.Errorf("Category changes shouldn't add revisions, got %v", model.Revisions)
+	}
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"net/url"
+)
+
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var UnknownLogLevel = errors.New("Unknown log level")
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	}
+	return "unknown"
+}
+
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level := LogDebug; level <= LogError; level++ {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+	}
+	return LogDebug, UnknownLogLevel
+}
+
+// A named value attached to a log message, so messages can be filtered on them.
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+func FeedField(Url url.URL) LogField {
+	return LogField{"feed", Url.String()}
+}
+
+// The pipeline stage a message is about.
+func StageField(stage PipelineStage) LogField {
+	return LogField{"stage", stage.String()}
+}
+
+func ItemCountField(count int) LogField {
+	return LogField{"items", count}
+}
+
+func DurationField(duration time.Duration) LogField {
+	return LogField{"duration", duration}
+}
+
+func ErrorField(err error) LogField {
+	return LogField{"error", err}
+}
+
+func RetryableField(err PipelineError) LogField {
+	return LogField{"retryable", err.Retryable()}
+}
+
+type Logger interface {
+	// Writes msg with fields, unless level is below what the logger shows.
+	Log(level LogLevel, msg string, fields ...LogField)
+	// Returns a logger that adds fields to every message.
+	With(fields ...LogField) Logger
+}
+
+// Used by everything not given its own logger.  RssMaster uses it unless RssMasterConfig says
+// otherwise.
+var DefaultLogger Logger = NewTextLogger(os.Stderr, LogInfo)
+
+// Loggers share their output with the loggers made from them by With, so writes are locked together.
+type lockedWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (w *lockedWriter) write(line []byte) {
+	w.lock.Lock()
+	w.w.Write(line)
+	w.lock.Unlock()
+}
+
+type textLogger struct {
+	out    *lockedWriter
+	level  LogLevel
+	fields []LogField
+}
+
+// Writes messages at or above level as lines of text, with fields as key=value pairs.
+func NewTextLogger(w io.Writer, level LogLevel) Logger {
+	return &textLogger{out: &lockedWriter{w: w}, level: level}
+}
+
+func (l *textLogger) Log(level LogLevel, msg string, fields ...LogField) {
+	if level < l.level {
+		return
+	}
+	line := fmt.Sprintf("%s %-5s %s", time.Now().Format("2006/01/02 15:04:05"), strings.ToUpper(level.String()), msg)
+	for _, field := range append(l.fields, fields...) {
+		value := fmt.Sprint(field.Value)
+		if strings.ContainsAny(value, " \"=\n") {
+			value = fmt.Sprintf("%q", value)
+		}
+		line += " " + field.Key + "=" + value
+	}
+	l.out.write([]byte(line + "\n"))
+}
+
+func (l *textLogger) With(fields ...LogField) Logger {
+	return &textLogger{out: l.out, level: l.level, fields: append(l.fields[:len(l.fields):len(l.fields)], fields...)}
+}
+
+type jsonLogger struct {
+	out    *lockedWriter
+	level  LogLevel
+	fields []LogField
+}
+
+// Writes messages at or above level as one JSON object per line, for shipping to log collectors.
+// Each object has time, level and msg, plus a member for every field.  Durations are in seconds.
+func NewJSONLogger(w io.Writer, level LogLevel) Logger {
+	return &jsonLogger{out: &lockedWriter{w: w}, level: level}
+}
+
+func (l *jsonLogger) Log(level LogLevel, msg string, fields ...LogField) {
+	if level < l.level {
+		return
+	}
+	entry := map[string]interface{}{
+		"time":  time.Now().Format(time.RFC3339Nano),
+		"level": level.String(),
+		"msg":   msg,
+	}
+	for _, field := range append(l.fields, fields...) {
+		switch value := field.Value.(type) {
+		case error:
+			entry[field.Key] = value.Error()
+		case time.Duration:
+			entry[field.Key] = value.Seconds()
+		default:
+			entry[field.Key] = value
+		}
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{"time": entry["time"], "level": "error", "msg": "Failed to encode log message: " + err.Error()})
+	}
+	l.out.write(append(line, '\n'))
+}
+
+func (l *jsonLogger) With(fields ...LogField) Logger {
+	return &jsonLogger{out: l.out, level: l.level, fields: append(l.fields[:len(l.fields):len(l.fields)], fields...)}
+}
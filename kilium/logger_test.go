@@ -0,0 +1,85 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"net/url"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for _, level := range []LogLevel{LogDebug, LogInfo, LogWarn, LogError} {
+		if parsed, err := ParseLogLevel(strings.ToUpper(level.String())); err != nil || parsed != level {
+			t.Errorf("Parsing %v gave %v, %v", level, parsed, err)
+		}
+	}
+	if _, err := ParseLogLevel("loud"); err != UnknownLogLevel {
+		t.Error("Unknown level parsed:", err)
+	}
+}
+
+func TestTextLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewTextLogger(&buf, LogInfo)
+	Url, _ := url.Parse("http://example.com/feed")
+
+	logger.Log(LogDebug, "Hidden")
+	logger.With(FeedField(*Url)).Log(LogWarn, "Failed to fetch feed", StageField(FetchStage), ErrorField(errors.New("no such host")))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 1 {
+		t.Fatal("Expected one line, got", lines)
+	}
+	expected := ` WARN  Failed to fetch feed feed=http://example.com/feed stage=fetch error="no such host"`
+	if !strings.HasSuffix(lines[0], expected) {
+		t.Errorf("Expected a line ending in %q, got %q", expected, lines[0])
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf, LogDebug)
+	Url, _ := url.Parse("http://example.com/feed")
+
+	base := logger.With(FeedField(*Url))
+	base.Log(LogInfo, "Polled feed", ItemCountField(3), DurationField(1500*time.Millisecond))
+	// Fields added to one message mustn't leak into the next.
+	base.Log(LogError, "Failed to store feed", StageField(StoreStage), ErrorField(errors.New("timeout")))
+
+	decoder := json.NewDecoder(&buf)
+	var first, second map[string]interface{}
+	if err := decoder.Decode(&first); err != nil {
+		t.Fatal(err)
+	}
+	if err := decoder.Decode(&second); err != nil {
+		t.Fatal(err)
+	}
+
+	if first["level"] != "info" || first["msg"] != "Polled feed" || first["feed"] != "http://example.com/feed" ||
+		first["items"] != 3.0 || first["duration"] != 1.5 || first["time"] == nil {
+		t.Error("Bad first entry:", first)
+	}
+	if second["level"] != "error" || second["stage"] != "store" || second["error"] != "timeout" || second["items"] != nil {
+		t.Error("Bad second entry:", second)
+	}
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	riak "github.com/tpjg/goriakpbc"
+)
+
+// Prometheus' default histogram buckets, in seconds.
+var DefaultMetricBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Every metric kilium keeps.  Serving it over HTTP gives Prometheus' text format.
+var Metrics = NewMetricsRegistry()
+
+var (
+	fetchesMetric       = Metrics.NewCounter("kilium_fetches_total", "Feed fetches, by HTTP status code, or error if no response came back.", "code")
+	fetchDurationMetric = Metrics.NewHistogram("kilium_fetch_duration_seconds", "How long fetching a feed took.", DefaultMetricBuckets)
+	fetchBytesMetric    = Metrics.NewCounter("kilium_fetch_bytes_total", "Bytes of feeds downloaded.")
+	parseFailuresMetric = Metrics.NewCounter("kilium_parse_failures_total", "Feeds that failed to parse.")
+	itemsMetric         = Metrics.NewCounter("kilium_items_total", "Items changed by feed updates, by change.", "change")
+
+	riakDurationMetric = Metrics.NewHistogram("kilium_riak_operation_duration_seconds", "How long riak operations took, by operation.", DefaultMetricBuckets, "operation")
+	riakErrorsMetric   = Metrics.NewCounter("kilium_riak_errors_total", "Failed riak operations, by operation.", "operation")
+
+	pipelineQueueMetric    = Metrics.NewGauge("kilium_pipeline_queue_depth", "Feeds waiting to enter each pipeline stage.", "stage")
+	scheduledFeedsMetric   = Metrics.NewGauge("kilium_scheduled_feeds", "Feeds queued by the scheduler.")
+	outstandingFeedsMetric = Metrics.NewGauge("kilium_outstanding_feeds", "Feeds sent into the pipeline that haven't finished.")
+	overdueFeedsMetric     = Metrics.NewGauge("kilium_overdue_feeds", "Queued feeds past when they were due, waiting for room in the pipeline.")
+)
+
+// Records how long a riak operation took, and whether it failed.  Not finding something isn't a
+// failure.
+func observeRiak(operation string, start time.Time, err error) {
+	riakDurationMetric.Observe(time.Since(start).Seconds(), operation)
+	if err != nil && err != riak.NotFound {
+		riakErrorsMetric.Inc(operation)
+	}
+}
+
+type metricSeries struct {
+	labelValues []string
+
+	value float64
+	fn    func() float64
+
+	// Histograms only.  counts[i] is how many observations fell at or under buckets[i].
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type metricFamily struct {
+	name, help, kind string
+	labels           []string
+	buckets          []float64
+
+	lock   sync.Mutex
+	series map[string]*metricSeries
+}
+
+func (f *metricFamily) get(labelValues []string) *metricSeries {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("Metric %s takes %d labels, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	series, ok := f.series[key]
+	if !ok {
+		series = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		if f.buckets != nil {
+			series.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = series
+	}
+	return series
+}
+
+type Counter struct{ family *metricFamily }
+type Gauge struct{ family *metricFamily }
+type Histogram struct{ family *metricFamily }
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	c.family.lock.Lock()
+	c.family.get(labelValues).value += delta
+	c.family.lock.Unlock()
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.family.lock.Lock()
+	series := g.family.get(labelValues)
+	series.value, series.fn = value, nil
+	g.family.lock.Unlock()
+}
+
+// Reads the gauge from fn whenever the metrics are written.
+func (g *Gauge) SetFunc(fn func() float64, labelValues ...string) {
+	g.family.lock.Lock()
+	g.family.get(labelValues).fn = fn
+	g.family.lock.Unlock()
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.family.lock.Lock()
+	series := h.family.get(labelValues)
+	for i, bound := range h.family.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.sum += value
+	series.count++
+	h.family.lock.Unlock()
+}
+
+type MetricsRegistry struct {
+	lock     sync.Mutex
+	families []*metricFamily
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{}
+}
+
+func (r *MetricsRegistry) newFamily(name, help, kind string, buckets []float64, labels []string) *metricFamily {
+	family := &metricFamily{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*metricSeries)}
+	if len(labels) == 0 {
+		// Without labels there is only one series, so show it from the start.
+		family.get(nil)
+	}
+	r.lock.Lock()
+	r.families = append(r.families, family)
+	r.lock.Unlock()
+	return family
+}
+
+func (r *MetricsRegistry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.newFamily(name, help, "counter", nil, labels)}
+}
+
+func (r *MetricsRegistry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.newFamily(name, help, "gauge", nil, labels)}
+}
+
+// buckets are the upper bounds of the histogram's buckets, in increasing order.
+func (r *MetricsRegistry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{r.newFamily(name, help, "histogram", buckets, labels)}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatMetricLabels(names, values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelValueEscaper.Replace(values[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (f *metricFamily) write(w io.Writer) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := f.series[key]
+		if f.kind != "histogram" {
+			value := series.value
+			if series.fn != nil {
+				value = series.fn()
+			}
+			fmt.Fprintf(w, "%s%s %s\n", f.name, formatMetricLabels(f.labels, series.labelValues, "", ""), formatMetricValue(value))
+			continue
+		}
+
+		for i, bound := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatMetricLabels(f.labels, series.labelValues, "le", formatMetricValue(bound)), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatMetricLabels(f.labels, series.labelValues, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatMetricLabels(f.labels, series.labelValues, "", ""), formatMetricValue(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatMetricLabels(f.labels, series.labelValues, "", ""), series.count)
+	}
+}
+
+// Writes every metric in Prometheus' text format.
+func (r *MetricsRegistry) Write(w io.Writer) error {
+	buffered := bufio.NewWriter(w)
+	r.lock.Lock()
+	families := append([]*metricFamily(nil), r.families...)
+	r.lock.Unlock()
+
+	for _, family := range families {
+		family.write(buffered)
+	}
+	return buffered.Flush()
+}
+
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
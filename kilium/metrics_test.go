@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func checkMetricsOutput(t *testing.T, registry *MetricsRegistry, expected string) {
+	var buf bytes.Buffer
+	if err := registry.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expected {
+		t.Errorf("Unexpected metrics output:\n%s\nExpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestMetricsCounterAndGauge(t *testing.T) {
+	registry := NewMetricsRegistry()
+	counter := registry.NewCounter("test_total", "A counter.", "code")
+	gauge := registry.NewGauge("test_depth", "A gauge.")
+
+	counter.Inc("200")
+	counter.Inc("200")
+	counter.Add(3, "404")
+	gauge.Set(7)
+
+	checkMetricsOutput(t, registry, `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{code="200"} 2
+test_total{code="404"} 3
+# HELP test_depth A gauge.
+# TYPE test_depth gauge
+test_depth 7
+`)
+
+	depth := 1
+	gauge.SetFunc(func() float64 { return float64(depth) })
+	depth = 4
+	var buf bytes.Buffer
+	registry.Write(&buf)
+	if !strings.Contains(buf.String(), "test_depth 4\n") {
+		t.Error("Gauge function wasn't called when writing:", buf.String())
+	}
+}
+
+func TestMetricsUnusedSeries(t *testing.T) {
+	registry := NewMetricsRegistry()
+	registry.NewCounter("test_total", "A counter.")
+	registry.NewCounter("test_labelled_total", "A labelled counter.", "code")
+
+	// Only the series without labels is known before it is used.
+	checkMetricsOutput(t, registry, `# HELP test_total A counter.
+# TYPE test_total counter
+test_total 0
+# HELP test_labelled_total A labelled counter.
+# TYPE test_labelled_total counter
+`)
+}
+
+func TestMetricsHistogram(t *testing.T) {
+	registry := NewMetricsRegistry()
+	histogram := registry.NewHistogram("test_seconds", "A histogram.", []float64{0.5, 1, 2.5}, "operation")
+
+	histogram.Observe(0.25, "load")
+	histogram.Observe(1, "load")
+	histogram.Observe(10, "load")
+
+	checkMetricsOutput(t, registry, `# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{operation="load",le="0.5"} 1
+test_seconds_bucket{operation="load",le="1"} 2
+test_seconds_bucket{operation="load",le="2.5"} 2
+test_seconds_bucket{operation="load",le="+Inf"} 3
+test_seconds_sum{operation="load"} 11.25
+test_seconds_count{operation="load"} 3
+`)
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	registry := NewMetricsRegistry()
+	counter := registry.NewCounter("test_total", "A counter.", "stage")
+	counter.Inc("a \"quoted\"\\stage\nname")
+
+	checkMetricsOutput(t, registry, `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{stage="a \"quoted\"\\stage\nname"} 1
+`)
+}
@@ -16,11 +16,41 @@
  */
 package kilium
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
-// For this to be a valid error, there must be one error in the slice.  Otherwise Error will panic!
+// How many of a MultiError's errors its message lists.  The rest are only counted.
+const MultiErrorShown = 5
+
+// Several errors returned as one.  errors.Is and errors.As look through every one of them.
 type MultiError []error
 
 func (m MultiError) Error() string {
-	return fmt.Sprintf("%v errors returned, first is %s", len(m), m[0])
+	switch len(m) {
+	case 0:
+		return "no errors"
+	case 1:
+		return m[0].Error()
+	}
+
+	shown := m
+	if len(shown) > MultiErrorShown {
+		shown = shown[:MultiErrorShown]
+	}
+	messages := make([]string, len(shown))
+	for i, err := range shown {
+		messages[i] = err.Error()
+	}
+
+	msg := fmt.Sprintf("%v errors: %s", len(m), strings.Join(messages, "; "))
+	if len(m) > len(shown) {
+		msg += fmt.Sprintf("; and %v more", len(m)-len(shown))
+	}
+	return msg
+}
+
+func (m MultiError) Unwrap() []error {
+	return m
 }
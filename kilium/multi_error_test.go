@@ -0,0 +1,64 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"net/url"
+)
+
+func TestMultiErrorMessage(t *testing.T) {
+	if msg := MultiError(nil).Error(); msg != "no errors" {
+		t.Error("Bad message for no errors:", msg)
+	}
+	if msg := (MultiError{errors.New("one")}).Error(); msg != "one" {
+		t.Error("Bad message for one error:", msg)
+	}
+	if msg := (MultiError{errors.New("one"), errors.New("two")}).Error(); msg != "2 errors: one; two" {
+		t.Error("Bad message for two errors:", msg)
+	}
+
+	var many MultiError
+	for i := 0; i < MultiErrorShown+2; i++ {
+		many = append(many, fmt.Errorf("%v", i))
+	}
+	if msg := many.Error(); msg != "7 errors: 0; 1; 2; 3; 4; and 2 more" {
+		t.Error("Bad message for many errors:", msg)
+	}
+}
+
+func TestMultiErrorUnwrap(t *testing.T) {
+	Url, _ := url.Parse("http://example.com/feed")
+	var err error = MultiError{
+		errors.New("Random failure"),
+		FeedError{FeedNotFound, *Url},
+	}
+
+	if !errors.Is(err, FeedNotFound) {
+		t.Error("errors.Is didn't find the error inside the FeedError")
+	}
+	var feedErr FeedError
+	if !errors.As(err, &feedErr) || feedErr.Url != *Url {
+		t.Error("errors.As didn't find the FeedError:", feedErr)
+	}
+	if errors.Is(err, FeedLeased) {
+		t.Error("errors.Is found an error that isn't there")
+	}
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+type PipelineStage int
+
+const (
+	UnknownStage PipelineStage = iota
+	FetchStage
+	ParseStage
+	StoreStage
+)
+
+func (s PipelineStage) String() string {
+	switch s {
+	case FetchStage:
+		return "fetch"
+	case ParseStage:
+		return "parse"
+	case StoreStage:
+		return "store"
+	}
+	return "unknown"
+}
+
+// Implemented by the errors each stage of the pipeline fails with.  Retryable errors are likely to
+// go away on their own, so the feed is tried again soon.  Others need the feed or its server fixed
+// first.
+type PipelineError interface {
+	error
+	Stage() PipelineStage
+	Retryable() bool
+}
+
+// Finds the PipelineError in err's chain, or returns nil if there isn't one.
+func AsPipelineError(err error) PipelineError {
+	var pipelineErr PipelineError
+	if errors.As(err, &pipelineErr) {
+		return pipelineErr
+	}
+	return nil
+}
+
+// Retrieving the feed failed.  StatusCode is 0 when no response came back, in which case Err says
+// why.
+type FetchError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e FetchError) Error() string {
+	if e.StatusCode == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("Failed to successfully retrieve item, error code %v", e.StatusCode)
+}
+
+func (e FetchError) Unwrap() error {
+	return e.Err
+}
+
+func (e FetchError) Stage() PipelineStage {
+	return FetchStage
+}
+
+// Server errors, timeouts, rate limits and network trouble pass.  Missing feeds, denied requests and
+// names that don't resolve don't.
+func (e FetchError) Retryable() bool {
+	switch {
+	case e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests:
+		return true
+	case e.StatusCode >= 500:
+		return true
+	case e.StatusCode != 0:
+		return false
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(e.Err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+	return true
+}
+
+// The feed couldn't be parsed.  Line is where in the feed the problem is, or 0 when the problem isn't
+// with the XML itself.
+type ParseError struct {
+	Line int
+	Err  error
+}
+
+func newParseError(err error) ParseError {
+	parseErr := ParseError{Err: err}
+	var syntaxErr *xml.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		parseErr.Line = syntaxErr.Line
+	}
+	return parseErr
+}
+
+func (e ParseError) Error() string {
+	if e.Line == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("line %v: %s", e.Line, e.Err)
+}
+
+func (e ParseError) Unwrap() error {
+	return e.Err
+}
+
+func (e ParseError) Stage() PipelineStage {
+	return ParseStage
+}
+
+// The same content will fail the same way, so there is no point retrying until the feed changes.
+func (e ParseError) Retryable() bool {
+	return false
+}
+
+// Storing the feed or its items in riak failed.
+type StoreError struct {
+	Err error
+}
+
+func (e StoreError) Error() string {
+	return e.Err.Error()
+}
+
+func (e StoreError) Unwrap() error {
+	return e.Err
+}
+
+func (e StoreError) Stage() PipelineStage {
+	return StoreStage
+}
+
+// Riak failures are usually timeouts or nodes going away, which pass.  A feed removed while it was
+// being polled won't come back though.
+func (e StoreError) Retryable() bool {
+	return !errors.Is(e.Err, FeedNotFound)
+}
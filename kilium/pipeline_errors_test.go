@@ -0,0 +1,92 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestFetchErrorRetryable(t *testing.T) {
+	cases := []struct {
+		err       FetchError
+		retryable bool
+	}{
+		{FetchError{StatusCode: 404}, false},
+		{FetchError{StatusCode: 410}, false},
+		{FetchError{StatusCode: 403}, false},
+		{FetchError{StatusCode: 429}, true},
+		{FetchError{StatusCode: 500}, true},
+		{FetchError{StatusCode: 503}, true},
+		{FetchError{Err: errors.New("connection reset by peer")}, true},
+		{FetchError{Err: &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}}, false},
+		{FetchError{Err: &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}}, true},
+	}
+	for _, c := range cases {
+		if c.err.Retryable() != c.retryable {
+			t.Errorf("%v should have retryable %v", c.err, c.retryable)
+		}
+		if c.err.Stage() != FetchStage {
+			t.Errorf("%v has stage %v", c.err, c.err.Stage())
+		}
+	}
+}
+
+func TestParseErrorLine(t *testing.T) {
+	var v struct{}
+	err := newParseError(xml.Unmarshal([]byte("<rss>\n<channel>\n</rss>"), &v))
+	if err.Line != 3 {
+		t.Errorf("Expected the error on line 3, got %v (%s)", err.Line, err)
+	}
+	if !strings.HasPrefix(err.Error(), "line 3: ") {
+		t.Error("Line missing from message:", err)
+	}
+
+	err = newParseError(errors.New("No channel found inside the feed!"))
+	if err.Line != 0 || err.Error() != "No channel found inside the feed!" {
+		t.Errorf("Unexpected error for a feed without a channel: %v, %s", err.Line, err)
+	}
+	if err.Retryable() || err.Stage() != ParseStage {
+		t.Error("Parse errors should be from the parse stage, and not retryable")
+	}
+}
+
+func TestFeedErrorClassification(t *testing.T) {
+	wrapped := FeedError{StoreError{fmt.Errorf("Saving feed: %w", FeedNotFound)}, *testFeedUrl}
+	if wrapped.Stage() != StoreStage || !errors.Is(wrapped, FeedNotFound) {
+		t.Error("Bad classification of a wrapped store error:", wrapped.Stage())
+	}
+	if wrapped.Retryable() {
+		t.Error("Removed feeds shouldn't be retried")
+	}
+	if !(FeedError{StoreError{errors.New("timeout")}, *testFeedUrl}).Retryable() {
+		t.Error("Riak failures should be retried")
+	}
+
+	var err error = MultiError{FeedError{errors.New("Unknown"), *testFeedUrl}}
+	pipelineErr := AsPipelineError(err)
+	if pipelineErr == nil || pipelineErr.Stage() != UnknownStage || !pipelineErr.Retryable() {
+		t.Error("Errors from outside the stages should be retryable, with an unknown stage")
+	}
+	if AsPipelineError(errors.New("Plain")) != nil {
+		t.Error("Found a pipeline error where there isn't one")
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"errors"
+	"io"
+
+	"net/url"
+
+	"time"
+
+	"github.com/gorilla/feeds"
+	riak "github.com/tpjg/goriakpbc"
+)
+
+type RepublishFormat int
+
+const (
+	RSS RepublishFormat = iota
+	Atom
+	JSONFeed
+)
+
+// How many items a filtered feed looks through before giving up on filling itself.
+const MaximumRepublishScan = 1000
+
+var UnknownRepublishFormat = errors.New("Unknown feed format!")
+
+func ParseRepublishFormat(name string) (RepublishFormat, error) {
+	switch name {
+	case "", "rss":
+		return RSS, nil
+	case "atom":
+		return Atom, nil
+	case "json":
+		return JSONFeed, nil
+	}
+	return RSS, UnknownRepublishFormat
+}
+
+func (format RepublishFormat) ContentType() string {
+	switch format {
+	case Atom:
+		return "application/atom+xml"
+	case JSONFeed:
+		return "application/feed+json"
+	}
+	return "application/rss+xml"
+}
+
+// Picks which items go into a republished feed.
+type RepublishFilter struct {
+	// Items need every word of every keyword in their title, author or content.  Words are found the
+	// same way search finds them, so markup never matches and case is ignored.
+	Keywords []string
+}
+
+func (filter RepublishFilter) Matches(item *FeedItem) bool {
+	words := make(map[string]bool)
+	for _, text := range []string{item.Title, item.Author, item.Content} {
+		for _, word := range searchWords(text) {
+			words[word] = true
+		}
+	}
+	for _, keyword := range filter.Keywords {
+		for _, word := range searchWords(keyword) {
+			if !words[word] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Walks the river made from feeds, newest first, keeping up to limit items that match filter.  At
+// most MaximumRepublishScan items are looked at, so a filter that rarely matches gives a short feed.
+func LoadRepublishedItems(con *riak.Client, sources []*Feed, filter RepublishFilter, limit int) (RiverKeyList, []*FeedItem, error) {
+	var keys RiverKeyList
+	var items []*FeedItem
+
+	var cursor ItemKey
+	for scanned := 0; len(items) < limit && scanned < MaximumRepublishScan; {
+		page, err := LoadRiverPage(con, sources, cursor, Older, limit)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for i, item := range page.Items {
+			if filter.Matches(item) && len(items) < limit {
+				keys = append(keys, page.Keys[i])
+				items = append(items, item)
+			}
+		}
+
+		scanned += limit
+		if cursor = page.Older; cursor == nil {
+			break
+		}
+	}
+
+	return keys, items, nil
+}
+
+// Builds a feed out of items taken from sources, which keys index like a RiverPage's.
+func BuildRepublishedFeed(title string, link url.URL, sources []*Feed, keys RiverKeyList, items []*FeedItem) *feeds.Feed {
+	feed := &feeds.Feed{
+		Title: title,
+		Link:  &feeds.Link{Href: link.String()},
+		Id:    link.String(),
+	}
+
+	for i, item := range items {
+		source := sources[keys[i].Feed]
+		feed.Items = append(feed.Items, &feeds.Item{
+			Id:          keys[i].ItemKey.GetRiakKey(),
+			Title:       item.Title,
+			Link:        &feeds.Link{Href: item.Url.String()},
+			Source:      &feeds.Link{Href: source.Url.String()},
+			Author:      &feeds.Author{Name: item.Author},
+			Description: item.Content,
+			Created:     item.PubDate,
+			Updated:     item.PubDate,
+		})
+		if item.PubDate.After(feed.Updated) {
+			feed.Updated = item.PubDate
+		}
+	}
+	if feed.Updated.IsZero() {
+		feed.Updated = time.Now()
+	}
+
+	return feed
+}
+
+func WriteRepublishedFeed(w io.Writer, feed *feeds.Feed, format RepublishFormat) error {
+	switch format {
+	case Atom:
+		return feed.WriteAtom(w)
+	case JSONFeed:
+		return feed.WriteJSON(w)
+	}
+	return feed.WriteRss(w)
+}
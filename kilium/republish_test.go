@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"testing"
+)
+
+func TestRepublishFilter(t *testing.T) {
+	item := &FeedItem{Title: "Go 1.2 released", Author: "Gopher", Content: "<p>Faster builds</p>"}
+
+	for keywords, matches := range map[string]bool{
+		"":                 true,
+		"go":               true,
+		"GOPHER builds":    true,
+		"released rust":    false,
+		"faster slower go": false,
+		"Go!":              true,
+		"p":                false, // Only in the markup.
+		"fast":             false, // Whole words only, as in search.
+	} {
+		filter := RepublishFilter{Keywords: strings.Fields(keywords)}
+		if filter.Matches(item) != matches {
+			t.Errorf("Filter %q should match: %v", keywords, matches)
+		}
+	}
+}
+
+func TestParseRepublishFormat(t *testing.T) {
+	for name, format := range map[string]RepublishFormat{"": RSS, "rss": RSS, "atom": Atom, "json": JSONFeed} {
+		if parsed, err := ParseRepublishFormat(name); err != nil || parsed != format {
+			t.Errorf("Parsed %q wrong (%v, %v)", name, parsed, err)
+		}
+	}
+	if _, err := ParseRepublishFormat("xml"); err != UnknownRepublishFormat {
+		t.Errorf("Unknown format wasn't rejected (%v)", err)
+	}
+}
+
+func TestBuildRepublishedFeed(t *testing.T) {
+	sourceUrl, _ := url.Parse("http://example.com/source.rss")
+	itemUrl, _ := url.Parse("http://example.com/item")
+	link, _ := url.Parse("http://kilium.example.com/republish")
+	published := time.Date(2013, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	sources := []*Feed{&Feed{}, &Feed{Url: *sourceUrl}}
+	keys := RiverKeyList{{ItemKey: genItemKey(5, "A"), Feed: 1}}
+	items := []*FeedItem{&FeedItem{Title: "Title", Author: "Author", Content: "Content", Url: *itemUrl, PubDate: published}}
+
+	feed := BuildRepublishedFeed("Combined", *link, sources, keys, items)
+	if feed.Title != "Combined" || feed.Link.Href != link.String() || !feed.Updated.Equal(published) || len(feed.Items) != 1 {
+		t.Fatalf("Wrong feed (%+v)", feed)
+	}
+	item := feed.Items[0]
+	if item.Id != keys[0].ItemKey.GetRiakKey() || item.Title != "Title" || item.Author.Name != "Author" ||
+		item.Description != "Content" || item.Link.Href != itemUrl.String() || item.Source.Href != sourceUrl.String() {
+		t.Errorf("Wrong item (%+v)", item)
+	}
+}
+
+func TestLoadRepublishedItems(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	feeds := []*Feed{&Feed{}, &Feed{}}
+	for id := 6; id > 0; id-- {
+		key := NewItemKey(uint64(id), makeHash("Republish "+strconv.Itoa(id)+key_uniquer))
+		feed := feeds[id%2]
+		feed.ItemKeys = append(feed.ItemKeys, key)
+		title := "Odd"
+		if id%2 == 0 {
+			title = "Even"
+		}
+		if err := InsertItem(con, "", key, ParsedFeedItem{Title: title + " " + strconv.Itoa(id)}); err != nil {
+			t.Fatalf("Failed to insert item (%s)", err)
+		}
+	}
+
+	keys, items, err := LoadRepublishedItems(con, feeds, RepublishFilter{Keywords: []string{"odd"}}, 2)
+	if err != nil {
+		t.Fatalf("Failed to load items (%s)", err)
+	}
+	if len(items) != 2 || items[0].Title != "Odd 5" || items[1].Title != "Odd 3" || keys[0].Feed != 1 {
+		t.Errorf("Wrong republished items (%+v, %+v)", keys, items)
+	}
+}
@@ -0,0 +1,233 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"sort"
+	"time"
+
+	riak "github.com/tpjg/goriakpbc"
+)
+
+// How often the scheduler sweeps each feed it polls for items its retention policy no longer keeps.
+const RetentionSweepInterval = time.Hour
+
+// How long a feed's items are kept.  Zero values mean no limit.
+type RetentionPolicy struct {
+	MaxItems int `riak:"max_items"`
+	// Ages go by publication date, or by when the item was inserted if it has none.
+	MaxAge time.Duration `riak:"max_age"`
+
+	// Starred items are never removed, and don't count towards MaxItems.
+	KeepStarred bool `riak:"keep_starred"`
+}
+
+// The policy for feeds without their own.  This is only meant to be changed at start up.
+var GlobalRetentionPolicy = RetentionPolicy{MaxItems: MaximumFeedItems}
+
+// The feed's own policy, or the global one if it has none.
+func (f *Feed) RetentionPolicy() RetentionPolicy {
+	if f.Retention != nil {
+		return *f.Retention
+	}
+	return GlobalRetentionPolicy
+}
+
+// Items from before the returned time are too old.  It is the zero time without a MaxAge.
+func (p RetentionPolicy) cutoff(now time.Time) time.Time {
+	if p.MaxAge <= 0 {
+		return time.Time{}
+	}
+	return now.Add(-p.MaxAge)
+}
+
+func (p RetentionPolicy) expired(inserted, published, cutoff time.Time) bool {
+	if cutoff.IsZero() {
+		return false
+	}
+	if !published.IsZero() {
+		return published.Before(cutoff)
+	}
+	return inserted.Before(cutoff)
+}
+
+// Whether key is kept no matter what.  starred must be sorted like Feed.ItemKeys.
+func (p RetentionPolicy) keeps(key ItemKey, starred ItemKeyList) bool {
+	return p.KeepStarred && starred.Contains(key)
+}
+
+// Picks the keys the policy removes from keys, which is sorted like Feed.ItemKeys.  published gives the
+// publication dates of the items, and is only needed with a MaxAge.
+func (p RetentionPolicy) sweep(keys, starred ItemKeyList, published func(ItemKey) time.Time, now time.Time) ItemKeyList {
+	cutoff := p.cutoff(now)
+
+	var removed ItemKeyList
+	kept := 0
+	for _, key := range keys {
+		if p.keeps(key, starred) {
+			continue
+		}
+
+		var pubDate time.Time
+		if published != nil {
+			pubDate = published(key)
+		}
+		if p.expired(IdTimestamp(key.Id()), pubDate, cutoff) || (p.MaxItems > 0 && kept >= p.MaxItems) {
+			removed = append(removed, key)
+		} else {
+			kept++
+		}
+	}
+	return removed
+}
+
+// Every item in the feed starred by some user, sorted like Feed.ItemKeys.
+func StarredItemKeys(con *riak.Client, feedKey string) (ItemKeyList, error) {
+	bucket, err := con.Bucket("user_feed_states")
+	if err != nil {
+		return nil, err
+	}
+	stateKeys, err := bucket.IndexQuery(UserFeedStateFeedIndexName, feedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	starred := ItemKeyList{}
+	for _, stateKey := range stateKeys {
+		state := &UserFeedState{}
+		if err := con.LoadModel(stateKey, state); err == riak.NotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var keys ItemKeyList
+		for _, mark := range state.Starred {
+			if mark.Starred {
+				keys = append(keys, mark.Key)
+			}
+		}
+		starred = *InsertSliceSort(&starred, &keys).(*ItemKeyList)
+	}
+	return starred, nil
+}
+
+// Gives the feed its own retention policy, or with nil puts it back on the global one.
+func SetFeedRetention(con *riak.Client, feedKey string, policy *RetentionPolicy) error {
+	feed, err := LoadFeed(con, feedKey)
+	if err != nil {
+		return err
+	}
+	feed.Retention = policy
+	feed.RetentionUpdated = time.Now()
+	return feed.Save()
+}
+
+// Removes the feed's items that its retention policy no longer keeps, returning how many went.
+// updateFeed only enforces the policy as items come in, and never checks the age of stored items, so
+// this catches the rest.
+//
+// The feed is claimed for holder first, so the sweep can't race an update on another node, and released
+// again afterwards, even if the sweep failed.  Fails with FeedLeased while another node holds the feed.
+func SweepFeedRetention(con *riak.Client, feedKey, holder string, now time.Time) (int, error) {
+	feed, err := ClaimFeed(con, feedKey, holder, now, DefaultFeedLeaseDuration)
+	if err != nil {
+		return 0, err
+	}
+	removed, err := sweepFeedRetention(con, feed, now)
+	if releaseErr := releaseFeed(con, feedKey, holder, now); err == nil {
+		err = releaseErr
+	}
+	return removed, err
+}
+
+// Sweeps a feed the caller holds the lease on, and isn't updating meanwhile.
+func sweepFeedRetention(con *riak.Client, feed *Feed, now time.Time) (int, error) {
+	feedKey := feed.UrlKey()
+	policy := feed.RetentionPolicy()
+
+	var starred ItemKeyList
+	if policy.KeepStarred {
+		var err error
+		if starred, err = StarredItemKeys(con, feedKey); err != nil {
+			return 0, err
+		}
+	}
+
+	var published func(ItemKey) time.Time
+	if policy.MaxAge > 0 {
+		items, err := LoadFeedItems(con, feed.ItemKeys)
+		if err != nil {
+			return 0, err
+		}
+		pubDates := make(map[string]time.Time, len(items))
+		for i, item := range items {
+			if item != nil {
+				pubDates[string(feed.ItemKeys[i])] = item.PubDate
+			}
+		}
+		published = func(key ItemKey) time.Time { return pubDates[string(key)] }
+	}
+
+	removed := policy.sweep(feed.ItemKeys, starred, published, now)
+	if len(removed) == 0 {
+		return 0, nil
+	}
+
+	// Like updateFeed, record the deletes before doing them so they get finished if this fails.  Feeds
+	// saved by older updates may have their deletes out of order, which the merge can't handle.
+	sort.Sort(sort.Reverse(feed.DeletedItemKeys))
+	feed.DeletedItemKeys = *InsertSliceSort(&feed.DeletedItemKeys, &removed).(*ItemKeyList)
+	RemoveSliceElements(&feed.ItemKeys, &removed)
+	if err := feed.Save(); err != nil {
+		return 0, err
+	}
+
+	if err := deleteItems(con, feed.DeletedItemKeys, newSearchIndexBatch()); err != nil {
+		return 0, err
+	}
+
+	feed.DeletedItemKeys = nil
+	if err := feed.Save(); err != nil {
+		return 0, err
+	}
+	return len(removed), nil
+}
+
+// Sweeps every feed that no other node holds, logging what it did to logger.  See SweepFeedRetention.
+func SweepRetention(con *riak.Client, holder string, now time.Time, logger Logger) error {
+	keys, err := ListFeedKeys(con)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, key := range keys {
+		if removed, err := SweepFeedRetention(con, key, holder, now); err == FeedLeased {
+			logger.Log(LogInfo, "Skipped leased feed", LogField{"key", key})
+		} else if err != nil && err != FeedNotFound {
+			errs = append(errs, err)
+		} else if removed != 0 {
+			logger.Log(LogInfo, "Retention removed items", LogField{"key", key}, ItemCountField(removed))
+		}
+	}
+
+	if len(errs) != 0 {
+		return MultiError(errs)
+	}
+	return nil
+}
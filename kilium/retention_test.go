@@ -0,0 +1,190 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"reflect"
+	"strconv"
+	"time"
+
+	"testing"
+)
+
+func TestRetentionSweep(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	keyAt := func(at time.Time, name string) ItemKey {
+		return NewItemKey(uint64(at.Unix())<<IdTimestampShift, []byte(name))
+	}
+	keys := ItemKeyList{
+		keyAt(now.Add(-1*time.Hour), "A"),
+		keyAt(now.Add(-2*time.Hour), "B"), // Published too long ago.
+		keyAt(now.Add(-3*time.Hour), "C"),
+		keyAt(now.Add(-4*time.Hour), "D"),
+		keyAt(now.Add(-48*time.Hour), "E"), // No publication date, and inserted too long ago.
+	}
+	published := func(key ItemKey) time.Time {
+		if key.Equal(keys[1]) {
+			return now.Add(-72 * time.Hour)
+		} else if key.Equal(keys[4]) {
+			return time.Time{}
+		}
+		return IdTimestamp(key.Id())
+	}
+
+	check := func(policy RetentionPolicy, starred ItemKeyList, expected ItemKeyList) {
+		if removed := policy.sweep(keys, starred, published, now); !reflect.DeepEqual(removed, expected) {
+			t.Errorf("Wrong keys removed for %+v (expected, got) (%v, %v)", policy, expected, removed)
+		}
+	}
+
+	check(RetentionPolicy{}, nil, nil)
+	check(RetentionPolicy{MaxItems: 2}, nil, keys[2:])
+	check(RetentionPolicy{MaxAge: 24 * time.Hour}, nil, ItemKeyList{keys[1], keys[4]})
+	check(RetentionPolicy{MaxItems: 2, MaxAge: 24 * time.Hour}, nil, ItemKeyList{keys[1], keys[3], keys[4]})
+
+	// Starred items stay, and don't take up room.
+	starred := ItemKeyList{keys[0], keys[4]}
+	check(RetentionPolicy{MaxItems: 2, MaxAge: 24 * time.Hour, KeepStarred: true}, starred, ItemKeyList{keys[1]})
+	check(RetentionPolicy{MaxItems: 1, KeepStarred: true}, starred, ItemKeyList{keys[2], keys[3]})
+}
+
+func TestFeedRetentionPolicy(t *testing.T) {
+	feed := &Feed{}
+	if policy := feed.RetentionPolicy(); policy != GlobalRetentionPolicy {
+		t.Errorf("Feed without a policy should use the global one (%+v)", policy)
+	}
+	feed.Retention = &RetentionPolicy{MaxItems: 5}
+	if policy := feed.RetentionPolicy(); policy.MaxItems != 5 {
+		t.Errorf("Feed's own policy wasn't used (%+v)", policy)
+	}
+}
+
+func makeRetentionFeed(name string, count int, fetchedAt time.Time) *ParsedFeedData {
+	feed := &ParsedFeedData{Title: "Retention", FetchedAt: fetchedAt}
+	for i := 0; i < count; i++ {
+		feed.Items = append(feed.Items, ParsedFeedItem{
+			GenericKey: makeHash(key_uniquer + name + strconv.Itoa(i)),
+			Title:      strconv.Itoa(i),
+			PubDate:    fetchedAt.Add(-time.Duration(i) * time.Hour),
+		})
+	}
+	return feed
+}
+
+func TestUpdateFeedFollowsRetention(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	url := getUniqueExampleComUrl(t)
+	feedModel := CreateFeed(t, con, url)
+	if err := SetFeedRetention(con, feedModel.UrlKey(), &RetentionPolicy{MaxItems: 3, MaxAge: 4*time.Hour + time.Minute}); err != nil {
+		t.Fatalf("Failed to set retention policy (%s)", err)
+	}
+
+	// Only the newest three fit, and items over four hours old would be too old anyway.
+	now := time.Now()
+	result, err := updateFeed(con, *url, *makeRetentionFeed("first", 6, now), testIdGenerator)
+	if err != nil {
+		t.Fatalf("Failed to update feed (%s)", err)
+	}
+	if result.Inserted != 3 || len(result.Model.ItemKeys) != 3 {
+		t.Errorf("Expected three items to be kept (%+v)", result)
+	}
+
+	// Newer items push the oldest out.
+	later := now.Add(2 * time.Hour)
+	result, err = updateFeed(con, *url, *makeRetentionFeed("second", 8, later), testIdGenerator)
+	if err != nil {
+		t.Fatalf("Failed to update feed (%s)", err)
+	}
+	if result.Evicted != 3 || len(result.Model.ItemKeys) != 3 {
+		t.Errorf("Expected the old items to be evicted (%+v)", result)
+	}
+
+	// The sweep removes anything that grew too old since.
+	if removed, err := SweepFeedRetention(con, feedModel.UrlKey(), "a", later.Add(4*time.Hour)); err != nil {
+		t.Fatalf("Failed to sweep feed (%s)", err)
+	} else if removed != 2 {
+		t.Errorf("Expected the sweep to remove two items, removed %d", removed)
+	}
+	if feed, err := LoadFeed(con, feedModel.UrlKey()); err != nil {
+		t.Fatalf("Failed to load feed (%s)", err)
+	} else if len(feed.ItemKeys) != 1 || len(feed.DeletedItemKeys) != 0 {
+		t.Errorf("Sweep left the wrong keys (%v, %v)", feed.ItemKeys, feed.DeletedItemKeys)
+	}
+
+	// The sweep gave its lease back, but another node's running lease keeps the sweep away.
+	swept := later.Add(4 * time.Hour)
+	if _, err := SweepFeedRetention(con, feedModel.UrlKey(), "b", swept); err != nil {
+		t.Errorf("Sweep didn't release its lease (%s)", err)
+	}
+	if _, err := ClaimFeed(con, feedModel.UrlKey(), "c", swept, time.Minute); err != nil {
+		t.Fatalf("Failed to claim feed (%s)", err)
+	}
+	if _, err := SweepFeedRetention(con, feedModel.UrlKey(), "b", swept); err != FeedLeased {
+		t.Errorf("Sweeping a leased feed didn't fail properly (%v)", err)
+	}
+}
+
+func TestUpdateFeedKeepsStarredItems(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	url := getUniqueExampleComUrl(t)
+	if _, err := CreateUser(con, "reader", "password"); err != nil {
+		t.Fatalf("Failed to create user (%s)", err)
+	}
+	if err := Subscribe(con, "reader", *url, "", ""); err != nil {
+		t.Fatalf("Failed to subscribe (%s)", err)
+	}
+	feedKey := (&Feed{Url: *url}).UrlKey()
+	if err := SetFeedRetention(con, feedKey, &RetentionPolicy{MaxItems: 1, KeepStarred: true}); err != nil {
+		t.Fatalf("Failed to set retention policy (%s)", err)
+	}
+
+	now := time.Now()
+	result, err := updateFeed(con, *url, *makeRetentionFeed("first", 1, now), testIdGenerator)
+	if err != nil {
+		t.Fatalf("Failed to update feed (%s)", err)
+	}
+	starredKey := result.Model.ItemKeys[0]
+	if err := MarkItemsStarred(con, "reader", feedKey, ItemKeyList{starredKey}, true); err != nil {
+		t.Fatalf("Failed to star item (%s)", err)
+	}
+
+	// A newer item takes the only free spot, without pushing out the starred one.
+	result, err = updateFeed(con, *url, *makeRetentionFeed("second", 1, now.Add(time.Hour)), testIdGenerator)
+	if err != nil {
+		t.Fatalf("Failed to update feed (%s)", err)
+	}
+	if len(result.Model.ItemKeys) != 2 || !result.Model.ItemKeys.Contains(starredKey) {
+		t.Errorf("Starred item wasn't kept (%v)", result.Model.ItemKeys)
+	}
+
+	// With every stored item starred, new items still only get MaxItems spots between them.
+	otherStarredKey := result.Model.ItemKeys[0]
+	if err := MarkItemsStarred(con, "reader", feedKey, ItemKeyList{otherStarredKey}, true); err != nil {
+		t.Fatalf("Failed to star item (%s)", err)
+	}
+	result, err = updateFeed(con, *url, *makeRetentionFeed("third", 2, now.Add(2*time.Hour)), testIdGenerator)
+	if err != nil {
+		t.Fatalf("Failed to update feed (%s)", err)
+	}
+	if result.Inserted != 1 || len(result.Model.ItemKeys) != 3 || !result.Model.ItemKeys.Contains(otherStarredKey) {
+		t.Errorf("Expected one new item beside the starred ones (%+v)", result)
+	}
+}
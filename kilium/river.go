@@ -0,0 +1,190 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	riak "github.com/tpjg/goriakpbc"
+)
+
+// A key in a river, along with which of the river's feeds it came from.
+type RiverKey struct {
+	ItemKey ItemKey
+	Feed    int
+}
+
+func (l RiverKey) Less(r Comparable) bool {
+	return l.ItemKey.Less(r.(RiverKey).ItemKey)
+}
+
+type RiverKeyList []RiverKey
+
+func (list *RiverKeyList) Append(key Comparable) {
+	*list = append(*list, key.(RiverKey))
+}
+
+func (list RiverKeyList) Get(index int) Comparable {
+	return list[index]
+}
+
+func (list *RiverKeyList) RemoveAt(index int) {
+	*list = append((*list)[:index], (*list)[index+1:]...)
+}
+
+func (list RiverKeyList) Len() int {
+	return len(list)
+}
+
+func (RiverKeyList) Make() ComparableArray {
+	return &RiverKeyList{}
+}
+
+// A page of items merged from several feeds, newest first.  Items matches Keys, except missing items
+// are left out of both.
+type RiverPage struct {
+	Keys  RiverKeyList
+	Items []*FeedItem
+
+	// The feeds the river was made from, which RiverKey.Feed indexes.
+	Feeds []*Feed
+
+	// Cursors for the neighbouring pages, nil when there is nothing more in that direction.
+	Older ItemKey
+	Newer ItemKey
+}
+
+// Merges the feeds' keys older or newer than cursor into a single list, newest first, and keeps up to
+// limit of them.  Since ids come from one generator, keys from different feeds order correctly
+// against each other.  Only a page's worth of each feed is ever merged.
+func MergeRiverKeys(feeds []*Feed, cursor ItemKey, direction PageDirection, limit int) RiverKeyList {
+	merged := &RiverKeyList{}
+	for i, feed := range feeds {
+		page := feed.ItemKeys.Page(cursor, direction, limit)
+
+		next := make(RiverKeyList, len(page))
+		for j, key := range page {
+			next[j] = RiverKey{key, i}
+		}
+		merged = InsertSliceSort(merged, &next).(*RiverKeyList)
+	}
+
+	if len(*merged) <= limit {
+		return *merged
+	} else if direction == Older {
+		return (*merged)[:limit]
+	}
+	return (*merged)[len(*merged)-limit:]
+}
+
+// Walks the river from cursor in direction, keeping up to limit keys that keep accepts.  The keys are
+// returned in the order walked, so oldest first when going Newer.  The returned cursor continues the
+// walk, and is nil once there is nothing left.
+func FilterRiverKeys(feeds []*Feed, cursor ItemKey, direction PageDirection, limit int, keep func(RiverKey) bool) (RiverKeyList, ItemKey) {
+	kept := RiverKeyList{}
+	for {
+		batch := MergeRiverKeys(feeds, cursor, direction, limit)
+		for i := range batch {
+			key := batch[i]
+			if direction == Newer {
+				key = batch[len(batch)-1-i]
+			}
+			cursor = key.ItemKey
+
+			if keep(key) {
+				kept = append(kept, key)
+				if len(kept) == limit {
+					if riverHasMore(feeds, cursor, direction) {
+						return kept, cursor
+					}
+					return kept, nil
+				}
+			}
+		}
+		if len(batch) < limit {
+			return kept, nil
+		}
+	}
+}
+
+func riverHasMore(feeds []*Feed, cursor ItemKey, direction PageDirection) bool {
+	for _, feed := range feeds {
+		if len(feed.ItemKeys.Page(cursor, direction, 1)) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Loads every feed in keys in parallel.  Missing feeds give FeedNotFound.
+func LoadFeeds(con *riak.Client, keys []string) ([]*Feed, error) {
+	feeds := make([]*Feed, len(keys))
+	errCh := make(chan error)
+
+	for i, key := range keys {
+		go func(i int, key string) {
+			var err error
+			feeds[i], err = LoadFeed(con, key)
+			errCh <- err
+		}(i, key)
+	}
+
+	var errs []error
+	drainErrorChannelIntoSlice(errCh, &errs, len(keys))
+	if len(errs) != 0 {
+		return nil, MultiError(errs)
+	}
+	return feeds, nil
+}
+
+// Loads a page of the river made from feeds.  Cursors work just like for LoadItemPage, and may be
+// any key from any of the feeds.
+func LoadRiverPage(con *riak.Client, feeds []*Feed, cursor ItemKey, direction PageDirection, limit int) (*RiverPage, error) {
+	keys := MergeRiverKeys(feeds, cursor, direction, limit)
+
+	itemKeys := make(ItemKeyList, len(keys))
+	for i, key := range keys {
+		itemKeys[i] = key.ItemKey
+	}
+	items, err := LoadFeedItems(con, itemKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &RiverPage{Feeds: feeds}
+	for i, item := range items {
+		if item != nil {
+			page.Keys = append(page.Keys, keys[i])
+			page.Items = append(page.Items, item)
+		}
+	}
+
+	if len(keys) != 0 {
+		if first := keys[0].ItemKey; riverHasMore(feeds, first, Newer) {
+			page.Newer = first
+		}
+		if last := keys[len(keys)-1].ItemKey; riverHasMore(feeds, last, Older) {
+			page.Older = last
+		}
+	} else if cursor != nil {
+		if direction == Older && riverHasMore(feeds, cursor, Newer) {
+			page.Newer = cursor
+		} else if direction == Newer && riverHasMore(feeds, cursor, Older) {
+			page.Older = cursor
+		}
+	}
+
+	return page, nil
+}
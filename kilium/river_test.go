@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"strconv"
+
+	"testing"
+)
+
+func TestMergeRiverKeys(t *testing.T) {
+	feeds := []*Feed{
+		&Feed{ItemKeys: ItemKeyList{genItemKey(9, "A"), genItemKey(6, "A"), genItemKey(2, "A")}},
+		&Feed{ItemKeys: ItemKeyList{genItemKey(8, "B"), genItemKey(7, "B"), genItemKey(1, "B")}},
+		&Feed{},
+	}
+
+	checkRiver := func(name string, river RiverKeyList, want ...string) {
+		if len(river) != len(want) {
+			t.Errorf("%s: expected %v keys, got %v", name, len(want), len(river))
+			return
+		}
+		for i, key := range want {
+			id, _ := strconv.Atoi(key[1:])
+			feed := int(key[0] - 'A')
+			if !river[i].ItemKey.Equal(genItemKey(int64(id), key[:1])) || river[i].Feed != feed {
+				t.Errorf("%s: expected %s at %v, got %v from feed %v", name, key, i, river[i].ItemKey, river[i].Feed)
+			}
+		}
+	}
+
+	checkRiver("Everything", MergeRiverKeys(feeds, nil, Older, 10), "A9", "B8", "B7", "A6", "A2", "B1")
+	checkRiver("Newest", MergeRiverKeys(feeds, nil, Older, 3), "A9", "B8", "B7")
+	checkRiver("Oldest", MergeRiverKeys(feeds, nil, Newer, 3), "A6", "A2", "B1")
+	checkRiver("Older than B7", MergeRiverKeys(feeds, genItemKey(7, "B"), Older, 2), "A6", "A2")
+	checkRiver("Newer than A6", MergeRiverKeys(feeds, genItemKey(6, "A"), Newer, 2), "B8", "B7")
+	checkRiver("Nothing", MergeRiverKeys(feeds[2:], nil, Older, 2))
+}
+
+func TestFilterRiverKeys(t *testing.T) {
+	feeds := []*Feed{
+		&Feed{ItemKeys: ItemKeyList{genItemKey(9, "A"), genItemKey(6, "A"), genItemKey(2, "A")}},
+		&Feed{ItemKeys: ItemKeyList{genItemKey(8, "B"), genItemKey(7, "B"), genItemKey(1, "B")}},
+	}
+	onlyB := func(key RiverKey) bool { return key.Feed == 1 }
+
+	keys, next := FilterRiverKeys(feeds, nil, Older, 2, onlyB)
+	if len(keys) != 2 || keys[0].ItemKey.Id() != 8 || keys[1].ItemKey.Id() != 7 || next.Id() != 7 {
+		t.Errorf("Wrong first filtered page (%v, %v)", keys, next)
+	}
+	keys, next = FilterRiverKeys(feeds, next, Older, 2, onlyB)
+	if len(keys) != 1 || keys[0].ItemKey.Id() != 1 || next != nil {
+		t.Errorf("Wrong last filtered page (%v, %v)", keys, next)
+	}
+
+	keys, next = FilterRiverKeys(feeds, nil, Newer, 2, onlyB)
+	if len(keys) != 2 || keys[0].ItemKey.Id() != 1 || keys[1].ItemKey.Id() != 7 || next.Id() != 7 {
+		t.Errorf("Wrong oldest first filtered page (%v, %v)", keys, next)
+	}
+
+	if keys, next = FilterRiverKeys(feeds, nil, Older, 2, func(RiverKey) bool { return false }); len(keys) != 0 || next != nil {
+		t.Errorf("Filtering everything out still gave keys (%v, %v)", keys, next)
+	}
+}
+
+func TestLoadRiverPage(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	feeds := []*Feed{&Feed{}, &Feed{}}
+	for id := 6; id > 0; id-- {
+		key := NewItemKey(uint64(id), makeHash("River "+strconv.Itoa(id)+key_uniquer))
+		feed := feeds[id%2]
+		feed.ItemKeys = append(feed.ItemKeys, key)
+		if err := InsertItem(con, "", key, ParsedFeedItem{Title: strconv.Itoa(id)}); err != nil {
+			t.Fatalf("Failed to insert item (%s)", err)
+		}
+	}
+
+	page, err := LoadRiverPage(con, feeds, nil, Older, 4)
+	if err != nil {
+		t.Fatalf("Failed to load river (%s)", err)
+	}
+	if len(page.Items) != 4 || page.Items[0].Title != "6" || page.Items[3].Title != "3" || page.Newer != nil || page.Older == nil {
+		t.Errorf("Wrong first river page (%+v)", page)
+	} else if page.Keys[0].Feed != 0 || page.Keys[1].Feed != 1 {
+		t.Errorf("River keys point at the wrong feeds (%+v)", page.Keys)
+	}
+
+	page, err = LoadRiverPage(con, feeds, page.Older, Older, 4)
+	if err != nil {
+		t.Fatalf("Failed to load river (%s)", err)
+	}
+	if len(page.Items) != 2 || page.Items[0].Title != "2" || page.Newer == nil || page.Older != nil {
+		t.Errorf("Wrong last river page (%+v)", page)
+	}
+}
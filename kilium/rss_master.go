@@ -17,7 +17,8 @@
 package kilium
 
 import (
-	"log"
+	"fmt"
+	"os"
 
 	"net/url"
 	"strconv"
@@ -31,10 +32,65 @@ type AddFeedRequest struct {
 	ResponseCh chan<- error
 }
 
+type RemoveFeedRequest struct {
+	Url        url.URL
+	ResponseCh chan<- error
+}
+
+type RssMasterConfig struct {
+	// Names this node in feed leases.  Every node polling the same riak must have its own.
+	Node string
+	// How long this node has to poll a feed it claimed.  See ClaimFeed.
+	LeaseDuration time.Duration
+
+	// Up to how long after they are due feeds are polled, to spread out feeds due at the same time.
+	Jitter time.Duration
+	// How many feeds may be in the pipeline at once.
+	MaxOutstanding int
+
+	// Where the master and everything it starts logs to.  DefaultLogger when nil.
+	Logger Logger
+}
+
+// Names the node after the host and process, which is unique enough for most setups.
+func DefaultRssMasterConfig() RssMasterConfig {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return RssMasterConfig{
+		Node:          fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+		LeaseDuration: DefaultFeedLeaseDuration,
+
+		Jitter:         DefaultSchedulerJitter,
+		MaxOutstanding: DefaultMaxOutstandingFeeds,
+	}
+}
+
 type RssMaster struct {
-	AddRequestCh chan<- AddFeedRequest
+	AddRequestCh    chan<- AddFeedRequest
+	RemoveRequestCh chan<- RemoveFeedRequest
 
 	pipeline RssParserPipeline
+	events   *ItemEventBus
+	logger   Logger
+}
+
+// Where the master logs to, for whatever is built around it to log to as well.
+func (master RssMaster) Logger() Logger {
+	return master.logger
+}
+
+// Subscribe to events for items as they are inserted, updated or deleted.  Events are only sent
+// once the feed owning the items has been saved.  Up to bufferSize events are held for the
+// subscriber, after which policy decides what happens.
+func (master RssMaster) Subscribe(bufferSize int, policy OverflowPolicy) *ItemSubscription {
+	return master.events.Subscribe(bufferSize, policy)
+}
+
+// Stops sending events to sub, and closes its Events channel.
+func (master RssMaster) Unsubscribe(sub *ItemSubscription) {
+	master.events.Unsubscribe(sub)
 }
 
 func RssMasterHandleAddRequest(con *riak.Client, Url url.URL) error {
@@ -52,23 +108,66 @@ func RssMasterHandleAddRequest(con *riak.Client, Url url.URL) error {
 	return nil
 }
 
-func RssMasterPollFeeds(con *riak.Client, InputCh chan<- url.URL, OutputCh <-chan FeedError) {
+// Removes the feed and all of its items.  Removing a feed that doesn't exist is not an error.
+func RssMasterHandleRemoveRequest(con *riak.Client, Url url.URL) error {
+	feedModel := &Feed{Url: Url}
+	if err := con.LoadModel(feedModel.UrlKey(), feedModel); err == riak.NotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Remove the items first, so nothing is orphaned if this fails part way.
+	var toDelete ItemKeyList
+	toDelete = append(toDelete, feedModel.ItemKeys...)
+	toDelete = append(toDelete, feedModel.InsertedItemKeys...)
+	toDelete = append(toDelete, feedModel.DeletedItemKeys...)
+	if err := deleteItems(con, toDelete, newSearchIndexBatch()); err != nil {
+		return err
+	}
+
+	return deleteObject(con, "feeds", feedModel.UrlKey())
+}
+
+// Polls every due feed that no other node has claimed, using the default config, and waits for them
+// to finish.  RssMaster schedules feeds as they come due instead, but this is handy for polling once.
+//
+// Every feed that failed is returned in a MultiError as a FeedError, so callers can tell which did.
+// Feeds that couldn't be claimed are in there too, as plain errors.
+func RssMasterPollFeeds(con *riak.Client, InputCh chan<- url.URL, OutputCh <-chan FeedUpdateResult) error {
+	return rssMasterPollFeeds(con, DefaultRssMasterConfig(), InputCh, OutputCh)
+}
+
+func rssMasterPollFeeds(con *riak.Client, config RssMasterConfig, InputCh chan<- url.URL, OutputCh <-chan FeedUpdateResult) error {
+	logger := config.Logger
+	if logger == nil {
+		logger = DefaultLogger
+	}
 	bucket, err := con.NewBucket("feeds")
 	if err != nil {
-		log.Println("Failed to get feed bucket:", err)
+		return err
 	}
 	// -62135596800 is Go's zero time according to Unix's time format.  This is what empty feeds have for their check time.
 	// Nothing should appear before that.
 	keys_to_poll, err := bucket.IndexQueryRange(NextCheckIndexName, "-62135596800", strconv.FormatInt(time.Now().Unix(), 10))
+	if err != nil {
+		return err
+	}
 	var errors []error
 
 	valid_keys := 0
 	for _, key := range keys_to_poll {
-		var loadFeed Feed
-		if err := con.LoadModel(key, &loadFeed); err != nil {
+		// Claiming the feed keeps other nodes from polling it as well.
+		now := time.Now()
+		if loadFeed, err := ClaimFeed(con, key, config.Node, now, config.LeaseDuration); err == FeedLeased || err == FeedNotFound {
+			continue
+		} else if err != nil {
 			errors = append(errors, err)
+		} else if loadFeed.NextCheck.After(now) {
+			// Another node polled it since the index was read.
+			continue
 		} else {
-			log.Println(loadFeed.Url)
+			logger.Log(LogDebug, "Polling feed", FeedField(loadFeed.Url))
 			valid_keys++
 			go func(Url url.URL, inputCh chan<- url.URL) {
 				inputCh <- Url
@@ -76,39 +175,57 @@ func RssMasterPollFeeds(con *riak.Client, InputCh chan<- url.URL, OutputCh <-cha
 		}
 	}
 	for i := 0; i < valid_keys; i++ {
-		if err := <-OutputCh; err.Err != nil {
-			errors = append(errors, err)
+		if result := <-OutputCh; result.Err != nil {
+			if feedErr, ok := result.Err.(FeedError); ok {
+				errors = append(errors, feedErr)
+			} else {
+				errors = append(errors, FeedError{result.Err, result.Url})
+			}
 		}
 	}
 	if len(errors) != 0 {
-		log.Println(MultiError(errors))
+		return MultiError(errors)
 	}
+	return nil
 }
 
-func NewRssMaster(con *riak.Client, idGenerator <-chan uint64) (master RssMaster) {
+func NewRssMaster(con *riak.Client, idGenerator <-chan uint64) RssMaster {
+	return NewRssMasterWithConfig(con, idGenerator, DefaultRssMasterConfig())
+}
+
+func NewRssMasterWithConfig(con *riak.Client, idGenerator <-chan uint64, config RssMasterConfig) (master RssMaster) {
 	AddRequestCh := make(chan AddFeedRequest)
+	RemoveRequestCh := make(chan RemoveFeedRequest)
+	events := NewItemEventBus()
+	if config.Logger == nil {
+		config.Logger = DefaultLogger
+	}
 	master = RssMaster{
-		AddRequestCh: AddRequestCh,
+		AddRequestCh:    AddRequestCh,
+		RemoveRequestCh: RemoveRequestCh,
 
-		pipeline: NewRssParserPipeline(con, idGenerator),
+		pipeline: newRssParserPipeline(con, idGenerator, events, config),
+		events:   events,
+		logger:   config.Logger,
 	}
 
-	go func(con *riak.Client, AddRequestCh <-chan AddFeedRequest) {
+	go func(con *riak.Client, AddRequestCh <-chan AddFeedRequest, RemoveRequestCh <-chan RemoveFeedRequest) {
 		for {
-			next, ok := <-AddRequestCh
-			if !ok {
-				break
+			select {
+			case next, ok := <-AddRequestCh:
+				if !ok {
+					return
+				}
+				next.ResponseCh <- RssMasterHandleAddRequest(con, next.Url)
+			case next, ok := <-RemoveRequestCh:
+				if !ok {
+					return
+				}
+				next.ResponseCh <- RssMasterHandleRemoveRequest(con, next.Url)
 			}
-			next.ResponseCh <- RssMasterHandleAddRequest(con, next.Url)
-		}
-	}(con, AddRequestCh)
-	go func(con *riak.Client, InputCh chan<- url.URL, OutputCh <-chan FeedError) {
-		tick := time.Tick(5 * time.Minute)
-		for {
-			RssMasterPollFeeds(con, InputCh, OutputCh)
-			<-tick //Pause and wait for 5 minutes to pass.  This is just to batch requests when possible.
 		}
-	}(con, master.pipeline.InputCh, master.pipeline.OutputCh)
+	}(con, AddRequestCh, RemoveRequestCh)
+	go newFeedScheduler(con, config, master.pipeline.InputCh, master.pipeline.OutputCh).run()
 
 	return
 }
@@ -23,6 +23,8 @@ import (
 
 	"strconv"
 	"testing"
+
+	riak "github.com/tpjg/goriakpbc"
 )
 
 func TestRssMasterHandleAddRequest(t *testing.T) {
@@ -59,6 +61,35 @@ func TestRssMasterHandleAddRequest(t *testing.T) {
 	}
 }
 
+func TestRssMasterHandleRemoveRequest(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	Url := getUniqueExampleComUrl(t)
+
+	if err := RssMasterHandleRemoveRequest(con, *Url); err != nil {
+		t.Errorf("Failed to remove a feed that doesn't exist (%s)", err)
+	}
+
+	CreateFeed(t, con, Url)
+	MustUpdateFeedTo(t, con, Url, "simple", 1)
+
+	loadFeed := &Feed{Url: *Url}
+	if err := con.LoadModel(loadFeed.UrlKey(), loadFeed); err != nil {
+		t.Fatalf("Failed to load feed (%s)", err)
+	}
+
+	if err := RssMasterHandleRemoveRequest(con, *Url); err != nil {
+		t.Fatalf("Failed to remove feed (%s)", err)
+	}
+	if err := con.LoadModel(loadFeed.UrlKey(), &Feed{}); err != riak.NotFound {
+		t.Errorf("Feed still exists after removal (%v)", err)
+	}
+	if !checkAllItemsDeleted(t, loadFeed.ItemKeys, con) {
+		t.Errorf("Items still exist after removing their feed")
+	}
+}
+
 func TestRssMasterPollSingleFeed(t *testing.T) {
 	con := getTestConnection(t)
 	defer killTestDb(con, t)
@@ -73,31 +104,33 @@ func TestRssMasterPollSingleFeed(t *testing.T) {
 	// and failures.  Failures are left largely unhandled, but at least we should see the test finish!
 	inputCh := make(chan url.URL)
 	defer close(inputCh)
-	outputCh := make(chan FeedError)
+	outputCh := make(chan FeedUpdateResult)
 
 	feedsParsed := 0
 
-	go func(inputCh <-chan url.URL, outputCh chan<- FeedError) {
+	go func(inputCh <-chan url.URL, outputCh chan<- FeedUpdateResult) {
 		defer close(outputCh)
 		for {
 			if next, ok := <-inputCh; !ok {
 				break
 			} else {
 				feedsParsed++
-				outputCh <- FeedError{Url: next, Err: nil} // SUCCESS!!!
+				outputCh <- FeedUpdateResult{Url: next, Err: nil} // SUCCESS!!!
 			}
 
 			if next, ok := <-inputCh; !ok {
 				break
 			} else {
 				feedsParsed++
-				outputCh <- FeedError{Url: next, Err: errors.New("Random test failure!")} // FAILURE!!!
+				outputCh <- FeedUpdateResult{Url: next, Err: errors.New("Random test failure!")} // FAILURE!!!
 			}
 		}
 	}(inputCh, outputCh)
 
 	// And try the fetch!
-	RssMasterPollFeeds(con, inputCh, outputCh)
+	if err := RssMasterPollFeeds(con, inputCh, outputCh); err != nil {
+		t.Error("Polling failed:", err)
+	}
 	if feedsParsed != 1 {
 		t.Errorf("Failed to parse the expected number of feeds.  Wanted 1, got %v", feedsParsed)
 	}
@@ -40,6 +40,10 @@ type ParsedFeedItemList []ParsedFeedItem
 type ParsedFeedData struct {
 	Title string
 
+	// Advertised through rel="hub" and rel="self" links, for WebSub.  Empty when not advertised.
+	HubUrl  url.URL
+	SelfUrl url.URL
+
 	Items ParsedFeedItemList
 
 	FetchedAt     time.Time
@@ -51,6 +55,7 @@ type ParsedFeedItem struct {
 	Title      string
 	Author     string
 	Content    string
+	Categories []string
 
 	Url url.URL
 
@@ -112,11 +117,31 @@ func parseRssFeed(feedContents []byte, fetchedAt time.Time) (*ParsedFeedData, er
 		Title: channel.Title,
 	}
 
+	for _, link := range channel.Links {
+		if link.Href == "" {
+			continue
+		}
+		Url, err := url.Parse(link.Href)
+		if err != nil {
+			continue
+		}
+		if link.Rel == "hub" && output.HubUrl.String() == "" {
+			output.HubUrl = *Url
+		} else if link.Rel == "self" && output.SelfUrl.String() == "" {
+			output.SelfUrl = *Url
+		}
+	}
+
 	for _, item := range channel.Items {
 		nextItem := ParsedFeedItem{
 			Title:  item.Title,
 			Author: item.Author.Name,
 		}
+		for _, category := range item.Categories {
+			if category.Text != "" {
+				nextItem.Categories = append(nextItem.Categories, category.Text)
+			}
+		}
 		if item.Content == nil {
 			nextItem.Content = item.Description
 		} else {
@@ -177,17 +202,30 @@ func parseRssFeed(feedContents []byte, fetchedAt time.Time) (*ParsedFeedData, er
 type FeedParserOut struct {
 	Data ParsedFeedData
 	Url  url.URL
+
+	// Carried over from the RawFeed, so they can be reported once the feed is stored.
+	FetchDuration time.Duration
+	Bytes         int
+	Pushed        bool
 }
 
 func FeedParser(in <-chan RawFeed, out chan<- FeedParserOut, errChan chan<- FeedError) {
+	feedParser(in, out, errChan, DefaultLogger)
+}
+
+func feedParser(in <-chan RawFeed, out chan<- FeedParserOut, errChan chan<- FeedError, logger Logger) {
 	for {
 		if next, ok := <-in; ok {
 
 			data, err := parseRssFeed(next.Data, next.FetchedAt)
 			if err == nil {
-				out <- FeedParserOut{Data: *data, Url: next.Url}
+				logger.Log(LogDebug, "Parsed feed", FeedField(next.Url), StageField(ParseStage), ItemCountField(len(data.Items)))
+				out <- FeedParserOut{Data: *data, Url: next.Url, FetchDuration: next.FetchDuration, Bytes: len(next.Data), Pushed: next.Pushed}
 			} else {
-				errChan <- FeedError{Err: err, Url: next.Url}
+				parseFailuresMetric.Inc()
+				parseErr := newParseError(err)
+				logger.Log(LogWarn, "Failed to parse feed", FeedField(next.Url), StageField(ParseStage), ErrorField(parseErr), RetryableField(parseErr))
+				errChan <- FeedError{Err: parseErr, Url: next.Url}
 			}
 		} else {
 			break
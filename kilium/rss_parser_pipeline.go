@@ -22,45 +22,95 @@ import (
 	riak "github.com/tpjg/goriakpbc"
 )
 
+// How many feeds can wait between stages of the pipeline.  Their depth is exported as a metric, so a
+// stage that can't keep up shows as a full buffer in front of it.
+const PipelineStageBuffer = 10
+
 type RssParserPipeline struct {
 	InputCh  chan<- url.URL
-	OutputCh <-chan FeedError
+	OutputCh <-chan FeedUpdateResult
 
 	fetcherCh    chan url.URL
 	parserCh     chan RawFeed
 	updateDbDch  chan FeedParserOut
-	completionCh chan UpdatedModel
+	completionCh chan FeedUpdateResult
+	errorCh      chan FeedError
+
+	// Pushed content (from WebSub) skips the fetcher, and has its results dropped once events are
+	// published.  It has its own parser, but shares the one updater with polled content so a feed is
+	// never updated twice at once.
+	pushCh chan RawFeed
+
+	events *ItemEventBus
 }
 
-func rssParserPipelineFinishItem(completionCh chan UpdatedModel, outputCh chan FeedError) {
+// Every feed that enters the pipeline leaves it here, either as a completed update or as an error from
+// one of the stages.  Item events for completed updates are published before the result is passed on.
+// Results for pushed content stop once their events are published.
+func rssParserPipelineFinishItem(completionCh <-chan FeedUpdateResult, errorCh <-chan FeedError, outputCh chan<- FeedUpdateResult, events *ItemEventBus) {
 	for {
-		if output, ok := <-completionCh; ok {
-			outputCh <- FeedError{Url: output.Url, Err: nil}
-		} else {
-			break
+		select {
+		case output, ok := <-completionCh:
+			if !ok {
+				return
+			}
+			if events != nil {
+				events.PublishResult(output)
+			}
+			if !output.Pushed {
+				outputCh <- output
+			}
+		case err := <-errorCh:
+			outputCh <- FeedUpdateResult{Url: err.Url, Err: err}
 		}
 	}
 }
 
-func NewRssParserPipeline(con *riak.Client, idGenerator <-chan uint64) (pipeline RssParserPipeline) {
+// Failures of pushed content have nobody waiting on them.  The parser already logged them.
+func rssParserPipelineDiscardErrors(errorCh <-chan FeedError) {
+	for _ = range errorCh {
+	}
+}
+
+func NewRssParserPipeline(con *riak.Client, idGenerator <-chan uint64, events *ItemEventBus) RssParserPipeline {
+	return newRssParserPipeline(con, idGenerator, events, RssMasterConfig{Logger: DefaultLogger})
+}
+
+// Feeds are stored as config.Node.  See updateFeeds.
+func newRssParserPipeline(con *riak.Client, idGenerator <-chan uint64, events *ItemEventBus, config RssMasterConfig) (pipeline RssParserPipeline) {
+	logger := config.Logger
 	InputCh := make(chan url.URL)
-	OutputCh := make(chan FeedError)
+	OutputCh := make(chan FeedUpdateResult)
 	pipeline = RssParserPipeline{
 		InputCh:  InputCh,
 		OutputCh: OutputCh,
 
-		parserCh:     make(chan RawFeed),
-		updateDbDch:  make(chan FeedParserOut),
-		completionCh: make(chan UpdatedModel),
+		parserCh:     make(chan RawFeed, PipelineStageBuffer),
+		updateDbDch:  make(chan FeedParserOut, PipelineStageBuffer),
+		completionCh: make(chan FeedUpdateResult, PipelineStageBuffer),
+		errorCh:      make(chan FeedError),
+
+		pushCh: make(chan RawFeed),
+
+		events: events,
 	}
 
+	pipelineQueueMetric.SetFunc(func() float64 { return float64(len(pipeline.parserCh)) }, "parse")
+	pipelineQueueMetric.SetFunc(func() float64 { return float64(len(pipeline.updateDbDch)) }, "update")
+	pipelineQueueMetric.SetFunc(func() float64 { return float64(len(pipeline.completionCh)) }, "finish")
+
 	// Launch the various pipeline pieces.
-	go FeedFetcher(InputCh, pipeline.parserCh, OutputCh)
-	go FeedParser(pipeline.parserCh, pipeline.updateDbDch, OutputCh)
-	go UpdateFeed(con, idGenerator, pipeline.updateDbDch, pipeline.completionCh, OutputCh)
+	go feedFetcher(InputCh, pipeline.parserCh, pipeline.errorCh, logger)
+	go feedParser(pipeline.parserCh, pipeline.updateDbDch, pipeline.errorCh, logger)
+	go updateFeeds(con, idGenerator, pipeline.updateDbDch, pipeline.completionCh, pipeline.errorCh, config)
 
 	// Launch the handling go routines.
-	go rssParserPipelineFinishItem(pipeline.completionCh, OutputCh)
+	go rssParserPipelineFinishItem(pipeline.completionCh, pipeline.errorCh, OutputCh, events)
+
+	// And the pushed content's parser, which joins the polled content at the updater.
+	pushErrorCh := make(chan FeedError)
+	go feedParser(pipeline.pushCh, pipeline.updateDbDch, pushErrorCh, logger.With(LogField{"pushed", true}))
+	go rssParserPipelineDiscardErrors(pushErrorCh)
 
 	return
 }
@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"errors"
+	"net/url"
+
+	"testing"
+)
+
+func TestPipelineFinishItemReportsEverything(t *testing.T) {
+	completionCh := make(chan FeedUpdateResult)
+	errorCh := make(chan FeedError)
+	outputCh := make(chan FeedUpdateResult)
+	defer close(completionCh)
+
+	go rssParserPipelineFinishItem(completionCh, errorCh, outputCh, nil)
+
+	good, _ := url.Parse("http://example.com/good.rss")
+	bad, _ := url.Parse("http://example.com/bad.rss")
+
+	completionCh <- FeedUpdateResult{Url: *good, Inserted: 3, Bytes: 42}
+	if result := <-outputCh; result.Err != nil || result.Url != *good || result.Inserted != 3 || result.Bytes != 42 {
+		t.Errorf("Successful result was mangled (%+v)", result)
+	}
+
+	errorCh <- FeedError{Url: *bad, Err: errors.New("Test failure!")}
+	if result := <-outputCh; result.Err == nil || result.Url != *bad {
+		t.Errorf("Failure wasn't reported as a failed result (%+v)", result)
+	}
+}
+
+func TestPipelineFinishItemPublishesEvents(t *testing.T) {
+	completionCh := make(chan FeedUpdateResult)
+	errorCh := make(chan FeedError)
+	outputCh := make(chan FeedUpdateResult)
+	defer close(completionCh)
+
+	events := NewItemEventBus()
+	sub := events.Subscribe(10, DropNewest)
+
+	go rssParserPipelineFinishItem(completionCh, errorCh, outputCh, events)
+
+	Url, _ := url.Parse("http://example.com/feed.rss")
+	completionCh <- FeedUpdateResult{
+		Url:             *Url,
+		NewItemKeys:     ItemKeyList{genItemKey(2, "New")},
+		DeletedItemKeys: ItemKeyList{genItemKey(1, "Old")},
+	}
+	<-outputCh
+
+	// Events must be published before the result comes out.
+	if event := <-sub.Events; event.Type != DeletedItem || !event.ItemKey.Equal(genItemKey(1, "Old")) {
+		t.Errorf("Expected the deleted item first, got %v", event)
+	}
+	if event := <-sub.Events; event.Type != NewItem || !event.ItemKey.Equal(genItemKey(2, "New")) {
+		t.Errorf("Expected the new item second, got %v", event)
+	}
+
+	errorCh <- FeedError{Url: *Url, Err: errors.New("Test failure!")}
+	<-outputCh
+	select {
+	case event := <-sub.Events:
+		t.Errorf("Failed update published an event (%v)", event)
+	default:
+	}
+}
+
+func TestPipelineFinishItemDropsPushedResults(t *testing.T) {
+	completionCh := make(chan FeedUpdateResult)
+	errorCh := make(chan FeedError)
+	outputCh := make(chan FeedUpdateResult, 1)
+	defer close(completionCh)
+
+	events := NewItemEventBus()
+	sub := events.Subscribe(10, DropNewest)
+
+	go rssParserPipelineFinishItem(completionCh, errorCh, outputCh, events)
+
+	pushed, _ := url.Parse("http://example.com/pushed.rss")
+	polled, _ := url.Parse("http://example.com/polled.rss")
+	completionCh <- FeedUpdateResult{Url: *pushed, NewItemKeys: ItemKeyList{genItemKey(1, "Pushed")}, Pushed: true}
+	completionCh <- FeedUpdateResult{Url: *polled}
+
+	// The polled result comes out, but the pushed one only publishes its events.
+	if result := <-outputCh; result.Url != *polled {
+		t.Errorf("Expected only the polled result, got %+v", result)
+	}
+	if event := <-sub.Events; event.Type != NewItem || event.FeedUrl != *pushed {
+		t.Errorf("Pushed result didn't publish its event (%v)", event)
+	}
+}
@@ -22,6 +22,7 @@ import (
 
 	"reflect"
 	"testing"
+	"time"
 )
 
 // Note, original is modified to preform the compare operations!
@@ -91,3 +92,30 @@ func TestSimpleFeedParserTest(t *testing.T) {
 	verifyParsedAtomFeed(t, *feed, *atomOut)
 	verifyParsedRssFeed(t, *feed, *rssOut)
 }
+
+func TestFeedParserFindsWebSubLinks(t *testing.T) {
+	atom := `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+	<title>Pushy</title>
+	<link rel="self" href="http://example.com/self.atom"/>
+	<link rel="hub" href="http://hub.example.com/"/>
+	<id>tag:example.com,2013:pushy</id>
+	<updated>2013-07-08T02:03:00Z</updated>
+	<entry>
+		<title>Item</title>
+		<id>tag:example.com,2013:item</id>
+		<updated>2013-07-08T02:03:00Z</updated>
+	</entry>
+</feed>`
+
+	parsed, err := parseRssFeed([]byte(atom), time.Now())
+	if err != nil {
+		t.Fatalf("Failed to parse atom feed (%s)", err)
+	}
+	if parsed.HubUrl.String() != "http://hub.example.com/" {
+		t.Errorf("Hub link not found (%v)", parsed.HubUrl)
+	}
+	if parsed.SelfUrl.String() != "http://example.com/self.atom" {
+		t.Errorf("Self link not found (%v)", parsed.SelfUrl)
+	}
+}
@@ -0,0 +1,651 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	riak "github.com/tpjg/goriakpbc"
+)
+
+const (
+	// Longer words aren't indexed, to keep riak keys sane.
+	MaximumSearchTermLength = 64
+	// Removed postings are kept this long, so siblings written before the removal can't bring them
+	// back.
+	SearchTombstoneLifetime = 24 * time.Hour
+
+	// Terms are split into a shard for each period of item ids, so no one object holds every posting
+	// of a common word, and items found at different times don't contend for the same object.
+	SearchShardPeriod = 24 * time.Hour
+	// The most postings a shard keeps.  Past this the oldest are dropped, so a word in more items than
+	// this in one period only finds the newest of them.
+	MaximumSearchShardPostings = 10000
+
+	// Shards are indexed by their term, so searches can find every shard of a term.
+	SearchTermIndexName = "term_bin"
+
+	// Fields are spaced apart by this much, so phrases don't match across them.
+	searchFieldGap = 1000
+)
+
+// Words too common to be worth indexing.  Searching for only these finds nothing, and in phrases they
+// stand for any word.
+var searchStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "by": true,
+	"for": true, "from": true, "in": true, "is": true, "it": true, "of": true, "on": true, "or": true,
+	"that": true, "the": true, "this": true, "to": true, "was": true, "with": true,
+}
+
+var EmptySearchQuery = errors.New("Search query has nothing to look for!")
+var NegatedSearchAlternative = errors.New("Negated terms can't be part of an OR!")
+var UnterminatedSearchPhrase = errors.New("Search phrase is missing its closing quote!")
+
+// Where a term shows up in an item.
+type SearchPosting struct {
+	Key       ItemKey
+	Positions []int
+
+	// Removed postings stay around as tombstones until SearchTombstoneLifetime passes.
+	Removed bool
+	Updated time.Time
+}
+
+// Kept sorted like ItemKeyList, newest first.
+type SearchPostingList []SearchPosting
+
+// One shard of a term in the inverted index, holding the postings of the items whose ids fall in one
+// SearchShardPeriod.  Stored at searchShardKey.
+type SearchTerm struct {
+	Term     string            `riak:"term"`
+	Postings SearchPostingList `riak:"postings"`
+
+	riak.Model `riak:"search_terms"`
+}
+
+func searchShardKey(term string, key ItemKey) string {
+	period := IdTimestamp(key.Id()).Unix() / int64(SearchShardPeriod/time.Second)
+	return term + "@" + strconv.FormatInt(period, 10)
+}
+
+var (
+	searchIgnoredElements = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>`)
+	searchTags            = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// Turns text into lower case words, dropping any html.
+func searchWords(text string) []string {
+	text = searchIgnoredElements.ReplaceAllString(text, " ")
+	text = html.UnescapeString(searchTags.ReplaceAllString(text, " "))
+
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// The terms in item, with the positions each is found at.
+func searchTerms(item *FeedItem) map[string][]int {
+	terms := make(map[string][]int)
+	for field, text := range []string{item.Title, item.Author, item.Content} {
+		for i, word := range searchWords(text) {
+			if len(word) <= MaximumSearchTermLength && !searchStopWords[word] {
+				terms[word] = append(terms[word], field*searchFieldGap+i)
+			}
+		}
+	}
+	return terms
+}
+
+func (list SearchPostingList) search(key ItemKey) int {
+	return sort.Search(len(list), func(i int) bool { return !key.Less(list[i].Key) })
+}
+
+// Returns the live posting for key, if there is one.
+func (list SearchPostingList) Find(key ItemKey) (SearchPosting, bool) {
+	if i := list.search(key); i < len(list) && list[i].Key.Equal(key) && !list[i].Removed {
+		return list[i], true
+	}
+	return SearchPosting{}, false
+}
+
+// Replaces or inserts posting, keeping the list sorted.
+func (list *SearchPostingList) Set(posting SearchPosting) {
+	i := list.search(posting.Key)
+	if i < len(*list) && (*list)[i].Key.Equal(posting.Key) {
+		(*list)[i] = posting
+		return
+	}
+	*list = append(*list, SearchPosting{})
+	copy((*list)[i+1:], (*list)[i:])
+	(*list)[i] = posting
+}
+
+// The keys of every live posting.
+func (list SearchPostingList) Keys() ItemKeyList {
+	keys := ItemKeyList{}
+	for _, posting := range list {
+		if !posting.Removed {
+			keys = append(keys, posting.Key)
+		}
+	}
+	return keys
+}
+
+// Drops tombstones old enough to no longer matter.
+func (list *SearchPostingList) prune(now time.Time) {
+	kept := (*list)[:0]
+	for _, posting := range *list {
+		if !posting.Removed || now.Sub(posting.Updated) < SearchTombstoneLifetime {
+			kept = append(kept, posting)
+		}
+	}
+	*list = kept
+}
+
+// Merges two sorted lists, keeping the latest change to each posting.
+func mergeSearchPostings(x, y SearchPostingList) SearchPostingList {
+	ret := make(SearchPostingList, 0, len(x)+len(y))
+
+	xI, yI := 0, 0
+	for xI < len(x) && yI < len(y) {
+		switch bytes.Compare(x[xI].Key, y[yI].Key) {
+		case 1:
+			ret = append(ret, x[xI])
+			xI++
+		case -1:
+			ret = append(ret, y[yI])
+			yI++
+		default:
+			if y[yI].Updated.After(x[xI].Updated) {
+				ret = append(ret, y[yI])
+			} else {
+				ret = append(ret, x[xI])
+			}
+			xI++
+			yI++
+		}
+	}
+	ret = append(ret, x[xI:]...)
+	ret = append(ret, y[yI:]...)
+
+	return ret
+}
+
+func (t *SearchTerm) Resolve(siblingsCount int) error {
+	siblingsI, err := t.Siblings(&SearchTerm{})
+	if err != nil {
+		return err
+	}
+	siblings := siblingsI.([]SearchTerm)
+
+	t.Postings = nil
+	for i := 0; i < siblingsCount; i++ {
+		t.Term = siblings[i].Term
+		t.Postings = mergeSearchPostings(t.Postings, siblings[i].Postings)
+	}
+	t.updateIndexes()
+	return nil
+}
+
+func (t *SearchTerm) updateIndexes() {
+	t.Indexes()[SearchTermIndexName] = t.Term
+}
+
+// Applies postings to the shard at shardKey.
+func updateSearchShard(con *riak.Client, shardKey, term string, postings []SearchPosting, now time.Time) error {
+	model := &SearchTerm{}
+	if err := con.LoadModel(shardKey, model); err != nil && err != riak.NotFound {
+		return err
+	}
+	model.Term = term
+	for _, posting := range postings {
+		model.Postings.Set(posting)
+	}
+	model.Postings.prune(now)
+	if len(model.Postings) > MaximumSearchShardPostings {
+		model.Postings = model.Postings[:MaximumSearchShardPostings]
+	}
+	model.updateIndexes()
+	return model.Save()
+}
+
+func positionsEqual(x, y []int) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Index changes gathered from several items, so each shard they touch is written once.
+//
+// Writing a shard loads and saves the whole of it, which is up to MaximumSearchShardPostings postings
+// with their positions, so it is worth doing as rarely as possible.  Items in one feed update are
+// mostly found at the same time and share words, so batching an update costs about one round trip per
+// distinct word in it, rather than one per word per item.
+type searchIndexBatch struct {
+	mutex sync.Mutex
+	now   time.Time
+	// The postings for each shard key, and the term of each.
+	changes map[string][]SearchPosting
+	terms   map[string]string
+}
+
+func newSearchIndexBatch() *searchIndexBatch {
+	return &searchIndexBatch{
+		now:     time.Now(),
+		changes: make(map[string][]SearchPosting),
+		terms:   make(map[string]string),
+	}
+}
+
+// Adds moving the index for key from old to updated.  Either can be nil, for inserted or deleted
+// items.  Only terms that changed are touched.  Safe to call from several goroutines.
+func (b *searchIndexBatch) add(key ItemKey, old, updated *FeedItem) {
+	oldTerms, newTerms := map[string][]int{}, map[string][]int{}
+	if old != nil {
+		oldTerms = searchTerms(old)
+	}
+	if updated != nil {
+		newTerms = searchTerms(updated)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	change := func(term string, posting SearchPosting) {
+		shardKey := searchShardKey(term, key)
+		b.changes[shardKey] = append(b.changes[shardKey], posting)
+		b.terms[shardKey] = term
+	}
+	for term := range oldTerms {
+		if _, ok := newTerms[term]; !ok {
+			change(term, SearchPosting{Key: key, Removed: true, Updated: b.now})
+		}
+	}
+	for term, positions := range newTerms {
+		if !positionsEqual(oldTerms[term], positions) {
+			change(term, SearchPosting{Key: key, Positions: positions, Updated: b.now})
+		}
+	}
+}
+
+// Writes every change added so far, and empties the batch.
+func (b *searchIndexBatch) write(con *riak.Client) error {
+	b.mutex.Lock()
+	changes, terms := b.changes, b.terms
+	b.changes, b.terms = make(map[string][]SearchPosting), make(map[string]string)
+	b.mutex.Unlock()
+
+	errCh := make(chan error)
+	for shardKey, postings := range changes {
+		go func(shardKey string, postings []SearchPosting) {
+			errCh <- updateSearchShard(con, shardKey, terms[shardKey], postings, b.now)
+		}(shardKey, postings)
+	}
+
+	var errs []error
+	drainErrorChannelIntoSlice(errCh, &errs, len(changes))
+	if len(errs) != 0 {
+		return MultiError(errs)
+	}
+	return nil
+}
+
+// Moves the index for key from old to updated straight away.  See searchIndexBatch.add.
+func updateSearchIndex(con *riak.Client, key ItemKey, old, updated *FeedItem) error {
+	batch := newSearchIndexBatch()
+	batch.add(key, old, updated)
+	return batch.write(con)
+}
+
+// Drops the whole search index, and builds it again from every stored item, logging its progress to
+// logger.
+func RebuildSearchIndex(con *riak.Client, logger Logger) error {
+	terms, err := con.Bucket("search_terms")
+	if err != nil {
+		return err
+	}
+	termKeys, err := terms.ListKeys()
+	if err != nil {
+		return err
+	}
+	for _, term := range termKeys {
+		if err := deleteObject(con, "search_terms", string(term)); err != nil {
+			return err
+		}
+	}
+
+	items, err := con.Bucket("items")
+	if err != nil {
+		return err
+	}
+	itemKeys, err := items.ListKeys()
+	if err != nil {
+		return err
+	}
+	// Flushed every thousand items, so the batch stays small.
+	batch := newSearchIndexBatch()
+	for i, riakKey := range itemKeys {
+		key, err := ParseItemKey(string(riakKey))
+		if err != nil {
+			logger.Log(LogWarn, "Skipping item with a bad key", LogField{"key", string(riakKey)}, ErrorField(err))
+			continue
+		}
+
+		item := &FeedItem{}
+		if err := con.LoadModel(string(riakKey), item); err == riak.NotFound {
+			continue // Deleted while rebuilding.
+		} else if err != nil {
+			return err
+		}
+		batch.add(key, nil, item)
+
+		if (i+1)%1000 == 0 {
+			if err := batch.write(con); err != nil {
+				return err
+			}
+			logger.Log(LogInfo, "Reindexing items", ItemCountField(i+1), LogField{"total", len(itemKeys)})
+		}
+	}
+	return batch.write(con)
+}
+
+// A phrase of one or more words, which must show up next to each other.
+type searchPhrase []string
+
+// Any of the alternatives can match, unless the clause is negated, in which case none may.
+type searchClause struct {
+	Alternatives []searchPhrase
+	Negated      bool
+}
+
+// A parsed search.  Every clause must hold, and if any feeds are given, items must come from one of
+// them.
+type SearchQuery struct {
+	Clauses []searchClause
+	Feeds   []string
+}
+
+// Parses a query made of:
+//
+//	word                 Items with the word.
+//	"some words"         Items with the words in order.
+//	a OR b               Items with either.
+//	-word, NOT word      Items without the word, or phrase.
+//	feed:{key}           Only items from the feed.  Giving several allows any of them.
+//
+// Everything else must all match.
+func ParseSearchQuery(query string) (*SearchQuery, error) {
+	var tokens []string
+	var quoted []bool
+	for rest := strings.TrimSpace(query); rest != ""; rest = strings.TrimSpace(rest) {
+		if rest[0] == '"' || strings.HasPrefix(rest, "-\"") {
+			negated := rest[0] == '-'
+			if negated {
+				rest = rest[1:]
+			}
+			end := strings.IndexByte(rest[1:], '"')
+			if end == -1 {
+				return nil, UnterminatedSearchPhrase
+			}
+			if negated {
+				tokens, quoted = append(tokens, "NOT"), append(quoted, false)
+			}
+			tokens, quoted = append(tokens, rest[1:end+1]), append(quoted, true)
+			rest = rest[end+2:]
+			continue
+		}
+
+		end := strings.IndexFunc(rest, unicode.IsSpace)
+		if end == -1 {
+			end = len(rest)
+		}
+		token := rest[:end]
+		if len(token) > 1 && token[0] == '-' {
+			tokens, quoted = append(tokens, "NOT"), append(quoted, false)
+			token = token[1:]
+		}
+		tokens, quoted = append(tokens, token), append(quoted, false)
+		rest = rest[end:]
+	}
+
+	parsed := &SearchQuery{}
+	negateNext, orNext := false, false
+	for i, token := range tokens {
+		switch {
+		case !quoted[i] && token == "NOT":
+			negateNext = true
+			continue
+		case !quoted[i] && token == "OR":
+			orNext = len(parsed.Clauses) != 0
+			continue
+		case !quoted[i] && strings.HasPrefix(token, "feed:"):
+			parsed.Feeds = append(parsed.Feeds, strings.TrimPrefix(token, "feed:"))
+			continue
+		}
+
+		phrase := searchPhrase(searchWords(token))
+		if !phrase.indexed() {
+			negateNext, orNext = false, false
+			continue
+		}
+
+		if orNext {
+			last := &parsed.Clauses[len(parsed.Clauses)-1]
+			if last.Negated || negateNext {
+				return nil, NegatedSearchAlternative
+			}
+			last.Alternatives = append(last.Alternatives, phrase)
+		} else {
+			parsed.Clauses = append(parsed.Clauses, searchClause{Alternatives: []searchPhrase{phrase}, Negated: negateNext})
+		}
+		negateNext, orNext = false, false
+	}
+
+	for _, clause := range parsed.Clauses {
+		if !clause.Negated {
+			return parsed, nil
+		}
+	}
+	return nil, EmptySearchQuery
+}
+
+// Loads terms for a single search, remembering them so each is only loaded once.
+type searchTermCache struct {
+	con   *riak.Client
+	terms map[string]SearchPostingList
+}
+
+// Loads and merges every shard of term.
+func (cache *searchTermCache) load(term string) (SearchPostingList, error) {
+	if postings, ok := cache.terms[term]; ok {
+		return postings, nil
+	}
+
+	bucket, err := cache.con.Bucket("search_terms")
+	if err != nil {
+		return nil, err
+	}
+	shardKeys, err := bucket.IndexQuery(SearchTermIndexName, term)
+	if err != nil {
+		return nil, err
+	}
+
+	shards := make([]SearchPostingList, len(shardKeys))
+	errCh := make(chan error)
+	for i, key := range shardKeys {
+		go func(i int, key string) {
+			model := &SearchTerm{}
+			err := cache.con.LoadModel(key, model)
+			if err == riak.NotFound {
+				err = nil
+			}
+			shards[i] = model.Postings
+			errCh <- err
+		}(i, key)
+	}
+
+	var errs []error
+	drainErrorChannelIntoSlice(errCh, &errs, len(shardKeys))
+	if len(errs) != 0 {
+		return nil, MultiError(errs)
+	}
+
+	// Shards hold different items, so merging just puts them in order.
+	var postings SearchPostingList
+	for _, shard := range shards {
+		postings = mergeSearchPostings(postings, shard)
+	}
+	cache.terms[term] = postings
+	return postings, nil
+}
+
+func containsPosition(positions []int, position int) bool {
+	i := sort.SearchInts(positions, position)
+	return i < len(positions) && positions[i] == position
+}
+
+// Whether the phrase has any words that aren't stop words, which are all that can be looked up.
+func (phrase searchPhrase) indexed() bool {
+	for _, word := range phrase {
+		if !searchStopWords[word] {
+			return true
+		}
+	}
+	return false
+}
+
+func (phrase searchPhrase) keys(cache *searchTermCache) (ItemKeyList, error) {
+	// Stop words aren't indexed, so they are left out of the lookups and match any word.
+	var words []int
+	postings := make([]SearchPostingList, len(phrase))
+	for i, word := range phrase {
+		if searchStopWords[word] {
+			continue
+		}
+		words = append(words, i)
+		var err error
+		if postings[i], err = cache.load(word); err != nil {
+			return nil, err
+		}
+	}
+
+	first := words[0]
+	keys := postings[first].Keys()
+	for _, i := range words[1:] {
+		keys.intersect(postings[i].Keys())
+	}
+	if len(phrase) == 1 {
+		return keys, nil
+	}
+
+	// Only keep items where the words follow each other somewhere.
+	matching := ItemKeyList{}
+	for _, key := range keys {
+		firstPosting, _ := postings[first].Find(key)
+		for _, position := range firstPosting.Positions {
+			start := position - first
+			found := start >= 0 && start/searchFieldGap == (start+len(phrase)-1)/searchFieldGap
+			for _, i := range words[1:] {
+				if !found {
+					break
+				}
+				next, _ := postings[i].Find(key)
+				found = containsPosition(next.Positions, start+i)
+			}
+			if found {
+				matching = append(matching, key)
+				break
+			}
+		}
+	}
+	return matching, nil
+}
+
+func (clause searchClause) keys(cache *searchTermCache) (ItemKeyList, error) {
+	keys := ItemKeyList{}
+	for _, phrase := range clause.Alternatives {
+		next, err := phrase.keys(cache)
+		if err != nil {
+			return nil, err
+		}
+		keys = *InsertSliceSort(&keys, &next).(*ItemKeyList)
+	}
+	return keys, nil
+}
+
+// Runs the query, returning up to limit matching keys, newest first.
+func (query *SearchQuery) Run(con *riak.Client, limit int) (ItemKeyList, error) {
+	cache := &searchTermCache{con: con, terms: make(map[string]SearchPostingList)}
+
+	var result ItemKeyList
+	var excluded ItemKeyList
+	for _, clause := range query.Clauses {
+		keys, err := clause.keys(cache)
+		if err != nil {
+			return nil, err
+		}
+
+		if clause.Negated {
+			excluded = *InsertSliceSort(&excluded, &keys).(*ItemKeyList)
+		} else if result == nil {
+			result = keys
+		} else {
+			result.intersect(keys)
+		}
+	}
+	RemoveSliceElements(&result, &excluded)
+
+	if len(query.Feeds) != 0 {
+		feeds, err := LoadFeeds(con, query.Feeds)
+		if err != nil {
+			return nil, err
+		}
+		inFeeds := ItemKeyList{}
+		for _, feed := range feeds {
+			inFeeds = *InsertSliceSort(&inFeeds, &feed.ItemKeys).(*ItemKeyList)
+		}
+		result.intersect(inFeeds)
+	}
+
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+// Parses and runs query.  See ParseSearchQuery for what it can hold.
+func Search(con *riak.Client, query string, limit int) (ItemKeyList, error) {
+	parsed, err := ParseSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return parsed.Run(con, limit)
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"reflect"
+	"strconv"
+	"time"
+
+	"testing"
+)
+
+func TestSearchWords(t *testing.T) {
+	words := searchWords(`<p>Hello, <b>World</b>!</p><script>var ignored;</script> Caf&eacute; 2013`)
+	expected := []string{"hello", "world", "café", "2013"}
+	if !reflect.DeepEqual(words, expected) {
+		t.Errorf("Wrong words (expected, got) (%v, %v)", expected, words)
+	}
+}
+
+func TestSearchTerms(t *testing.T) {
+	terms := searchTerms(&FeedItem{Title: "Go go", Author: "Gopher", Content: "<i>go</i> fast"})
+	expected := map[string][]int{
+		"go":     {0, 1, 2 * searchFieldGap},
+		"gopher": {searchFieldGap},
+		"fast":   {2*searchFieldGap + 1},
+	}
+	if !reflect.DeepEqual(terms, expected) {
+		t.Errorf("Wrong terms (expected, got) (%v, %v)", expected, terms)
+	}
+}
+
+func TestSearchTermsSkipStopWords(t *testing.T) {
+	terms := searchTerms(&FeedItem{Title: "The state of the art"})
+	expected := map[string][]int{"state": {1}, "art": {4}}
+	if !reflect.DeepEqual(terms, expected) {
+		t.Errorf("Wrong terms (expected, got) (%v, %v)", expected, terms)
+	}
+}
+
+func TestSearchShardKey(t *testing.T) {
+	day := time.Date(2013, 7, 1, 0, 0, 0, 0, time.UTC)
+	first := NewItemKey(uint64(day.Unix())<<IdTimestampShift, []byte("A"))
+	last := NewItemKey(uint64(day.Add(SearchShardPeriod-time.Second).Unix())<<IdTimestampShift|0xfffff, []byte("B"))
+	next := NewItemKey(uint64(day.Add(SearchShardPeriod).Unix())<<IdTimestampShift, []byte("C"))
+
+	if searchShardKey("go", first) != searchShardKey("go", last) {
+		t.Error("Items found in the same period went to different shards")
+	}
+	if searchShardKey("go", first) == searchShardKey("go", next) {
+		t.Error("Items found in different periods went to the same shard")
+	}
+	if searchShardKey("go", first) == searchShardKey("rust", first) {
+		t.Error("Different terms went to the same shard")
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	query, err := ParseSearchQuery(`go OR rust "fast builds" -slow NOT "very old" feed:abc`)
+	if err != nil {
+		t.Fatalf("Failed to parse query (%s)", err)
+	}
+	expected := &SearchQuery{
+		Clauses: []searchClause{
+			{Alternatives: []searchPhrase{{"go"}, {"rust"}}},
+			{Alternatives: []searchPhrase{{"fast", "builds"}}},
+			{Alternatives: []searchPhrase{{"slow"}}, Negated: true},
+			{Alternatives: []searchPhrase{{"very", "old"}}, Negated: true},
+		},
+		Feeds: []string{"abc"},
+	}
+	if !reflect.DeepEqual(query, expected) {
+		t.Errorf("Wrong query (expected, got) (\n%+v, \n%+v)", expected, query)
+	}
+
+	for bad, expectedErr := range map[string]error{
+		"":             EmptySearchQuery,
+		"-only":        EmptySearchQuery,
+		"x OR -b":      NegatedSearchAlternative,
+		`"unfinished`:  UnterminatedSearchPhrase,
+		"feed:abc ...": EmptySearchQuery,
+		`the "of a"`:   EmptySearchQuery,
+	} {
+		if _, err := ParseSearchQuery(bad); err != expectedErr {
+			t.Errorf("Parsing %q gave %v, expected %v", bad, err, expectedErr)
+		}
+	}
+}
+
+func TestMergeSearchPostings(t *testing.T) {
+	early := time.Date(2013, 7, 1, 0, 0, 0, 0, time.UTC)
+	late := time.Date(2013, 7, 2, 0, 0, 0, 0, time.UTC)
+
+	x := SearchPostingList{
+		{Key: genItemKey(9, "A"), Positions: []int{1}, Updated: early},
+		{Key: genItemKey(5, "B"), Removed: true, Updated: late},
+	}
+	y := SearchPostingList{
+		{Key: genItemKey(7, "C"), Positions: []int{2}, Updated: early},
+		{Key: genItemKey(5, "B"), Positions: []int{3}, Updated: early},
+	}
+
+	merged := mergeSearchPostings(x, y)
+	if !reflect.DeepEqual(merged, mergeSearchPostings(y, x)) {
+		t.Error("Merge depends on order")
+	}
+	if keys := merged.Keys(); len(keys) != 2 || !keys[0].Equal(genItemKey(9, "A")) || !keys[1].Equal(genItemKey(7, "C")) {
+		t.Errorf("Removed posting came back (%+v)", merged)
+	}
+
+	merged.prune(late.Add(SearchTombstoneLifetime))
+	if len(merged) != 2 {
+		t.Errorf("Old tombstone wasn't pruned (%+v)", merged)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	items := []ParsedFeedItem{
+		{Title: "Go is fast", Content: "<p>Builds are quick</p>"},
+		{Title: "Rust is fast too", Content: "But builds are slow"},
+		{Title: "Fast food", Content: "Nothing to do with go"},
+	}
+	keys := ItemKeyList{}
+	feed := &Feed{}
+	for i, item := range items {
+		key := NewItemKey(uint64(10-i), makeHash("Search "+strconv.Itoa(i)+key_uniquer))
+		keys = append(keys, key)
+		if err := InsertItem(con, "", key, item); err != nil {
+			t.Fatalf("Failed to insert item (%s)", err)
+		}
+	}
+	feed.ItemKeys = keys[1:]
+	if err := con.NewModel("SearchFeed", feed); err != nil {
+		t.Fatalf("Failed to create feed (%s)", err)
+	} else if err := feed.Save(); err != nil {
+		t.Fatalf("Failed to save feed (%s)", err)
+	}
+
+	check := func(query string, want ...int) {
+		found, err := Search(con, query, 10)
+		if err != nil {
+			t.Errorf("Search for %q failed (%s)", query, err)
+			return
+		}
+		if len(found) != len(want) {
+			t.Errorf("Search for %q found %v items, expected %v", query, len(found), len(want))
+			return
+		}
+		for i, item := range want {
+			if !found[i].Equal(keys[item]) {
+				t.Errorf("Search for %q found the wrong items (%v)", query, found)
+			}
+		}
+	}
+
+	check("fast", 0, 1, 2)
+	check("go", 0, 2)
+	check(`"is fast"`, 0, 1)
+	check("fast -builds", 2)
+	check("rust OR food", 1, 2)
+	check(`"fast go"`)
+	check(`"go is fast"`, 0)
+	check(`"rust is fast"`, 1)
+	check(`"is fast food"`)
+	check("fast feed:SearchFeed", 1, 2)
+
+	model := &FeedItem{}
+	if err := con.LoadModel(keys[0].GetRiakKey(), model); err != nil {
+		t.Fatalf("Failed to load item (%s)", err)
+	}
+	if err := UpdateItem(con, "", keys[0], ParsedFeedItem{Title: "Go is slow"}, model); err != nil {
+		t.Fatalf("Failed to update item (%s)", err)
+	}
+	check("fast", 1, 2)
+	check("slow", 0, 1)
+
+	if err := DeleteItem(con, keys[1]); err != nil {
+		t.Fatalf("Failed to delete item (%s)", err)
+	}
+	check("slow", 0)
+
+	if err := RebuildSearchIndex(con, DefaultLogger); err != nil {
+		t.Fatalf("Failed to rebuild index (%s)", err)
+	}
+	check("go", 0, 2)
+	check("rust")
+}
@@ -0,0 +1,230 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"time"
+
+	riak "github.com/tpjg/goriakpbc"
+)
+
+const (
+	PasswordHashIterations = 100000
+	passwordSaltLength     = 16
+	passwordHashLength     = 32
+)
+
+var UserNotFound = errors.New("Failed to find user in riak!")
+var UserExists = errors.New("User already exists!")
+var NotSubscribed = errors.New("User is not subscribed to that feed!")
+
+func hashPassword(password string, salt []byte) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, PasswordHashIterations, passwordHashLength)
+}
+
+// Replaces the user's password.  The user still needs to be saved afterwards.
+func (u *User) SetPassword(password string) error {
+	salt := make([]byte, passwordSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	hash, err := hashPassword(password, salt)
+	if err != nil {
+		return err
+	}
+
+	u.PasswordSalt = salt
+	u.PasswordHash = hash
+	u.PasswordUpdated = time.Now()
+
+	feverKey := md5.Sum([]byte(u.Name + ":" + password))
+	u.FeverKey = hex.EncodeToString(feverKey[:])
+	return nil
+}
+
+func (u *User) CheckPassword(password string) bool {
+	if len(u.PasswordHash) == 0 {
+		return false
+	}
+	hash, err := hashPassword(password, u.PasswordSalt)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(hash, u.PasswordHash)
+}
+
+func CreateUser(con *riak.Client, name, password string) (*User, error) {
+	user := &User{}
+	if err := con.LoadModel(name, user); err == nil {
+		return nil, UserExists
+	} else if err != riak.NotFound {
+		return nil, err
+	}
+
+	user.Name = name
+	if err := user.SetPassword(password); err != nil {
+		return nil, err
+	}
+	user.updateIndexes()
+	if err := user.Save(); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func LoadUser(con *riak.Client, name string) (*User, error) {
+	user := &User{}
+	if err := con.LoadModel(name, user); err == riak.NotFound {
+		return nil, UserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func FindUserByFeverKey(con *riak.Client, key string) (*User, error) {
+	bucket, err := con.Bucket("users")
+	if err != nil {
+		return nil, err
+	}
+	names, err := bucket.IndexQuery(FeverKeyIndexName, key)
+	if err != nil {
+		return nil, err
+	} else if len(names) == 0 {
+		return nil, UserNotFound
+	}
+
+	// The index can lag behind, so make sure the key still matches.
+	user, err := LoadUser(con, names[0])
+	if err != nil {
+		return nil, err
+	} else if user.FeverKey != key {
+		return nil, UserNotFound
+	}
+	return user, nil
+}
+
+// Subscribes the user to feedUrl, adding the feed if nobody had it yet.  Subscribing again just updates
+// the title and folder.
+func Subscribe(con *riak.Client, name string, feedUrl url.URL, title, folder string) error {
+	if err := RssMasterHandleAddRequest(con, feedUrl); err != nil {
+		return err
+	}
+
+	user, err := LoadUser(con, name)
+	if err != nil {
+		return err
+	}
+	if user.Subscriptions == nil {
+		user.Subscriptions = make(map[string]Subscription)
+	}
+
+	user.Subscriptions[(&Feed{Url: feedUrl}).UrlKey()] = Subscription{
+		FeedUrl:    feedUrl,
+		Title:      title,
+		Folder:     folder,
+		Subscribed: true,
+		Updated:    time.Now(),
+	}
+	return user.Save()
+}
+
+// Removes the user's subscription.  The feed itself stays, since other users may still want it.
+func Unsubscribe(con *riak.Client, name string, feedUrl url.URL) error {
+	user, err := LoadUser(con, name)
+	if err != nil {
+		return err
+	}
+
+	key := (&Feed{Url: feedUrl}).UrlKey()
+	sub, ok := user.Subscriptions[key]
+	if !ok || !sub.Subscribed {
+		return nil
+	}
+
+	sub.Subscribed = false
+	sub.Updated = time.Now()
+	user.Subscriptions[key] = sub
+	return user.Save()
+}
+
+// Loads the user's state for a feed.  A missing state is returned empty, ready to be saved.
+func LoadUserFeedState(con *riak.Client, name, feedKey string) (*UserFeedState, error) {
+	state := &UserFeedState{}
+	if err := con.LoadModel(UserFeedStateKey(name, feedKey), state); err == riak.NotFound {
+		state.User = name
+		state.FeedKey = feedKey
+	} else if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func updateUserFeedState(con *riak.Client, name, feedKey string, update func(*UserFeedState)) error {
+	user, err := LoadUser(con, name)
+	if err != nil {
+		return err
+	}
+	if !user.Subscriptions[feedKey].Subscribed {
+		return NotSubscribed
+	}
+
+	feed, err := LoadFeed(con, feedKey)
+	if err != nil {
+		return err
+	}
+	state, err := LoadUserFeedState(con, name, feedKey)
+	if err != nil {
+		return err
+	}
+
+	update(state)
+	state.Compact(feed.ItemKeys)
+	state.updateIndexes()
+	return state.Save()
+}
+
+func MarkItemsRead(con *riak.Client, name, feedKey string, keys ItemKeyList, read bool) error {
+	return updateUserFeedState(con, name, feedKey, func(state *UserFeedState) {
+		for _, key := range keys {
+			state.SetRead(key, read)
+		}
+	})
+}
+
+// Marks every item of the feed at or below upTo read.
+func MarkFeedRead(con *riak.Client, name, feedKey string, upTo ItemKey) error {
+	return updateUserFeedState(con, name, feedKey, func(state *UserFeedState) {
+		state.MarkAllRead(upTo)
+	})
+}
+
+func MarkItemsStarred(con *riak.Client, name, feedKey string, keys ItemKeyList, starred bool) error {
+	return updateUserFeedState(con, name, feedKey, func(state *UserFeedState) {
+		for _, key := range keys {
+			state.SetStarred(key, starred)
+		}
+	})
+}
@@ -0,0 +1,330 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"bytes"
+	"net/url"
+	"sort"
+	"time"
+
+	riak "github.com/tpjg/goriakpbc"
+)
+
+const (
+	FeverKeyIndexName = "fever_key_bin"
+
+	UserFeedStateFeedIndexName = "feed_bin"
+)
+
+type User struct {
+	Name string `riak:"name"`
+
+	PasswordSalt    []byte    `riak:"password_salt"`
+	PasswordHash    []byte    `riak:"password_hash"`
+	PasswordUpdated time.Time `riak:"password_updated"`
+	// The Fever API's key, an md5 of "name:password".  Fever clients can't use anything better, so it
+	// is kept apart from the real hash.
+	FeverKey string `riak:"fever_key"`
+
+	// Keyed by the feed's UrlKey.  Unsubscribing leaves the subscription behind, marked as such, so
+	// that concurrent changes merge properly.
+	Subscriptions map[string]Subscription `riak:"subscriptions"`
+
+	riak.Model `riak:"users"`
+}
+
+type Subscription struct {
+	FeedUrl url.URL
+
+	// Overrides the feed's own title when not empty.
+	Title  string
+	Folder string
+
+	Subscribed bool
+	Updated    time.Time
+}
+
+// Starred state for a single item.  The latest change wins when merging.
+type ItemMark struct {
+	Key ItemKey
+
+	Starred bool
+	Updated time.Time
+}
+
+// Kept sorted like ItemKeyList, newest first.
+type ItemMarkList []ItemMark
+
+// A user's state for the items of one of their feeds.
+//
+// Read state is kept as a high-water mark: every item at or below ReadBelow is read, except those in
+// UnreadBelow, and every item above it is unread, except those in ReadAbove.  Marking a whole feed read
+// then just moves ReadBelow, and the exception lists stay small.  Siblings merge as sets, with read
+// winning over unread.
+type UserFeedState struct {
+	User    string `riak:"user"`
+	FeedKey string `riak:"feed"`
+
+	ReadBelow   ItemKey     `riak:"read_below"`
+	ReadAbove   ItemKeyList `riak:"read_above"`
+	UnreadBelow ItemKeyList `riak:"unread_below"`
+
+	Starred ItemMarkList `riak:"starred"`
+
+	riak.Model `riak:"user_feed_states"`
+}
+
+// Subscriptions that haven't been removed, keyed by feed key.
+func (u *User) ActiveSubscriptions() map[string]Subscription {
+	active := make(map[string]Subscription)
+	for key, sub := range u.Subscriptions {
+		if sub.Subscribed {
+			active[key] = sub
+		}
+	}
+	return active
+}
+
+func (u *User) Resolve(siblingsCount int) error {
+	siblingsI, err := u.Siblings(&User{})
+	if err != nil {
+		return err
+	}
+	siblings := siblingsI.([]User)
+
+	u.Name = siblings[0].Name
+	u.Subscriptions = make(map[string]Subscription)
+
+	for i := 0; i < siblingsCount; i++ {
+		if i == 0 || siblings[i].PasswordUpdated.After(u.PasswordUpdated) {
+			u.PasswordSalt = siblings[i].PasswordSalt
+			u.PasswordHash = siblings[i].PasswordHash
+			u.PasswordUpdated = siblings[i].PasswordUpdated
+			u.FeverKey = siblings[i].FeverKey
+		}
+
+		// Every subscription is merged on its own, latest change wins.
+		for key, sub := range siblings[i].Subscriptions {
+			if existing, ok := u.Subscriptions[key]; !ok || sub.Updated.After(existing.Updated) {
+				u.Subscriptions[key] = sub
+			}
+		}
+	}
+	u.updateIndexes()
+
+	return nil
+}
+
+func (u *User) updateIndexes() {
+	if u.FeverKey != "" {
+		u.Indexes()[FeverKeyIndexName] = u.FeverKey
+	} else {
+		delete(u.Indexes(), FeverKeyIndexName)
+	}
+}
+
+func UserFeedStateKey(userName, feedKey string) string {
+	// Feed keys are url safe base64, so they never contain a ':'.
+	return userName + ":" + feedKey
+}
+
+// Finds where key is, or would be inserted.
+func (list ItemMarkList) search(key ItemKey) int {
+	return sort.Search(len(list), func(i int) bool { return !key.Less(list[i].Key) })
+}
+
+// Returns the mark for key, or an empty one if the item has never been marked.
+func (list ItemMarkList) Find(key ItemKey) ItemMark {
+	if i := list.search(key); i < len(list) && list[i].Key.Equal(key) {
+		return list[i]
+	}
+	return ItemMark{Key: key}
+}
+
+// Replaces or inserts mark, keeping the list sorted.
+func (list *ItemMarkList) Set(mark ItemMark) {
+	i := list.search(mark.Key)
+	if i < len(*list) && (*list)[i].Key.Equal(mark.Key) {
+		(*list)[i] = mark
+		return
+	}
+	*list = append(*list, ItemMark{})
+	copy((*list)[i+1:], (*list)[i:])
+	(*list)[i] = mark
+}
+
+func mergeItemMark(x, y ItemMark) ItemMark {
+	if y.Updated.After(x.Updated) {
+		return y
+	}
+	return x
+}
+
+// Merges two sorted mark lists like InsertSliceSort, except matching marks are merged instead of one
+// being dropped.
+func mergeItemMarks(x, y ItemMarkList) ItemMarkList {
+	ret := make(ItemMarkList, 0, len(x)+len(y))
+
+	xI, yI := 0, 0
+	for xI < len(x) && yI < len(y) {
+		switch bytes.Compare(x[xI].Key, y[yI].Key) {
+		case 1: // Descending, so the bigger key goes first.
+			ret = append(ret, x[xI])
+			xI++
+		case -1:
+			ret = append(ret, y[yI])
+			yI++
+		default:
+			ret = append(ret, mergeItemMark(x[xI], y[yI]))
+			xI++
+			yI++
+		}
+	}
+	ret = append(ret, x[xI:]...)
+	ret = append(ret, y[yI:]...)
+
+	return ret
+}
+
+// Finds where key is, or would be inserted, in a descending list.  Everything from there on is at or
+// below key.
+func (list ItemKeyList) search(key ItemKey) int {
+	return sort.Search(len(list), func(i int) bool { return !key.Less(list[i]) })
+}
+
+func (list ItemKeyList) Contains(key ItemKey) bool {
+	i := list.search(key)
+	return i < len(list) && list[i].Equal(key)
+}
+
+// Removes every key that isn't in keep.  Both lists must be sorted.
+func (list *ItemKeyList) intersect(keep ItemKeyList) {
+	toRemove := append(ItemKeyList{}, (*list)...)
+	RemoveSliceElements(&toRemove, &keep)
+	RemoveSliceElements(list, &toRemove)
+}
+
+func (s *UserFeedState) atOrBelowMark(key ItemKey) bool {
+	return s.ReadBelow != nil && !s.ReadBelow.Less(key)
+}
+
+func (s *UserFeedState) IsRead(key ItemKey) bool {
+	if s.atOrBelowMark(key) {
+		return !s.UnreadBelow.Contains(key)
+	}
+	return s.ReadAbove.Contains(key)
+}
+
+func (s *UserFeedState) SetRead(key ItemKey, read bool) {
+	list := &s.ReadAbove
+	if s.atOrBelowMark(key) {
+		list, read = &s.UnreadBelow, !read
+	}
+
+	if read {
+		*list = *InsertSliceSort(list, &ItemKeyList{key}).(*ItemKeyList)
+	} else {
+		RemoveSliceElements(list, &ItemKeyList{key})
+	}
+}
+
+// Marks every item at or below upTo read.
+func (s *UserFeedState) MarkAllRead(upTo ItemKey) {
+	if !s.atOrBelowMark(upTo) {
+		s.ReadBelow = upTo
+		s.ReadAbove = s.ReadAbove[:s.ReadAbove.search(upTo)]
+	}
+	s.UnreadBelow = s.UnreadBelow[:s.UnreadBelow.search(upTo)]
+}
+
+// Moves the high-water mark up over read items, and forgets about items no longer in the feed.
+// feedKeys is the feed's ItemKeys.
+func (s *UserFeedState) Compact(feedKeys ItemKeyList) {
+	s.ReadAbove.intersect(feedKeys)
+	s.UnreadBelow.intersect(feedKeys)
+
+	i := len(feedKeys)
+	if s.ReadBelow != nil {
+		i = feedKeys.search(s.ReadBelow)
+	}
+	// Walk up from the mark while items are read.
+	for i--; i >= 0 && s.ReadAbove.Contains(feedKeys[i]); i-- {
+		s.ReadBelow = feedKeys[i]
+	}
+	s.ReadAbove = s.ReadAbove[:s.ReadAbove.search(s.ReadBelow)]
+}
+
+func (s *UserFeedState) IsStarred(key ItemKey) bool {
+	return s.Starred.Find(key).Starred
+}
+
+func (s *UserFeedState) SetStarred(key ItemKey, starred bool) {
+	s.Starred.Set(ItemMark{Key: key, Starred: starred, Updated: time.Now()})
+}
+
+// Returns the keys read in this state, out of candidates.  The candidates must be sorted.
+func (s *UserFeedState) readKeys(candidates ItemKeyList) ItemKeyList {
+	read := ItemKeyList{}
+	if s.ReadBelow != nil {
+		read = append(read, candidates[candidates.search(s.ReadBelow):]...)
+		RemoveSliceElements(&read, &s.UnreadBelow)
+	}
+	return *InsertSliceSort(&read, &s.ReadAbove).(*ItemKeyList)
+}
+
+func (s *UserFeedState) Resolve(siblingsCount int) error {
+	siblingsI, err := s.Siblings(&UserFeedState{})
+	if err != nil {
+		return err
+	}
+	s.mergeSiblings(siblingsI.([]UserFeedState)[:siblingsCount])
+	s.updateIndexes()
+	return nil
+}
+
+func (s *UserFeedState) updateIndexes() {
+	s.Indexes()[UserFeedStateFeedIndexName] = s.FeedKey
+}
+
+func (s *UserFeedState) mergeSiblings(siblings []UserFeedState) {
+	s.User = siblings[0].User
+	s.FeedKey = siblings[0].FeedKey
+	s.ReadBelow = nil
+	s.ReadAbove = ItemKeyList{}
+	s.UnreadBelow = ItemKeyList{}
+	s.Starred = nil
+
+	for i := range siblings {
+		if s.ReadBelow == nil || s.ReadBelow.Less(siblings[i].ReadBelow) {
+			s.ReadBelow = siblings[i].ReadBelow
+		}
+		s.ReadAbove = *InsertSliceSort(&s.ReadAbove, &siblings[i].ReadAbove).(*ItemKeyList)
+		s.UnreadBelow = *InsertSliceSort(&s.UnreadBelow, &siblings[i].UnreadBelow).(*ItemKeyList)
+		s.Starred = mergeItemMarks(s.Starred, siblings[i].Starred)
+	}
+
+	// Read wins, so an item only stays unread if no sibling has it read.
+	s.ReadAbove = s.ReadAbove[:s.ReadAbove.search(s.ReadBelow)]
+	if s.ReadBelow != nil {
+		s.UnreadBelow = s.UnreadBelow[s.UnreadBelow.search(s.ReadBelow):]
+	}
+	for i := range siblings {
+		read := siblings[i].readKeys(s.UnreadBelow)
+		RemoveSliceElements(&s.UnreadBelow, &read)
+	}
+}
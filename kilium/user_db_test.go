@@ -0,0 +1,307 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUserPassword(t *testing.T) {
+	user := User{Name: "someone"}
+	if user.CheckPassword("") {
+		t.Error("A user without a password accepted an empty one")
+	}
+
+	if err := user.SetPassword("secret"); err != nil {
+		t.Fatalf("Failed to set password (%s)", err)
+	}
+	if !user.CheckPassword("secret") {
+		t.Error("Correct password was rejected")
+	}
+	if user.CheckPassword("Secret") {
+		t.Error("Wrong password was accepted")
+	}
+	// md5("someone:secret")
+	if user.FeverKey != "8c0e9cd8251265675da8c3a803b0c78b" {
+		t.Errorf("Wrong fever key (%s)", user.FeverKey)
+	}
+}
+
+func TestItemMarkListSet(t *testing.T) {
+	var marks ItemMarkList
+	marks.Set(ItemMark{Key: genItemKey(5, "B"), Starred: true})
+	marks.Set(ItemMark{Key: genItemKey(10, "A"), Starred: true})
+	marks.Set(ItemMark{Key: genItemKey(1, "C"), Starred: true})
+	marks.Set(ItemMark{Key: genItemKey(5, "B"), Starred: false})
+
+	expected := ItemMarkList{
+		{Key: genItemKey(10, "A"), Starred: true},
+		{Key: genItemKey(5, "B")},
+		{Key: genItemKey(1, "C"), Starred: true},
+	}
+	if !reflect.DeepEqual(marks, expected) {
+		t.Errorf("Marks don't match (expected, got) (\n%+v, \n%+v)", expected, marks)
+	}
+
+	if mark := marks.Find(genItemKey(7, "D")); mark.Starred || !mark.Key.Equal(genItemKey(7, "D")) {
+		t.Errorf("Unmarked item has a mark (%+v)", mark)
+	}
+}
+
+func TestMergeItemMarks(t *testing.T) {
+	early := time.Date(2013, 7, 1, 0, 0, 0, 0, time.UTC)
+	late := time.Date(2013, 7, 2, 0, 0, 0, 0, time.UTC)
+
+	x := ItemMarkList{
+		{Key: genItemKey(10, "A"), Starred: true, Updated: late},
+		{Key: genItemKey(5, "B"), Starred: true, Updated: late},
+	}
+	y := ItemMarkList{
+		{Key: genItemKey(8, "C"), Starred: true, Updated: early},
+		{Key: genItemKey(5, "B"), Starred: false, Updated: early},
+	}
+
+	expected := ItemMarkList{
+		{Key: genItemKey(10, "A"), Starred: true, Updated: late},
+		{Key: genItemKey(8, "C"), Starred: true, Updated: early},
+		{Key: genItemKey(5, "B"), Starred: true, Updated: late},
+	}
+
+	if merged := mergeItemMarks(x, y); !reflect.DeepEqual(merged, expected) {
+		t.Errorf("Merged marks don't match (expected, got) (\n%+v, \n%+v)", expected, merged)
+	}
+	if merged := mergeItemMarks(y, x); !reflect.DeepEqual(merged, expected) {
+		t.Errorf("Merge depends on order (expected, got) (\n%+v, \n%+v)", expected, merged)
+	}
+}
+
+func checkReadState(t *testing.T, state *UserFeedState, read, unread ItemKeyList) {
+	for _, key := range read {
+		if !state.IsRead(key) {
+			t.Errorf("Item %d is unread, expected read (%+v)", key[7], state)
+		}
+	}
+	for _, key := range unread {
+		if state.IsRead(key) {
+			t.Errorf("Item %d is read, expected unread (%+v)", key[7], state)
+		}
+	}
+}
+
+func TestUserFeedStateReadMarks(t *testing.T) {
+	feedKeys := ItemKeyList{genItemKey(5, "E"), genItemKey(4, "D"), genItemKey(3, "C"), genItemKey(2, "B"), genItemKey(1, "A")}
+	state := &UserFeedState{}
+
+	checkReadState(t, state, nil, feedKeys)
+
+	state.SetRead(feedKeys[3], true)
+	state.SetRead(feedKeys[0], true)
+	checkReadState(t, state, ItemKeyList{feedKeys[0], feedKeys[3]}, ItemKeyList{feedKeys[1], feedKeys[2], feedKeys[4]})
+
+	state.MarkAllRead(feedKeys[2])
+	checkReadState(t, state, ItemKeyList{feedKeys[0], feedKeys[2], feedKeys[3], feedKeys[4]}, ItemKeyList{feedKeys[1]})
+	if len(state.ReadAbove) != 1 {
+		t.Errorf("Marking all read didn't drop covered exceptions (%+v)", state.ReadAbove)
+	}
+
+	state.SetRead(feedKeys[3], false)
+	checkReadState(t, state, ItemKeyList{feedKeys[0], feedKeys[2], feedKeys[4]}, ItemKeyList{feedKeys[1], feedKeys[3]})
+
+	// Reading item 4 lets the mark move to the top.
+	state.SetRead(feedKeys[1], true)
+	state.Compact(feedKeys)
+	if !state.ReadBelow.Equal(feedKeys[0]) || len(state.ReadAbove) != 0 {
+		t.Errorf("Compacting didn't move the mark up (%+v)", state)
+	}
+	checkReadState(t, state, ItemKeyList{feedKeys[0], feedKeys[1], feedKeys[2], feedKeys[4]}, ItemKeyList{feedKeys[3]})
+
+	// Items gone from the feed are forgotten.
+	state.Compact(feedKeys[:3])
+	if len(state.UnreadBelow) != 0 {
+		t.Errorf("Compacting kept an exception for a removed item (%+v)", state.UnreadBelow)
+	}
+}
+
+func TestUserSubscriptions(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	if _, err := CreateUser(con, "reader", "password"); err != nil {
+		t.Fatalf("Failed to create user (%s)", err)
+	}
+	if _, err := CreateUser(con, "reader", "other"); err != UserExists {
+		t.Errorf("Creating a user twice didn't fail properly (%v)", err)
+	}
+
+	if err := Subscribe(con, "reader", *testFeedUrl, "Custom", "News"); err != nil {
+		t.Fatalf("Failed to subscribe (%s)", err)
+	}
+	keys := ItemKeyList{genItemKey(10, "A"), genItemKey(5, "B")}
+	feedKey := (&Feed{Url: *testFeedUrl}).UrlKey()
+	if feed, err := LoadFeed(con, feedKey); err != nil {
+		t.Fatalf("Subscribing didn't add the feed (%s)", err)
+	} else {
+		feed.ItemKeys = keys
+		if err := feed.Save(); err != nil {
+			t.Fatalf("Failed to save feed (%s)", err)
+		}
+	}
+
+	user, err := LoadUser(con, "reader")
+	if err != nil {
+		t.Fatalf("Failed to load user (%s)", err)
+	}
+	if !user.CheckPassword("password") {
+		t.Error("Stored password doesn't match")
+	}
+	if sub, ok := user.ActiveSubscriptions()[feedKey]; !ok || sub.Title != "Custom" || sub.Folder != "News" {
+		t.Errorf("Subscription wasn't stored correctly (%+v)", user.Subscriptions)
+	}
+
+	if err := MarkItemsRead(con, "reader", feedKey, keys, true); err != nil {
+		t.Fatalf("Failed to mark items read (%s)", err)
+	}
+	if err := MarkItemsStarred(con, "reader", feedKey, keys[1:], true); err != nil {
+		t.Fatalf("Failed to star item (%s)", err)
+	}
+
+	state, err := LoadUserFeedState(con, "reader", feedKey)
+	if err != nil {
+		t.Fatalf("Failed to load feed state (%s)", err)
+	}
+	if !state.IsRead(keys[0]) || !state.IsRead(keys[1]) || state.IsStarred(keys[0]) || !state.IsStarred(keys[1]) {
+		t.Errorf("Feed state doesn't match what was marked (%+v)", state)
+	}
+
+	if err := Unsubscribe(con, "reader", *testFeedUrl); err != nil {
+		t.Fatalf("Failed to unsubscribe (%s)", err)
+	}
+	if user, err = LoadUser(con, "reader"); err != nil {
+		t.Fatalf("Failed to load user (%s)", err)
+	} else if len(user.ActiveSubscriptions()) != 0 {
+		t.Errorf("User is still subscribed (%+v)", user.Subscriptions)
+	}
+	if err := MarkItemsRead(con, "reader", feedKey, keys, false); err != NotSubscribed {
+		t.Errorf("Marking items of an unsubscribed feed didn't fail properly (%v)", err)
+	}
+}
+
+func TestUserResolving(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	otherUrl, _ := url.Parse("http://example.com/other.rss")
+	early := time.Date(2013, 7, 1, 0, 0, 0, 0, time.UTC)
+	late := time.Date(2013, 7, 2, 0, 0, 0, 0, time.UTC)
+
+	EntryA := User{
+		Name:            "conflict",
+		PasswordHash:    []byte("A"),
+		PasswordUpdated: late,
+		Subscriptions: map[string]Subscription{
+			"feed": {FeedUrl: *testFeedUrl, Title: "A", Subscribed: true, Updated: early},
+		},
+	}
+	EntryB := User{
+		Name:            "conflict",
+		PasswordHash:    []byte("B"),
+		PasswordUpdated: early,
+		Subscriptions: map[string]Subscription{
+			"feed":  {FeedUrl: *testFeedUrl, Title: "B", Subscribed: false, Updated: late},
+			"other": {FeedUrl: *otherUrl, Subscribed: true, Updated: early},
+		},
+	}
+
+	if err := con.NewModel("conflict", &EntryA); err != nil {
+		t.Fatalf("Failed to create EntryA's model (%s)", err)
+	}
+	if err := EntryA.Save(); err != nil {
+		t.Fatalf("Failed to save EntryA (%s)", err)
+	}
+	if err := con.NewModel("conflict", &EntryB); err != nil {
+		t.Fatalf("Failed to create EntryB's model (%s)", err)
+	}
+	if err := EntryB.Save(); err != nil {
+		t.Fatalf("Failed to save EntryB (%s)", err)
+	}
+
+	load, err := LoadUser(con, "conflict")
+	if err != nil {
+		t.Fatalf("Failed to load conflict model (%s)", err)
+	}
+	if string(load.PasswordHash) != "A" {
+		t.Errorf("Resolved to the older password (%s)", load.PasswordHash)
+	}
+	if sub := load.Subscriptions["feed"]; sub.Subscribed || sub.Title != "B" {
+		t.Errorf("Resolved to the older subscription (%+v)", sub)
+	}
+	if sub := load.Subscriptions["other"]; !sub.Subscribed {
+		t.Errorf("Lost a subscription while resolving (%+v)", load.Subscriptions)
+	}
+}
+
+func TestUserFeedStateMerging(t *testing.T) {
+	feedKeys := ItemKeyList{genItemKey(5, "E"), genItemKey(4, "D"), genItemKey(3, "C"), genItemKey(2, "B"), genItemKey(1, "A")}
+
+	// X has read everything but D and B, while Y has read E and C, but marked A unread.
+	x := UserFeedState{ReadBelow: feedKeys[0], UnreadBelow: ItemKeyList{feedKeys[1], feedKeys[3]}}
+	y := UserFeedState{ReadBelow: feedKeys[2], ReadAbove: ItemKeyList{feedKeys[0]}, UnreadBelow: ItemKeyList{feedKeys[3], feedKeys[4]}}
+
+	for _, siblings := range [][]UserFeedState{{x, y}, {y, x}} {
+		merged := &UserFeedState{}
+		merged.mergeSiblings(siblings)
+
+		// Read wins, so A stays read while D and B are unread everywhere.
+		checkReadState(t, merged, ItemKeyList{feedKeys[0], feedKeys[2], feedKeys[4]}, ItemKeyList{feedKeys[1], feedKeys[3]})
+		if !merged.ReadBelow.Equal(feedKeys[0]) || len(merged.ReadAbove) != 0 {
+			t.Errorf("Merged mark is wrong (%+v)", merged)
+		}
+	}
+}
+
+func TestUserFeedStateResolving(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	feedKeys := ItemKeyList{genItemKey(5, "E"), genItemKey(4, "D"), genItemKey(3, "C"), genItemKey(2, "B"), genItemKey(1, "A")}
+
+	EntryA := UserFeedState{User: "conflict", FeedKey: "feed", ReadBelow: feedKeys[0], UnreadBelow: ItemKeyList{feedKeys[1], feedKeys[3]}}
+	EntryB := UserFeedState{User: "conflict", FeedKey: "feed", ReadBelow: feedKeys[2], ReadAbove: ItemKeyList{feedKeys[0]}, UnreadBelow: ItemKeyList{feedKeys[3], feedKeys[4]}}
+
+	key := UserFeedStateKey("conflict", "feed")
+	if err := con.NewModel(key, &EntryA); err != nil {
+		t.Fatalf("Failed to create EntryA's model (%s)", err)
+	}
+	if err := EntryA.Save(); err != nil {
+		t.Fatalf("Failed to save EntryA (%s)", err)
+	}
+	if err := con.NewModel(key, &EntryB); err != nil {
+		t.Fatalf("Failed to create EntryB's model (%s)", err)
+	}
+	if err := EntryB.Save(); err != nil {
+		t.Fatalf("Failed to save EntryB (%s)", err)
+	}
+
+	load, err := LoadUserFeedState(con, "conflict", "feed")
+	if err != nil {
+		t.Fatalf("Failed to load conflict model (%s)", err)
+	}
+	checkReadState(t, load, ItemKeyList{feedKeys[0], feedKeys[2], feedKeys[4]}, ItemKeyList{feedKeys[1], feedKeys[3]})
+}
@@ -0,0 +1,509 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"bytes"
+
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+
+	"fmt"
+
+	"io"
+	"io/ioutil"
+
+	"net/http"
+	"net/url"
+
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	riak "github.com/tpjg/goriakpbc"
+)
+
+const (
+	// Holds "sha256=" followed by the hex encoded HMAC-SHA256 of the request body, keyed with the
+	// webhook's secret.
+	WebhookSignatureHeader = "X-Kilium-Signature"
+	// Holds a key unique to the item and webhook.  Retries reuse it, so receivers can de-dup.
+	WebhookDeliveryHeader = "X-Kilium-Delivery"
+
+	NextAttemptIndexName = "next_attempt_int"
+
+	// Deliveries are retried with exponential backoff, up to this many attempts.  With the
+	// backoff below, that is a little over two days of trying.
+	MaximumWebhookAttempts = 15
+	WebhookInitialBackoff  = 30 * time.Second
+	WebhookMaximumBackoff  = 6 * time.Hour
+
+	// How often queued deliveries are checked, in case nothing new pokes the dispatcher.
+	WebhookPollInterval = time.Minute
+	// How long registered webhooks are cached by the dispatcher.
+	WebhookCacheTime = time.Minute
+	// How many deliveries may be in flight at once.
+	WebhookDeliveryConcurrency = 8
+)
+
+type Webhook struct {
+	Url    url.URL `riak:"url"`
+	Secret string  `riak:"secret"`
+
+	// When not empty, only items from these feeds are delivered.
+	FeedUrls []url.URL `riak:"feed_urls"`
+	// When not empty, only items with at least one of these categories are delivered.
+	Categories []string `riak:"categories"`
+
+	Updated time.Time `riak:"updated"`
+
+	riak.Model `riak:"webhooks"`
+}
+
+// A queued delivery of a single item to a single webhook.  It is removed once delivered, or once it
+// runs out of attempts.
+type WebhookDelivery struct {
+	Webhook string `riak:"webhook"` // The UrlKey of the webhook to deliver to.
+	Payload []byte `riak:"payload"`
+
+	Attempts    int       `riak:"attempts"`
+	NextAttempt time.Time `riak:"next_attempt"`
+	LastError   string    `riak:"last_error"`
+
+	riak.Model `riak:"webhook_deliveries"`
+}
+
+// The JSON body POSTed to webhooks.
+type WebhookPayload struct {
+	Event   string  `json:"event"`
+	FeedUrl string  `json:"feed_url"`
+	ItemKey ItemKey `json:"item_key"`
+
+	Title      string    `json:"title"`
+	Author     string    `json:"author"`
+	Content    string    `json:"content"`
+	Url        string    `json:"url"`
+	PubDate    time.Time `json:"publication_date"`
+	Categories []string  `json:"categories,omitempty"`
+}
+
+func (w *Webhook) UrlKey() string {
+	return base64.URLEncoding.EncodeToString(makeHash(w.Url.String()))
+}
+
+func (w *Webhook) Matches(feedUrl url.URL, item *FeedItem) bool {
+	if len(w.FeedUrls) != 0 {
+		found := false
+		for _, Url := range w.FeedUrls {
+			if Url.String() == feedUrl.String() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(w.Categories) != 0 {
+		for _, want := range w.Categories {
+			for _, have := range item.Categories {
+				if strings.EqualFold(want, have) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func (w *Webhook) Resolve(siblingsCount int) error {
+	siblingsI, err := w.Siblings(&Webhook{})
+	if err != nil {
+		return err
+	}
+	siblings := siblingsI.([]Webhook)
+
+	// Registrations are replaced wholesale, so the latest one wins.
+	for i := 0; i < siblingsCount; i++ {
+		if i == 0 || siblings[i].Updated.After(w.Updated) {
+			w.Url = siblings[i].Url
+			w.Secret = siblings[i].Secret
+			w.FeedUrls = siblings[i].FeedUrls
+			w.Categories = siblings[i].Categories
+			w.Updated = siblings[i].Updated
+		}
+	}
+	return nil
+}
+
+func (d *WebhookDelivery) Resolve(siblingsCount int) error {
+	siblingsI, err := d.Siblings(&WebhookDelivery{})
+	if err != nil {
+		return err
+	}
+	siblings := siblingsI.([]WebhookDelivery)
+
+	// The payload never changes, so just go with the sibling that has tried the hardest.
+	for i := 0; i < siblingsCount; i++ {
+		if i == 0 || siblings[i].Attempts > d.Attempts ||
+			(siblings[i].Attempts == d.Attempts && siblings[i].NextAttempt.After(d.NextAttempt)) {
+			d.Webhook = siblings[i].Webhook
+			d.Payload = siblings[i].Payload
+			d.Attempts = siblings[i].Attempts
+			d.NextAttempt = siblings[i].NextAttempt
+			d.LastError = siblings[i].LastError
+		}
+	}
+	d.Indexes()[NextAttemptIndexName] = strconv.FormatInt(d.NextAttempt.Unix(), 10)
+
+	return nil
+}
+
+// Registers a webhook, replacing any existing registration for the same url.
+func SaveWebhook(con *riak.Client, hook Webhook) error {
+	model := &Webhook{Url: hook.Url}
+	if err := con.LoadModel(model.UrlKey(), model); err != nil && err != riak.NotFound {
+		return err
+	}
+	model.Secret = hook.Secret
+	model.FeedUrls = hook.FeedUrls
+	model.Categories = hook.Categories
+	model.Updated = time.Now()
+
+	return model.Save()
+}
+
+// Removes the webhook registered for Url.  Anything still queued for it is dropped when it comes up
+// for delivery.
+func RemoveWebhook(con *riak.Client, Url url.URL) error {
+	hook := &Webhook{Url: Url}
+	return deleteObject(con, "webhooks", hook.UrlKey())
+}
+
+// Loads every registered webhook, keyed by UrlKey.
+func LoadWebhooks(con *riak.Client) (map[string]*Webhook, error) {
+	bucket, err := con.Bucket("webhooks")
+	if err != nil {
+		return nil, err
+	}
+	keys, err := bucket.ListKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := make(map[string]*Webhook)
+	for _, key := range keys {
+		hook := &Webhook{}
+		if err := con.LoadModel(string(key), hook); err == riak.NotFound {
+			continue // Removed while listing.
+		} else if err != nil {
+			return nil, err
+		}
+		hooks[string(key)] = hook
+	}
+	return hooks, nil
+}
+
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// For receivers, checks the WebhookSignatureHeader value against the received body.
+func VerifyWebhookSignature(secret string, payload []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhookPayload(secret, payload)), []byte(signature))
+}
+
+// How long to wait before the next attempt, after attempts failures.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := WebhookInitialBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= WebhookMaximumBackoff {
+			return WebhookMaximumBackoff
+		}
+	}
+	return backoff
+}
+
+func webhookDeliveryKey(hook *Webhook, itemKey ItemKey) string {
+	return hook.UrlKey() + "-" + itemKey.GetRiakKey()
+}
+
+func newWebhookPayload(event ItemEvent, item *FeedItem) WebhookPayload {
+	return WebhookPayload{
+		Event:   event.Type.String(),
+		FeedUrl: event.FeedUrl.String(),
+		ItemKey: event.ItemKey,
+
+		Title:      item.Title,
+		Author:     item.Author,
+		Content:    item.Content,
+		Url:        item.Url.String(),
+		PubDate:    item.PubDate,
+		Categories: item.Categories,
+	}
+}
+
+func deliverWebhook(client *http.Client, hook *Webhook, deliveryKey string, payload []byte) error {
+	req, err := http.NewRequest("POST", hook.Url.String(), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(hook.Secret, payload))
+	req.Header.Set(WebhookDeliveryHeader, deliveryKey)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook responded with status code %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// Queues a delivery of the event's item to every matching webhook.  The deliveries are stored before
+// anything is sent, so they survive a restart.
+func enqueueWebhookDeliveries(con *riak.Client, hooks map[string]*Webhook, event ItemEvent, now time.Time) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	item := &FeedItem{}
+	if err := con.LoadModel(event.ItemKey.GetRiakKey(), item); err == riak.NotFound {
+		return nil // Already gone, so there is nothing to tell anyone about.
+	} else if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(newWebhookPayload(event, item))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, hook := range hooks {
+		if !hook.Matches(event.FeedUrl, item) {
+			continue
+		}
+
+		delivery := &WebhookDelivery{}
+		if err := con.LoadModel(webhookDeliveryKey(hook, event.ItemKey), delivery); err == nil {
+			continue // Already queued.
+		} else if err != riak.NotFound {
+			errs = append(errs, err)
+			continue
+		}
+
+		delivery.Webhook = hook.UrlKey()
+		delivery.Payload = payload
+		delivery.NextAttempt = now
+		delivery.Indexes()[NextAttemptIndexName] = strconv.FormatInt(now.Unix(), 10)
+		if err := delivery.Save(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) != 0 {
+		return MultiError(errs)
+	}
+	return nil
+}
+
+// Makes one attempt at the delivery stored at key, then removes or reschedules it.  A failed
+// delivery is not an error, only failing to record the outcome is.
+func attemptWebhookDelivery(con *riak.Client, client *http.Client, hooks map[string]*Webhook, key string, now time.Time, logger Logger) error {
+	delivery := &WebhookDelivery{}
+	if err := con.LoadModel(key, delivery); err == riak.NotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if delivery.NextAttempt.After(now) {
+		return nil // Already attempted since the index was queried.
+	}
+
+	hook, ok := hooks[delivery.Webhook]
+	if !ok {
+		// The webhook was removed, so there is nowhere to send this.
+		return deleteObject(con, "webhook_deliveries", key)
+	}
+
+	err := deliverWebhook(client, hook, key, delivery.Payload)
+	if err == nil {
+		return deleteObject(con, "webhook_deliveries", key)
+	}
+
+	delivery.Attempts++
+	delivery.LastError = err.Error()
+	if delivery.Attempts >= MaximumWebhookAttempts {
+		logger.Log(LogWarn, "Giving up on webhook delivery", LogField{"delivery", key}, LogField{"webhook", hook.Url.String()}, LogField{"attempts", delivery.Attempts}, ErrorField(err))
+		return deleteObject(con, "webhook_deliveries", key)
+	}
+
+	delivery.NextAttempt = now.Add(webhookBackoff(delivery.Attempts))
+	delivery.Indexes()[NextAttemptIndexName] = strconv.FormatInt(delivery.NextAttempt.Unix(), 10)
+	return delivery.Save()
+}
+
+// Attempts every delivery that is due at now.
+func processDueWebhookDeliveries(con *riak.Client, client *http.Client, hooks map[string]*Webhook, now time.Time, logger Logger) error {
+	bucket, err := con.Bucket("webhook_deliveries")
+	if err != nil {
+		return err
+	}
+	// See RssMasterPollFeeds for where this number comes from.
+	keys, err := bucket.IndexQueryRange(NextAttemptIndexName, "-62135596800", strconv.FormatInt(now.Unix(), 10))
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error)
+	limit := make(chan bool, WebhookDeliveryConcurrency)
+	for _, key := range keys {
+		go func(key string) {
+			limit <- true
+			defer func() { <-limit }()
+			errCh <- attemptWebhookDelivery(con, client, hooks, key, now, logger)
+		}(key)
+	}
+
+	var errs []error
+	drainErrorChannelIntoSlice(errCh, &errs, len(keys))
+	if len(errs) != 0 {
+		return MultiError(errs)
+	}
+	return nil
+}
+
+type webhookCache struct {
+	lock     sync.Mutex
+	hooks    map[string]*Webhook
+	loadedAt time.Time
+}
+
+func (c *webhookCache) get(con *riak.Client) (map[string]*Webhook, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.hooks == nil || time.Since(c.loadedAt) > WebhookCacheTime {
+		hooks, err := LoadWebhooks(con)
+		if err != nil {
+			return nil, err
+		}
+		c.hooks = hooks
+		c.loadedAt = time.Now()
+	}
+	return c.hooks, nil
+}
+
+// WebhookDispatcher sends every newly inserted item to the registered webhooks.  New registrations
+// are noticed within WebhookCacheTime.
+type WebhookDispatcher struct {
+	con    *riak.Client
+	client *http.Client
+	master RssMaster
+	sub    *ItemSubscription
+	hooks  webhookCache
+
+	pokeCh chan bool
+	stopCh chan bool
+}
+
+func NewWebhookDispatcher(con *riak.Client, master RssMaster) *WebhookDispatcher {
+	dispatcher := &WebhookDispatcher{
+		con:    con,
+		client: &http.Client{Timeout: 30 * time.Second},
+		master: master,
+		// Block, since every item must at least make it into the queue.
+		sub: master.Subscribe(100, Block),
+
+		pokeCh: make(chan bool, 1),
+		stopCh: make(chan bool),
+	}
+
+	go dispatcher.queueEvents()
+	go dispatcher.deliver()
+
+	return dispatcher
+}
+
+func (d *WebhookDispatcher) Stop() {
+	d.master.Unsubscribe(d.sub)
+	close(d.stopCh)
+}
+
+func (d *WebhookDispatcher) queueEvents() {
+	for event := range d.sub.Events {
+		if event.Type != NewItem {
+			continue
+		}
+
+		hooks, err := d.hooks.get(d.con)
+		if err != nil {
+			d.master.logger.Log(LogError, "Failed to load webhooks", ErrorField(err))
+			continue
+		}
+		if err := enqueueWebhookDeliveries(d.con, hooks, event, time.Now()); err != nil {
+			d.master.logger.Log(LogError, "Failed to queue webhook deliveries", FeedField(event.FeedUrl), ErrorField(err))
+			continue
+		}
+
+		// Wake up the delivery loop, unless it has already been woken.
+		select {
+		case d.pokeCh <- true:
+		default:
+		}
+	}
+}
+
+func (d *WebhookDispatcher) deliver() {
+	tick := time.NewTicker(WebhookPollInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-d.stopCh:
+			return
+		case <-tick.C:
+		case <-d.pokeCh:
+		}
+
+		hooks, err := d.hooks.get(d.con)
+		if err != nil {
+			d.master.logger.Log(LogError, "Failed to load webhooks", ErrorField(err))
+			continue
+		}
+		if err := processDueWebhookDeliveries(d.con, d.client, hooks, time.Now(), d.master.logger); err != nil {
+			d.master.logger.Log(LogError, "Failed to process webhook deliveries", ErrorField(err))
+		}
+	}
+}
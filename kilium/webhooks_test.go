@@ -0,0 +1,219 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"io/ioutil"
+
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"sync"
+	"time"
+
+	"testing"
+
+	riak "github.com/tpjg/goriakpbc"
+)
+
+type testWebhookReceiver struct {
+	lock       sync.Mutex
+	status     int
+	secret     string
+	deliveries []string
+	badSigs    int
+}
+
+func (r *testWebhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !VerifyWebhookSignature(r.secret, body, req.Header.Get(WebhookSignatureHeader)) {
+		r.badSigs++
+	}
+	r.deliveries = append(r.deliveries, req.Header.Get(WebhookDeliveryHeader))
+	w.WriteHeader(r.status)
+}
+
+func (r *testWebhookReceiver) setStatus(status int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.status = status
+}
+
+func (r *testWebhookReceiver) count() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.deliveries)
+}
+
+func newTestWebhookReceiver(t *testing.T, status int) (*testWebhookReceiver, *httptest.Server, *url.URL) {
+	receiver := &testWebhookReceiver{status: status, secret: "Sekrit"}
+	server := httptest.NewServer(receiver)
+	Url, err := url.Parse(server.URL + "/hook")
+	if err != nil {
+		t.Fatalf("Failed to parse test server url (%s)", err)
+	}
+	return receiver, server, Url
+}
+
+func TestWebhookSignature(t *testing.T) {
+	payload := []byte(`{"event":"new"}`)
+	signature := SignWebhookPayload("secret", payload)
+
+	if !VerifyWebhookSignature("secret", payload, signature) {
+		t.Errorf("Signature failed to verify (%s)", signature)
+	}
+	if VerifyWebhookSignature("other secret", payload, signature) {
+		t.Error("Signature verified with the wrong secret")
+	}
+	if VerifyWebhookSignature("secret", []byte(`{"event":"deleted"}`), signature) {
+		t.Error("Signature verified with the wrong payload")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	if webhookBackoff(1) != WebhookInitialBackoff {
+		t.Errorf("First retry should wait the initial backoff, waits %v", webhookBackoff(1))
+	}
+	if webhookBackoff(3) != 4*WebhookInitialBackoff {
+		t.Errorf("Third retry should wait 4 times the initial backoff, waits %v", webhookBackoff(3))
+	}
+	if webhookBackoff(MaximumWebhookAttempts) != WebhookMaximumBackoff {
+		t.Errorf("Backoff isn't capped, waits %v", webhookBackoff(MaximumWebhookAttempts))
+	}
+}
+
+func TestWebhookMatches(t *testing.T) {
+	feedA, _ := url.Parse("http://example.com/a.rss")
+	feedB, _ := url.Parse("http://example.com/b.rss")
+	item := &FeedItem{Categories: []string{"Go", "Riak"}}
+
+	if !(&Webhook{}).Matches(*feedA, item) {
+		t.Error("Unfiltered webhook didn't match")
+	}
+	if !(&Webhook{FeedUrls: []url.URL{*feedA}}).Matches(*feedA, item) {
+		t.Error("Feed filtered webhook didn't match its feed")
+	}
+	if (&Webhook{FeedUrls: []url.URL{*feedA}}).Matches(*feedB, item) {
+		t.Error("Feed filtered webhook matched another feed")
+	}
+	if !(&Webhook{Categories: []string{"riak"}}).Matches(*feedB, item) {
+		t.Error("Category filtered webhook didn't match its category")
+	}
+	if (&Webhook{Categories: []string{"Rust"}}).Matches(*feedB, item) {
+		t.Error("Category filtered webhook matched another category")
+	}
+	if (&Webhook{FeedUrls: []url.URL{*feedA}, Categories: []string{"Go"}}).Matches(*feedB, item) {
+		t.Error("Webhook matched with only its category filter passing")
+	}
+}
+
+func TestDeliverWebhook(t *testing.T) {
+	receiver, server, Url := newTestWebhookReceiver(t, http.StatusOK)
+	defer server.Close()
+
+	hook := &Webhook{Url: *Url, Secret: receiver.secret}
+	if err := deliverWebhook(http.DefaultClient, hook, "Delivery", []byte(`{}`)); err != nil {
+		t.Errorf("Failed to deliver webhook (%s)", err)
+	}
+	if receiver.count() != 1 || receiver.deliveries[0] != "Delivery" || receiver.badSigs != 0 {
+		t.Errorf("Receiver didn't get a correctly signed delivery (%+v)", receiver)
+	}
+
+	receiver.setStatus(http.StatusInternalServerError)
+	if err := deliverWebhook(http.DefaultClient, hook, "Delivery", []byte(`{}`)); err == nil {
+		t.Error("Failed delivery didn't return an error")
+	}
+}
+
+func TestWebhookDeliveryQueue(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	goodReceiver, goodServer, goodUrl := newTestWebhookReceiver(t, http.StatusNoContent)
+	defer goodServer.Close()
+	badReceiver, badServer, badUrl := newTestWebhookReceiver(t, http.StatusServiceUnavailable)
+	defer badServer.Close()
+
+	if err := SaveWebhook(con, Webhook{Url: *goodUrl, Secret: goodReceiver.secret}); err != nil {
+		t.Fatalf("Failed to register webhook (%s)", err)
+	}
+	if err := SaveWebhook(con, Webhook{Url: *badUrl, Secret: badReceiver.secret}); err != nil {
+		t.Fatalf("Failed to register webhook (%s)", err)
+	}
+	hooks, err := LoadWebhooks(con)
+	if err != nil {
+		t.Fatalf("Failed to load webhooks (%s)", err)
+	} else if len(hooks) != 2 {
+		t.Fatalf("Expected 2 webhooks, got %v", len(hooks))
+	}
+
+	feedUrl := getUniqueExampleComUrl(t)
+	itemKey := NewItemKey(1, makeHash("Webhook item"+key_uniquer))
+	if err := InsertItem(con, "", itemKey, ParsedFeedItem{Title: "Hooked"}); err != nil {
+		t.Fatalf("Failed to insert item (%s)", err)
+	}
+
+	now := time.Now()
+	event := ItemEvent{Type: NewItem, FeedUrl: *feedUrl, ItemKey: itemKey}
+	if err := enqueueWebhookDeliveries(con, hooks, event, now); err != nil {
+		t.Fatalf("Failed to queue deliveries (%s)", err)
+	}
+	// Queueing twice must not deliver twice.
+	if err := enqueueWebhookDeliveries(con, hooks, event, now); err != nil {
+		t.Fatalf("Failed to re-queue deliveries (%s)", err)
+	}
+
+	if err := processDueWebhookDeliveries(con, http.DefaultClient, hooks, now, DefaultLogger); err != nil {
+		t.Fatalf("Failed to process deliveries (%s)", err)
+	}
+	if goodReceiver.count() != 1 || badReceiver.count() != 1 {
+		t.Errorf("Expected one delivery each, got %v and %v", goodReceiver.count(), badReceiver.count())
+	}
+
+	// The successful delivery is gone, the failed one is waiting for a retry.
+	goodDelivery := &WebhookDelivery{}
+	if err := con.LoadModel(webhookDeliveryKey(hooks[(&Webhook{Url: *goodUrl}).UrlKey()], itemKey), goodDelivery); err != riak.NotFound {
+		t.Errorf("Successful delivery is still queued (%v)", err)
+	}
+	badDelivery := &WebhookDelivery{}
+	if err := con.LoadModel(webhookDeliveryKey(hooks[(&Webhook{Url: *badUrl}).UrlKey()], itemKey), badDelivery); err != nil {
+		t.Errorf("Failed delivery isn't queued (%s)", err)
+	} else if badDelivery.Attempts != 1 || !badDelivery.NextAttempt.After(now) {
+		t.Errorf("Failed delivery wasn't rescheduled (%+v)", badDelivery)
+	}
+
+	// Nothing is due yet, so nothing should be sent.
+	if err := processDueWebhookDeliveries(con, http.DefaultClient, hooks, now, DefaultLogger); err != nil {
+		t.Fatalf("Failed to process deliveries (%s)", err)
+	}
+	if badReceiver.count() != 1 {
+		t.Errorf("Retry happened before the backoff expired")
+	}
+
+	// Once recovered, the retry goes through.
+	badReceiver.setStatus(http.StatusOK)
+	if err := processDueWebhookDeliveries(con, http.DefaultClient, hooks, now.Add(WebhookInitialBackoff+time.Second), DefaultLogger); err != nil {
+		t.Fatalf("Failed to process deliveries (%s)", err)
+	}
+	if badReceiver.count() != 2 || badReceiver.badSigs != 0 {
+		t.Errorf("Retry wasn't delivered correctly (%+v)", badReceiver)
+	}
+}
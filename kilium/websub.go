@@ -0,0 +1,341 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+
+	"encoding/hex"
+
+	"fmt"
+	"hash"
+
+	"io"
+	"io/ioutil"
+
+	"net/http"
+	"net/url"
+
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	riak "github.com/tpjg/goriakpbc"
+)
+
+const (
+	// The lease asked of hubs.  Hubs are free to pick something else.
+	WebSubLeaseSeconds = 7 * 24 * 60 * 60
+	// While subscribed, feeds are still polled this often in case the hub misses something.
+	WebSubPollInterval = 24 * time.Hour
+	// How long to wait before trying to subscribe again after a failure, or after a request is sent
+	// but not yet verified.
+	WebSubRetryInterval = time.Hour
+	// How often feeds are checked for subscriptions needing renewal.
+	WebSubRenewCheckInterval = time.Minute
+	// Largest pushed body accepted.
+	MaximumWebSubContentLength = 10 << 20
+)
+
+// Picks up any change to the hub advertised by the feed, and backs off polling while a lease is held.
+// Once the lease expires without renewal the regular check time from the feed is used again.
+func updateFeedWebSub(feed *Feed, feedData ParsedFeedData) {
+	topic := feedData.SelfUrl
+	if topic.String() == "" {
+		topic = feed.Url
+	}
+	if feedData.HubUrl.String() == "" {
+		topic = url.URL{}
+	}
+
+	if feed.Hub.String() != feedData.HubUrl.String() || feed.Topic.String() != topic.String() {
+		// New or changed hub, so any existing subscription is useless.  Subscribe again right away.
+		feed.Hub = feedData.HubUrl
+		feed.Topic = topic
+		feed.WebSubSecret = ""
+		feed.WebSubLeaseExpires = time.Time{}
+		feed.WebSubRenewAt = time.Time{}
+		feed.WebSubUpdated = feedData.FetchedAt
+	}
+
+	if feed.Hub.String() != "" && feed.WebSubLeaseExpires.After(feedData.FetchedAt) {
+		nextCheck := feedData.FetchedAt.Add(WebSubPollInterval)
+		if feed.WebSubLeaseExpires.Before(nextCheck) {
+			nextCheck = feed.WebSubLeaseExpires
+		}
+		if nextCheck.After(feed.NextCheck) {
+			feed.NextCheck = nextCheck
+		}
+	}
+}
+
+// Checks an X-Hub-Signature header of the form "method=hexdigest" against body.
+func checkWebSubSignature(secret string, body []byte, signature string) bool {
+	parts := strings.SplitN(signature, "=", 2)
+	if secret == "" || len(parts) != 2 {
+		return false
+	}
+
+	var hasher func() hash.Hash
+	switch parts[0] {
+	case "sha1":
+		hasher = sha1.New
+	case "sha256":
+		hasher = sha256.New
+	case "sha384":
+		hasher = sha512.New384
+	case "sha512":
+		hasher = sha512.New
+	default:
+		return false
+	}
+
+	expected, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(hasher, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+func newWebSubSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// WebSubSubscriber subscribes to the hubs advertised by feeds, and serves the callback hubs talk to.
+// Pushed content goes straight into the parser.  It must be served at the callback url given to
+// NewWebSubSubscriber, with the feed's key appended as the final path element.
+type WebSubSubscriber struct {
+	con      *riak.Client
+	callback url.URL
+	client   *http.Client
+	pushCh   chan<- RawFeed
+	logger   Logger
+
+	stopCh chan bool
+}
+
+func newWebSubSubscriber(con *riak.Client, callback url.URL, pushCh chan<- RawFeed) *WebSubSubscriber {
+	return &WebSubSubscriber{
+		con:      con,
+		callback: callback,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		pushCh:   pushCh,
+		logger:   DefaultLogger,
+
+		stopCh: make(chan bool),
+	}
+}
+
+// Starts subscribing to hubs for master's feeds.  callback is the public url the returned handler is
+// reachable at.
+func NewWebSubSubscriber(con *riak.Client, master RssMaster, callback url.URL) *WebSubSubscriber {
+	subscriber := newWebSubSubscriber(con, callback, master.pipeline.pushCh)
+	subscriber.logger = master.logger
+	go subscriber.renewSubscriptions()
+	return subscriber
+}
+
+func (s *WebSubSubscriber) Stop() {
+	close(s.stopCh)
+}
+
+func (s *WebSubSubscriber) callbackFor(feed *Feed) string {
+	callback := s.callback
+	callback.Path = strings.TrimSuffix(callback.Path, "/") + "/" + feed.UrlKey()
+	return callback.String()
+}
+
+func (s *WebSubSubscriber) renewSubscriptions() {
+	tick := time.NewTicker(WebSubRenewCheckInterval)
+	defer tick.Stop()
+
+	for {
+		if err := s.renewDueSubscriptions(time.Now()); err != nil {
+			s.logger.Log(LogError, "Failed to renew WebSub subscriptions", ErrorField(err))
+		}
+
+		select {
+		case <-s.stopCh:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func (s *WebSubSubscriber) renewDueSubscriptions(now time.Time) error {
+	bucket, err := s.con.Bucket("feeds")
+	if err != nil {
+		return err
+	}
+	// See RssMasterPollFeeds for where this number comes from.
+	keys, err := bucket.IndexQueryRange(WebSubRenewIndexName, "-62135596800", strconv.FormatInt(now.Unix(), 10))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, key := range keys {
+		feed := &Feed{}
+		if err := s.con.LoadModel(key, feed); err != nil {
+			errs = append(errs, err)
+		} else if feed.Hub.String() != "" && !feed.WebSubRenewAt.After(now) {
+			if err := s.subscribe(feed, now); err != nil {
+				errs = append(errs, FeedError{err, feed.Url})
+			}
+		}
+	}
+
+	if len(errs) != 0 {
+		return MultiError(errs)
+	}
+	return nil
+}
+
+// Asks the feed's hub for a subscription.  The lease is only recorded once the hub verifies the
+// request through the callback, so until then the request is retried every WebSubRetryInterval.
+func (s *WebSubSubscriber) subscribe(feed *Feed, now time.Time) error {
+	// Renewals keep the old secret, so content pushed while renewing still verifies.
+	if feed.WebSubSecret == "" {
+		secret, err := newWebSubSecret()
+		if err != nil {
+			return err
+		}
+		feed.WebSubSecret = secret
+	}
+
+	// Save before asking, as the hub may verify before it even answers.  Either way, don't try again
+	// until the retry interval passes.
+	feed.WebSubRenewAt = now.Add(WebSubRetryInterval)
+	feed.WebSubUpdated = now
+	feed.updateIndexes()
+	if err := feed.Save(); err != nil {
+		return err
+	}
+
+	resp, err := s.client.PostForm(feed.Hub.String(), url.Values{
+		"hub.callback":      {s.callbackFor(feed)},
+		"hub.mode":          {"subscribe"},
+		"hub.topic":         {feed.Topic.String()},
+		"hub.secret":        {feed.WebSubSecret},
+		"hub.lease_seconds": {strconv.Itoa(WebSubLeaseSeconds)},
+	})
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Hub refused subscription with status code %v", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *WebSubSubscriber) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	feed := &Feed{}
+	if err := s.con.LoadModel(path.Base(req.URL.Path), feed); err == riak.NotFound {
+		http.NotFound(w, req)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		s.verifyIntent(w, req, feed, time.Now())
+	case "POST":
+		s.receiveContent(w, req, feed, time.Now())
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *WebSubSubscriber) verifyIntent(w http.ResponseWriter, req *http.Request, feed *Feed, now time.Time) {
+	query := req.URL.Query()
+	if feed.Hub.String() == "" || query.Get("hub.topic") != feed.Topic.String() {
+		// Not something this feed wants (any more).
+		http.NotFound(w, req)
+		return
+	}
+
+	switch query.Get("hub.mode") {
+	case "subscribe":
+		if feed.WebSubSecret == "" {
+			http.NotFound(w, req) // Never asked for, or asked of a since replaced hub.
+			return
+		}
+		lease, err := strconv.Atoi(query.Get("hub.lease_seconds"))
+		if err != nil || lease <= 0 {
+			http.Error(w, "Missing lease", http.StatusBadRequest)
+			return
+		}
+		feed.WebSubLeaseExpires = now.Add(time.Duration(lease) * time.Second)
+		// Renew once 90% of the lease has passed.
+		feed.WebSubRenewAt = now.Add(time.Duration(lease) * time.Second * 9 / 10)
+	case "denied":
+		s.logger.Log(LogWarn, "WebSub hub denied subscription", FeedField(feed.Url), LogField{"hub", feed.Hub.String()}, LogField{"topic", feed.Topic.String()}, LogField{"reason", query.Get("hub.reason")})
+		feed.WebSubLeaseExpires = time.Time{}
+		feed.WebSubRenewAt = now.Add(WebSubRetryInterval)
+	default:
+		// Unsubscribing is never requested, so don't confirm it.
+		http.NotFound(w, req)
+		return
+	}
+
+	feed.WebSubUpdated = now
+	feed.updateIndexes()
+	if err := feed.Save(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, query.Get("hub.challenge"))
+}
+
+func (s *WebSubSubscriber) receiveContent(w http.ResponseWriter, req *http.Request, feed *Feed, now time.Time) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, MaximumWebSubContentLength))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Hubs are told everything is fine even for bad signatures, as the spec requires.  The content is
+	// just ignored.
+	w.WriteHeader(http.StatusAccepted)
+
+	if !checkWebSubSignature(feed.WebSubSecret, body, req.Header.Get("X-Hub-Signature")) {
+		s.logger.Log(LogWarn, "Ignoring WebSub content with a bad signature", FeedField(feed.Url))
+		return
+	}
+
+	go func(raw RawFeed) {
+		s.pushCh <- raw
+	}(RawFeed{Data: body, Url: feed.Url, FetchedAt: now, Pushed: true})
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kilium
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"strings"
+	"time"
+
+	"testing"
+)
+
+func signWebSubTestBody(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestCheckWebSubSignature(t *testing.T) {
+	body := "<feed></feed>"
+	signature := signWebSubTestBody("secret", body)
+
+	if !checkWebSubSignature("secret", []byte(body), signature) {
+		t.Errorf("Valid signature failed (%s)", signature)
+	}
+	if checkWebSubSignature("", []byte(body), signature) {
+		t.Error("Signature passed without a secret")
+	}
+	if checkWebSubSignature("wrong", []byte(body), signature) {
+		t.Error("Signature passed with the wrong secret")
+	}
+	if checkWebSubSignature("secret", []byte(body), "md5="+signature[7:]) {
+		t.Error("Signature passed with an unknown method")
+	}
+	if checkWebSubSignature("secret", []byte(body), "sha256=zz") {
+		t.Error("Signature passed with a garbage digest")
+	}
+}
+
+func TestUpdateFeedWebSub(t *testing.T) {
+	feedUrl, _ := url.Parse("http://example.com/feed.rss")
+	hubUrl, _ := url.Parse("http://hub.example.com/")
+	selfUrl, _ := url.Parse("https://example.com/feed.rss")
+	fetchedAt := time.Date(2013, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	feed := &Feed{Url: *feedUrl, WebSubRenewAt: fetchedAt}
+	data := ParsedFeedData{HubUrl: *hubUrl, FetchedAt: fetchedAt, NextCheckTime: fetchedAt.Add(time.Hour)}
+	feed.NextCheck = data.NextCheckTime
+	updateFeedWebSub(feed, data)
+	if feed.Hub != *hubUrl || feed.Topic != *feedUrl || !feed.WebSubRenewAt.IsZero() {
+		t.Errorf("Newly advertised hub wasn't picked up (%+v)", feed)
+	}
+
+	// Self links take over from the feed's url.
+	data.SelfUrl = *selfUrl
+	updateFeedWebSub(feed, data)
+	if feed.Topic != *selfUrl {
+		t.Errorf("Self link isn't used as the topic (%+v)", feed.Topic)
+	}
+
+	// While leased, polling slows down.
+	feed.WebSubSecret = "secret"
+	feed.WebSubLeaseExpires = fetchedAt.Add(2 * WebSubPollInterval)
+	updateFeedWebSub(feed, data)
+	if !feed.NextCheck.Equal(fetchedAt.Add(WebSubPollInterval)) {
+		t.Errorf("Leased feed isn't polled at the WebSub interval (%v)", feed.NextCheck)
+	}
+
+	// But not past the end of the lease.
+	feed.NextCheck = data.NextCheckTime
+	feed.WebSubLeaseExpires = fetchedAt.Add(2 * time.Hour)
+	updateFeedWebSub(feed, data)
+	if !feed.NextCheck.Equal(feed.WebSubLeaseExpires) {
+		t.Errorf("Leased feed isn't polled when its lease expires (%v)", feed.NextCheck)
+	}
+
+	// Once expired, polling goes back to normal.
+	feed.NextCheck = data.NextCheckTime
+	feed.WebSubLeaseExpires = fetchedAt.Add(-time.Hour)
+	updateFeedWebSub(feed, data)
+	if !feed.NextCheck.Equal(data.NextCheckTime) {
+		t.Errorf("Expired lease still changes polling (%v)", feed.NextCheck)
+	}
+	if feed.WebSubSecret != "secret" {
+		t.Error("Unchanged hub lost its subscription")
+	}
+
+	// A removed hub drops everything.
+	data.HubUrl = url.URL{}
+	updateFeedWebSub(feed, data)
+	if feed.Hub.String() != "" || feed.Topic.String() != "" || feed.WebSubSecret != "" {
+		t.Errorf("Removed hub wasn't forgotten (%+v)", feed)
+	}
+}
+
+func TestWebSubSubscribeVerifyAndPush(t *testing.T) {
+	con := getTestConnection(t)
+	defer killTestDb(con, t)
+
+	pushCh := make(chan RawFeed, 1)
+	callback, _ := url.Parse("http://kilium.example.com/websub/")
+	subscriber := newWebSubSubscriber(con, *callback, pushCh)
+
+	// The hub verifies straight away, before answering.
+	var verifyResponse *httptest.ResponseRecorder
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		verify, _ := url.Parse(req.Form.Get("hub.callback"))
+		query := url.Values{
+			"hub.mode":          {req.Form.Get("hub.mode")},
+			"hub.topic":         {req.Form.Get("hub.topic")},
+			"hub.challenge":     {"Challenge accepted"},
+			"hub.lease_seconds": {"3600"},
+		}
+		verify.RawQuery = query.Encode()
+
+		verifyResponse = httptest.NewRecorder()
+		verifyReq, _ := http.NewRequest("GET", verify.String(), nil)
+		subscriber.ServeHTTP(verifyResponse, verifyReq)
+
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer hub.Close()
+
+	Url := getUniqueExampleComUrl(t)
+	if err := RssMasterHandleAddRequest(con, *Url); err != nil {
+		t.Fatalf("Failed to create feed (%s)", err)
+	}
+	feed := &Feed{Url: *Url}
+	if err := con.LoadModel(feed.UrlKey(), feed); err != nil {
+		t.Fatalf("Failed to load feed (%s)", err)
+	}
+	hubUrl, _ := url.Parse(hub.URL)
+	feed.Hub = *hubUrl
+	feed.Topic = *Url
+
+	now := time.Now()
+	if err := subscriber.subscribe(feed, now); err != nil {
+		t.Fatalf("Failed to subscribe (%s)", err)
+	}
+	if verifyResponse == nil || verifyResponse.Code != http.StatusOK || verifyResponse.Body.String() != "Challenge accepted" {
+		t.Fatalf("Verification of intent failed (%+v)", verifyResponse)
+	}
+
+	if err := con.LoadModel(feed.UrlKey(), feed); err != nil {
+		t.Fatalf("Failed to reload feed (%s)", err)
+	}
+	if feed.WebSubSecret == "" || !feed.WebSubLeaseExpires.After(now.Add(59*time.Minute)) || !feed.WebSubRenewAt.Before(feed.WebSubLeaseExpires) {
+		t.Errorf("Verified subscription wasn't recorded (%+v)", feed)
+	}
+
+	// Now push some content, first unsigned, then signed.
+	body := "<rss></rss>"
+	for _, signature := range []string{"", signWebSubTestBody(feed.WebSubSecret, body)} {
+		push := httptest.NewRecorder()
+		pushReq, _ := http.NewRequest("POST", subscriber.callbackFor(feed), strings.NewReader(body))
+		pushReq.Header.Set("X-Hub-Signature", signature)
+		subscriber.ServeHTTP(push, pushReq)
+		if push.Code != http.StatusAccepted {
+			t.Errorf("Push wasn't accepted (%v)", push.Code)
+		}
+	}
+
+	select {
+	case raw := <-pushCh:
+		if string(raw.Data) != body || raw.Url != *Url || !raw.Pushed {
+			t.Errorf("Pushed content was mangled (%+v)", raw)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Signed content wasn't pushed into the parser")
+	}
+	select {
+	case raw := <-pushCh:
+		t.Errorf("Unsigned content was pushed into the parser (%+v)", raw)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,378 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kiliumapi
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+
+	"net/http"
+
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MJDSystems/kilium/kilium"
+	riak "github.com/tpjg/goriakpbc"
+)
+
+const (
+	FeverApiVersion = 3
+	// Fever always sends items in pages of 50.
+	feverPageSize = 50
+)
+
+type feverGroupJSON struct {
+	Id    uint32 `json:"id"`
+	Title string `json:"title"`
+}
+
+type feverFeedsGroupJSON struct {
+	GroupId uint32 `json:"group_id"`
+	FeedIds string `json:"feed_ids"`
+}
+
+type feverFeedJSON struct {
+	Id                uint32 `json:"id"`
+	FaviconId         int    `json:"favicon_id"`
+	Title             string `json:"title"`
+	Url               string `json:"url"`
+	SiteUrl           string `json:"site_url"`
+	IsSpark           int    `json:"is_spark"`
+	LastUpdatedOnTime int64  `json:"last_updated_on_time"`
+}
+
+type feverItemJSON struct {
+	Id            uint64 `json:"id"`
+	FeedId        uint32 `json:"feed_id"`
+	Title         string `json:"title"`
+	Author        string `json:"author"`
+	Html          string `json:"html"`
+	Url           string `json:"url"`
+	IsSaved       int    `json:"is_saved"`
+	IsRead        int    `json:"is_read"`
+	CreatedOnTime int64  `json:"created_on_time"`
+}
+
+// FeverServer speaks the Fever API, for the users stored in riak.  Everything goes through a single
+// endpoint taking api, api_key, and then flags for what to return or change:
+//
+//	groups, feeds            The user's folders and subscriptions.
+//	items                    Up to 50 items, after since_id, before max_id, or the ones in with_ids.
+//	unread_item_ids          Every unread item's id.
+//	saved_item_ids           Every starred item's id.
+//	mark, as, id, before     Marks an item read, unread, saved or unsaved, or a feed or group read.
+//
+// Item ids are the ids in the items' keys.  Feed and group ids are made from hashes of the feed's key
+// and folder's name, since Fever needs them to be numbers.
+type FeverServer struct {
+	con *riak.Client
+}
+
+func NewFeverServer(con *riak.Client) *FeverServer {
+	return &FeverServer{con: con}
+}
+
+// Fever ids are plain numbers, so hash names down to positive 32 bit numbers.
+func feverId(name string) uint32 {
+	hash := md5.Sum([]byte(name))
+	return binary.BigEndian.Uint32(hash[:]) >> 1
+}
+
+func feverBool(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func feverIdList(ids []uint64) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.FormatUint(id, 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *FeverServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := req.Form["api"]; !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	response := map[string]interface{}{"api_version": FeverApiVersion, "auth": 0}
+
+	user, err := kilium.FindUserByFeverKey(f.con, strings.ToLower(req.Form.Get("api_key")))
+	if err == kilium.UserNotFound {
+		writeJSON(w, http.StatusOK, response)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	response["auth"] = 1
+
+	feeds, err := loadUserFeeds(f.con, user, func(kilium.Subscription) bool { return true })
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var lastRefreshed time.Time
+	for _, feed := range feeds.feeds {
+		if feed.LastCheck.After(lastRefreshed) {
+			lastRefreshed = feed.LastCheck
+		}
+	}
+	response["last_refreshed_on_time"] = lastRefreshed.Unix()
+
+	// Marking comes first, so anything returned reflects it.
+	if req.Form.Get("mark") != "" {
+		if err := f.mark(req, feeds); err != nil {
+			writeError(w, feverErrorStatus(err), err)
+			return
+		}
+		// Marked state is saved, so reload it.
+		if feeds, err = loadUserFeeds(f.con, user, func(kilium.Subscription) bool { return true }); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if _, ok := req.Form["groups"]; ok {
+		response["groups"] = f.groups(feeds)
+		response["feeds_groups"] = f.feedsGroups(feeds)
+	}
+	if _, ok := req.Form["feeds"]; ok {
+		response["feeds"] = f.feeds(feeds)
+		response["feeds_groups"] = f.feedsGroups(feeds)
+	}
+	if _, ok := req.Form["items"]; ok {
+		items, total, err := f.items(req, feeds)
+		if err != nil {
+			writeError(w, feverErrorStatus(err), err)
+			return
+		}
+		response["items"] = items
+		response["total_items"] = total
+	}
+	if _, ok := req.Form["unread_item_ids"]; ok {
+		response["unread_item_ids"] = f.itemIds(feeds, func(state *kilium.UserFeedState, key kilium.ItemKey) bool {
+			return !state.IsRead(key)
+		})
+	}
+	if _, ok := req.Form["saved_item_ids"]; ok {
+		response["saved_item_ids"] = f.itemIds(feeds, (*kilium.UserFeedState).IsStarred)
+	}
+	if _, ok := req.Form["favicons"]; ok {
+		response["favicons"] = []struct{}{}
+	}
+	if _, ok := req.Form["links"]; ok {
+		response["links"] = []struct{}{}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (f *FeverServer) groups(feeds *userFeeds) []feverGroupJSON {
+	groups := []feverGroupJSON{}
+	seen := make(map[string]bool)
+	for _, sub := range feeds.subs {
+		if sub.Folder != "" && !seen[sub.Folder] {
+			seen[sub.Folder] = true
+			groups = append(groups, feverGroupJSON{feverId(sub.Folder), sub.Folder})
+		}
+	}
+	return groups
+}
+
+func (f *FeverServer) feedsGroups(feeds *userFeeds) []feverFeedsGroupJSON {
+	var folders []string
+	members := make(map[string][]uint64)
+	for i, sub := range feeds.subs {
+		if sub.Folder == "" {
+			continue
+		}
+		if _, ok := members[sub.Folder]; !ok {
+			folders = append(folders, sub.Folder)
+		}
+		members[sub.Folder] = append(members[sub.Folder], uint64(feverId(feeds.keys[i])))
+	}
+
+	ret := make([]feverFeedsGroupJSON, len(folders))
+	for i, folder := range folders {
+		ret[i] = feverFeedsGroupJSON{feverId(folder), feverIdList(members[folder])}
+	}
+	return ret
+}
+
+func (f *FeverServer) feeds(feeds *userFeeds) []feverFeedJSON {
+	ret := make([]feverFeedJSON, len(feeds.feeds))
+	for i, feed := range feeds.feeds {
+		title := feeds.subs[i].Title
+		if title == "" {
+			title = feed.Title
+		}
+		ret[i] = feverFeedJSON{
+			Id:                feverId(feeds.keys[i]),
+			Title:             title,
+			Url:               feed.Url.String(),
+			SiteUrl:           feed.Url.String(),
+			LastUpdatedOnTime: feed.LastCheck.Unix(),
+		}
+	}
+	return ret
+}
+
+// A mistake in what the client sent, as opposed to a failure to load or store what it asked for.
+type feverRequestError struct {
+	error
+}
+
+// Bad requests are the client's fault, and anything else is the server's.
+func feverErrorStatus(err error) int {
+	if _, ok := err.(feverRequestError); ok {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func (f *FeverServer) items(req *http.Request, feeds *userFeeds) ([]feverItemJSON, int, error) {
+	total := 0
+	for _, feed := range feeds.feeds {
+		total += len(feed.ItemKeys)
+	}
+
+	var keys kilium.RiverKeyList
+	everything := func(kilium.RiverKey) bool { return true }
+	if withIds := req.Form.Get("with_ids"); withIds != "" {
+		for _, param := range strings.Split(withIds, ",") {
+			id, err := strconv.ParseUint(param, 10, 64)
+			if err != nil {
+				return nil, 0, feverRequestError{err}
+			}
+			if key, ok := feeds.findId(id); ok {
+				keys = append(keys, key)
+			}
+		}
+	} else if sinceId := req.Form.Get("since_id"); sinceId != "" {
+		id, err := strconv.ParseUint(sinceId, 10, 64)
+		if err != nil {
+			return nil, 0, feverRequestError{err}
+		}
+		// Every key with a bigger id sorts above the first key for the next id.
+		keys, _ = kilium.FilterRiverKeys(feeds.feeds, kilium.NewItemKey(id+1, nil), kilium.Newer, feverPageSize, everything)
+	} else {
+		var cursor kilium.ItemKey
+		if maxId := req.Form.Get("max_id"); maxId != "" {
+			id, err := strconv.ParseUint(maxId, 10, 64)
+			if err != nil {
+				return nil, 0, feverRequestError{err}
+			}
+			cursor = kilium.NewItemKey(id, nil)
+		}
+		keys, _ = kilium.FilterRiverKeys(feeds.feeds, cursor, kilium.Older, feverPageSize, everything)
+	}
+
+	keys, items, err := feeds.loadItems(f.con, keys)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ret := make([]feverItemJSON, len(items))
+	for i, item := range items {
+		key := keys[i]
+		ret[i] = feverItemJSON{
+			Id:            key.ItemKey.Id(),
+			FeedId:        feverId(feeds.keys[key.Feed]),
+			Title:         item.Title,
+			Author:        item.Author,
+			Html:          item.Content,
+			Url:           item.Url.String(),
+			IsSaved:       feverBool(feeds.states[key.Feed].IsStarred(key.ItemKey)),
+			IsRead:        feverBool(feeds.states[key.Feed].IsRead(key.ItemKey)),
+			CreatedOnTime: itemTime(key.ItemKey, item).Unix(),
+		}
+	}
+	return ret, total, nil
+}
+
+func (f *FeverServer) itemIds(feeds *userFeeds, include func(*kilium.UserFeedState, kilium.ItemKey) bool) string {
+	var ids []uint64
+	for i, feed := range feeds.feeds {
+		for _, key := range feed.ItemKeys {
+			if include(feeds.states[i], key) {
+				ids = append(ids, key.Id())
+			}
+		}
+	}
+	return feverIdList(ids)
+}
+
+func (f *FeverServer) mark(req *http.Request, feeds *userFeeds) error {
+	name := feeds.user.Name
+	id, err := strconv.ParseUint(req.Form.Get("id"), 10, 64)
+	if err != nil {
+		return feverRequestError{err}
+	}
+
+	switch req.Form.Get("mark") {
+	case "item":
+		key, ok := feeds.findId(id)
+		if !ok {
+			return nil // Already gone.
+		}
+		feedKey, itemKeys := feeds.keys[key.Feed], kilium.ItemKeyList{key.ItemKey}
+
+		switch req.Form.Get("as") {
+		case "read":
+			return kilium.MarkItemsRead(f.con, name, feedKey, itemKeys, true)
+		case "unread":
+			return kilium.MarkItemsRead(f.con, name, feedKey, itemKeys, false)
+		case "saved":
+			return kilium.MarkItemsStarred(f.con, name, feedKey, itemKeys, true)
+		case "unsaved":
+			return kilium.MarkItemsStarred(f.con, name, feedKey, itemKeys, false)
+		}
+	case "feed", "group":
+		if req.Form.Get("as") != "read" {
+			return nil
+		}
+		before, err := strconv.ParseInt(req.Form.Get("before"), 10, 64)
+		if err != nil {
+			return feverRequestError{err}
+		}
+		// Items found before the time are all below the first key that could be made at it.
+		upTo := kilium.FirstItemKeyAt(time.Unix(before, 0))
+
+		for i, feedKey := range feeds.keys {
+			// Group 0 is every feed, as in Fever itself.
+			inGroup := id == 0 || uint64(feverId(feeds.subs[i].Folder)) == id && feeds.subs[i].Folder != ""
+			if req.Form.Get("mark") == "feed" && uint64(feverId(feedKey)) == id ||
+				req.Form.Get("mark") == "group" && inGroup {
+				if err := kilium.MarkFeedRead(f.con, name, feedKey, upTo); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kiliumapi
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+
+	"net/http"
+	"net/url"
+
+	"strconv"
+	"strings"
+	"time"
+
+	"testing"
+
+	"github.com/MJDSystems/kilium/kilium"
+)
+
+func TestFeverIds(t *testing.T) {
+	if feverId("News") != feverId("News") {
+		t.Error("Fever ids aren't stable")
+	}
+	if feverId("News") == feverId("Sports") {
+		t.Error("Different names gave the same fever id")
+	}
+	if feverIdList([]uint64{3, 2, 1}) != "3,2,1" {
+		t.Errorf("Wrong id list (%s)", feverIdList([]uint64{3, 2, 1}))
+	}
+}
+
+func TestFeverErrorStatus(t *testing.T) {
+	if status := feverErrorStatus(feverRequestError{errors.New("Bad id")}); status != http.StatusBadRequest {
+		t.Errorf("Client mistakes should be bad requests, not %v", status)
+	}
+	if status := feverErrorStatus(errors.New("Riak went away")); status != http.StatusInternalServerError {
+		t.Errorf("Storage failures should be server errors, not %v", status)
+	}
+}
+
+func TestFeverRequiresApi(t *testing.T) {
+	if w := doRequest(t, NewFeverServer(nil), "GET", "/?groups", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Request without api wasn't rejected (%v)", w.Code)
+	}
+}
+
+type feverTestResponse struct {
+	Auth          int
+	Groups        []feverGroupJSON
+	FeedsGroups   []feverFeedsGroupJSON `json:"feeds_groups"`
+	Feeds         []feverFeedJSON
+	Items         []feverItemJSON
+	TotalItems    int    `json:"total_items"`
+	UnreadItemIds string `json:"unread_item_ids"`
+	SavedItemIds  string `json:"saved_item_ids"`
+}
+
+func TestFeverServer(t *testing.T) {
+	con := getTestConnection(t)
+	server := NewFeverServer(con)
+
+	name := "fever" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if _, err := kilium.CreateUser(con, name, "password"); err != nil {
+		t.Fatalf("Failed to create user (%s)", err)
+	}
+	feedUrl, _ := url.Parse("http://example.com/" + name + ".rss")
+	if err := kilium.Subscribe(con, name, *feedUrl, "", "News"); err != nil {
+		t.Fatalf("Failed to subscribe (%s)", err)
+	}
+	feedKey := (&kilium.Feed{Url: *feedUrl}).UrlKey()
+	defer kilium.RssMasterHandleRemoveRequest(con, *feedUrl)
+
+	feed, err := kilium.LoadFeed(con, feedKey)
+	if err != nil {
+		t.Fatalf("Failed to load feed (%s)", err)
+	}
+	for i := 3; i > 0; i-- {
+		key := kilium.NewItemKey(uint64(i), []byte(name+strings.Repeat("-", i)))
+		if err := kilium.InsertItem(con, feedKey, key, kilium.ParsedFeedItem{Title: strings.Repeat("I", i)}); err != nil {
+			t.Fatalf("Failed to insert item (%s)", err)
+		}
+		feed.ItemKeys = append(feed.ItemKeys, key)
+	}
+	if err := feed.Save(); err != nil {
+		t.Fatalf("Failed to save feed (%s)", err)
+	}
+
+	hash := md5.Sum([]byte(name + ":password"))
+	apiKey := hex.EncodeToString(hash[:])
+	request := func(query, body string) feverTestResponse {
+		var response feverTestResponse
+		req, _ := http.NewRequest("POST", "/?api&"+query, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		decodeResponse(t, serve(server, req), &response)
+		return response
+	}
+
+	if response := request("groups", "api_key=wrong"); response.Auth != 0 {
+		t.Errorf("Wrong key was accepted (%+v)", response)
+	}
+
+	response := request("groups&feeds", "api_key="+apiKey)
+	if response.Auth != 1 || len(response.Groups) != 1 || response.Groups[0].Title != "News" || len(response.Feeds) != 1 {
+		t.Fatalf("Wrong groups and feeds (%+v)", response)
+	}
+	if len(response.FeedsGroups) != 1 || response.FeedsGroups[0].FeedIds != strconv.FormatUint(uint64(response.Feeds[0].Id), 10) {
+		t.Errorf("Wrong feeds in groups (%+v)", response.FeedsGroups)
+	}
+	feverFeedId := response.Feeds[0].Id
+
+	response = request("items&since_id=1", "api_key="+apiKey)
+	if response.TotalItems != 3 || len(response.Items) != 2 || response.Items[0].Id != 2 || response.Items[1].Id != 3 {
+		t.Errorf("Wrong items since id 1 (%+v)", response)
+	}
+	response = request("items&max_id=3", "api_key="+apiKey)
+	if len(response.Items) != 2 || response.Items[0].Id != 2 || response.Items[0].FeedId != feverFeedId {
+		t.Errorf("Wrong items before id 3 (%+v)", response)
+	}
+	// The items have no dates, so they go by when they were found.
+	if response.Items[0].CreatedOnTime != kilium.IdTimestamp(2).Unix() {
+		t.Errorf("Undated item has the wrong creation time (%+v)", response.Items[0])
+	}
+	badMark, _ := http.NewRequest("POST", "/?api", strings.NewReader("api_key="+apiKey+"&mark=item&as=read&id=bad"))
+	badMark.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if w := serve(server, badMark); w.Code != http.StatusBadRequest {
+		t.Errorf("Bad mark wasn't rejected (%v)", w.Code)
+	}
+
+	response = request("unread_item_ids&saved_item_ids", "api_key="+apiKey+"&mark=item&as=saved&id=2")
+	if response.UnreadItemIds != "3,2,1" || response.SavedItemIds != "2" {
+		t.Errorf("Wrong ids after saving (%+v)", response)
+	}
+	response = request("unread_item_ids", "api_key="+apiKey+"&mark=item&as=read&id=3")
+	if response.UnreadItemIds != "2,1" {
+		t.Errorf("Wrong unread ids after reading (%+v)", response)
+	}
+
+	before := strconv.FormatInt(time.Now().Unix(), 10)
+	response = request("unread_item_ids", "api_key="+apiKey+"&mark=group&as=read&id="+strconv.FormatUint(uint64(feverId("News")), 10)+"&before="+before)
+	if response.UnreadItemIds != "" {
+		t.Errorf("Marking the group read left unread items (%+v)", response)
+	}
+}
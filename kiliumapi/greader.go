@@ -0,0 +1,552 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kiliumapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"net/http"
+
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MJDSystems/kilium/kilium"
+	riak "github.com/tpjg/goriakpbc"
+)
+
+const (
+	greaderItemIdPrefix = "tag:google.com,2005:reader/item/"
+
+	greaderReadingList = "user/-/state/com.google/reading-list"
+	greaderRead        = "user/-/state/com.google/read"
+	greaderStarred     = "user/-/state/com.google/starred"
+	greaderLabelPrefix = "user/-/label/"
+	greaderFeedPrefix  = "feed/"
+)
+
+var greaderUnknownStream = errors.New("Unknown stream")
+
+type greaderLinkJSON struct {
+	Href string `json:"href"`
+	Type string `json:"type,omitempty"`
+}
+
+type greaderCategoryJSON struct {
+	Id    string `json:"id"`
+	Label string `json:"label"`
+}
+
+type greaderSubscriptionJSON struct {
+	Id         string                `json:"id"`
+	Title      string                `json:"title"`
+	Categories []greaderCategoryJSON `json:"categories"`
+	Url        string                `json:"url"`
+	HtmlUrl    string                `json:"htmlUrl"`
+	IconUrl    string                `json:"iconUrl"`
+}
+
+type greaderContentJSON struct {
+	Content string `json:"content"`
+}
+
+type greaderOriginJSON struct {
+	StreamId string `json:"streamId"`
+	Title    string `json:"title"`
+	HtmlUrl  string `json:"htmlUrl"`
+}
+
+type greaderItemJSON struct {
+	Id            string             `json:"id"`
+	CrawlTimeMsec string             `json:"crawlTimeMsec"`
+	TimestampUsec string             `json:"timestampUsec"`
+	Published     int64              `json:"published"`
+	Title         string             `json:"title"`
+	Author        string             `json:"author"`
+	Canonical     []greaderLinkJSON  `json:"canonical"`
+	Alternate     []greaderLinkJSON  `json:"alternate"`
+	Summary       greaderContentJSON `json:"summary"`
+	Categories    []string           `json:"categories"`
+	Origin        greaderOriginJSON  `json:"origin"`
+}
+
+type greaderStreamJSON struct {
+	Id           string            `json:"id"`
+	Updated      int64             `json:"updated"`
+	Items        []greaderItemJSON `json:"items"`
+	Continuation string            `json:"continuation,omitempty"`
+}
+
+type greaderItemRefJSON struct {
+	Id            string `json:"id"`
+	TimestampUsec string `json:"timestampUsec"`
+}
+
+type greaderItemIdsJSON struct {
+	ItemRefs     []greaderItemRefJSON `json:"itemRefs"`
+	Continuation string               `json:"continuation,omitempty"`
+}
+
+// GReaderServer speaks enough of the Google Reader API for existing clients to use kilium, for the
+// users stored in riak.
+//
+//	POST /accounts/ClientLogin                   Logs in with Email and Passwd.
+//	GET  /reader/api/0/token                     Gives the token edit-tag needs as T.
+//	GET  /reader/api/0/subscription/list         Lists the user's subscriptions.
+//	GET  /reader/api/0/stream/contents/{stream}  Pages through a stream's items.
+//	GET  /reader/api/0/stream/items/ids          Pages through the ids of stream s's items.
+//	POST /reader/api/0/stream/items/contents     Gets the items with ids i.
+//	POST /reader/api/0/edit-tag                  Adds tag a to, or removes tag r from, items i.
+//
+// Streams are the reading list, starred items, a folder as a label, or a single feed.  Item ids are
+// the ids in the items' keys.  Logins give a token derived from secret and the user's password, so
+// changing the password logs out every client.
+type GReaderServer struct {
+	con    *riak.Client
+	secret []byte
+}
+
+func NewGReaderServer(con *riak.Client, secret []byte) *GReaderServer {
+	return &GReaderServer{con: con, secret: secret}
+}
+
+// Routed by hand, since stream ids are urls and would get cleaned up by a ServeMux.
+func (g *GReaderServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/accounts/ClientLogin" {
+		g.handleClientLogin(w, req)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/reader/api/0/")
+	if path == req.URL.Path {
+		http.NotFound(w, req)
+		return
+	}
+
+	user := g.authenticate(req)
+	if user == nil {
+		w.Header().Set("Google-Bad-Token", "true")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case path == "token":
+		fmt.Fprint(w, g.actionToken(user))
+	case path == "subscription/list":
+		g.handleSubscriptionList(w, req, user)
+	case strings.HasPrefix(path, "stream/contents"):
+		streamId := strings.TrimPrefix(strings.TrimPrefix(path, "stream/contents"), "/")
+		if streamId == "" {
+			streamId = req.Form.Get("s")
+		}
+		if streamId == "" {
+			streamId = greaderReadingList
+		}
+		g.handleStreamContents(w, req, user, streamId)
+	case path == "stream/items/ids":
+		g.handleStreamItemIds(w, req, user)
+	case path == "stream/items/contents":
+		g.handleStreamItemContents(w, req, user)
+	case path == "edit-tag":
+		g.handleEditTag(w, req, user)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (g *GReaderServer) mac(parts ...[]byte) string {
+	mac := hmac.New(sha256.New, g.secret)
+	for _, part := range parts {
+		mac.Write(part)
+		mac.Write([]byte{0})
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Tokens are the user's name and a mac over it and the password hash.
+func (g *GReaderServer) authToken(user *kilium.User) string {
+	return user.Name + "/" + g.mac([]byte("auth"), []byte(user.Name), user.PasswordHash)
+}
+
+func (g *GReaderServer) actionToken(user *kilium.User) string {
+	return g.mac([]byte("action"), []byte(user.Name), user.PasswordHash)
+}
+
+// Finds the user behind the request's "GoogleLogin auth=" header, or nil.
+func (g *GReaderServer) authenticate(req *http.Request) *kilium.User {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "GoogleLogin auth=")
+	i := strings.LastIndex(token, "/")
+	if i == -1 {
+		return nil
+	}
+
+	user, err := kilium.LoadUser(g.con, token[:i])
+	if err != nil || !hmac.Equal([]byte(token), []byte(g.authToken(user))) {
+		return nil
+	}
+	return user
+}
+
+func (g *GReaderServer) handleClientLogin(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := req.Form.Get("Email")
+	if name == "" {
+		http.Error(w, "Error=BadAuthentication", http.StatusUnauthorized)
+		return
+	}
+	user, err := kilium.LoadUser(g.con, name)
+	if err != nil && err != kilium.UserNotFound {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if err == kilium.UserNotFound || !user.CheckPassword(req.Form.Get("Passwd")) {
+		http.Error(w, "Error=BadAuthentication", http.StatusUnauthorized)
+		return
+	}
+
+	token := g.authToken(user)
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "SID=%s\nLSID=null\nAuth=%s\n", token, token)
+}
+
+func greaderItemId(key kilium.ItemKey) string {
+	return fmt.Sprintf("%s%016x", greaderItemIdPrefix, key.Id())
+}
+
+// Ids hold the time items were found, which stands in for their timestamp where the items themselves
+// aren't loaded.
+func greaderIdTimestampUsec(id uint64) string {
+	return strconv.FormatInt(kilium.IdTimestamp(id).UnixNano()/int64(time.Microsecond), 10)
+}
+
+// Ids come either in the long form, in hex, or as a signed decimal.
+func parseGReaderItemId(id string) (uint64, error) {
+	if strings.HasPrefix(id, greaderItemIdPrefix) {
+		return strconv.ParseUint(strings.TrimPrefix(id, greaderItemIdPrefix), 16, 64)
+	}
+	signed, err := strconv.ParseInt(id, 10, 64)
+	return uint64(signed), err
+}
+
+// Stream ids can name the user explicitly, which is always the current user here.
+func normalizeStreamId(streamId string) string {
+	if strings.HasPrefix(streamId, "user/") {
+		if i := strings.Index(streamId[len("user/"):], "/"); i != -1 {
+			return "user/-" + streamId[len("user/")+i:]
+		}
+	}
+	return streamId
+}
+
+func greaderFeedStreamId(sub kilium.Subscription) string {
+	return greaderFeedPrefix + sub.FeedUrl.String()
+}
+
+// Loads the subscriptions streamId covers, and the user's state for each.  keep is true for the items
+// in the stream, which for most streams is every item of the feeds.
+func (g *GReaderServer) loadStream(user *kilium.User, streamId string) (*userFeeds, func(kilium.RiverKey) bool, error) {
+	streamId = normalizeStreamId(streamId)
+
+	var inStream func(kilium.Subscription) bool
+	switch {
+	case streamId == greaderReadingList, streamId == greaderStarred, streamId == greaderRead:
+		inStream = func(kilium.Subscription) bool { return true }
+	case strings.HasPrefix(streamId, greaderLabelPrefix):
+		inStream = func(sub kilium.Subscription) bool {
+			return sub.Folder == strings.TrimPrefix(streamId, greaderLabelPrefix)
+		}
+	case strings.HasPrefix(streamId, greaderFeedPrefix):
+		inStream = func(sub kilium.Subscription) bool { return greaderFeedStreamId(sub) == streamId }
+	default:
+		return nil, nil, greaderUnknownStream
+	}
+
+	stream, err := loadUserFeeds(g.con, user, inStream)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keep := func(kilium.RiverKey) bool { return true }
+	if streamId == greaderStarred {
+		keep = func(key kilium.RiverKey) bool { return stream.states[key.Feed].IsStarred(key.ItemKey) }
+	} else if streamId == greaderRead {
+		keep = func(key kilium.RiverKey) bool { return stream.states[key.Feed].IsRead(key.ItemKey) }
+	}
+	return stream, keep, nil
+}
+
+// Pages through a stream with the usual n, c, r and xt parameters.
+func (g *GReaderServer) streamPage(req *http.Request, user *kilium.User, streamId string) (*userFeeds, kilium.RiverKeyList, kilium.ItemKey, error) {
+	stream, keep, err := g.loadStream(user, streamId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	limit := DefaultPageSize
+	if n, err := strconv.Atoi(req.Form.Get("n")); err == nil && n > 0 {
+		limit = n
+	}
+	if limit > MaximumPageSize {
+		limit = MaximumPageSize
+	}
+
+	var cursor kilium.ItemKey
+	if c := req.Form.Get("c"); c != "" {
+		if cursor, err = kilium.ParseItemKey(c); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	direction := kilium.Older
+	if req.Form.Get("r") == "o" {
+		direction = kilium.Newer
+	}
+	if normalizeStreamId(req.Form.Get("xt")) == greaderRead {
+		inStream := keep
+		keep = func(key kilium.RiverKey) bool {
+			return inStream(key) && !stream.states[key.Feed].IsRead(key.ItemKey)
+		}
+	}
+
+	keys, next := kilium.FilterRiverKeys(stream.feeds, cursor, direction, limit, keep)
+	return stream, keys, next, nil
+}
+
+func (g *GReaderServer) writeStreamError(w http.ResponseWriter, err error) {
+	if err == greaderUnknownStream {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	} else {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (g *GReaderServer) handleSubscriptionList(w http.ResponseWriter, req *http.Request, user *kilium.User) {
+	stream, _, err := g.loadStream(user, greaderReadingList)
+	if err != nil {
+		g.writeStreamError(w, err)
+		return
+	}
+
+	subs := make([]greaderSubscriptionJSON, len(stream.subs))
+	for i, sub := range stream.subs {
+		subs[i] = greaderSubscriptionJSON{
+			Id:         greaderFeedStreamId(sub),
+			Title:      greaderTitle(sub, stream.feeds[i]),
+			Categories: []greaderCategoryJSON{},
+			Url:        sub.FeedUrl.String(),
+			HtmlUrl:    sub.FeedUrl.String(),
+		}
+		if sub.Folder != "" {
+			subs[i].Categories = append(subs[i].Categories, greaderCategoryJSON{greaderLabelPrefix + sub.Folder, sub.Folder})
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"subscriptions": subs})
+}
+
+func greaderTitle(sub kilium.Subscription, feed *kilium.Feed) string {
+	if sub.Title != "" {
+		return sub.Title
+	}
+	return feed.Title
+}
+
+// Loads the items for keys, leaving out any that have gone missing.
+func (g *GReaderServer) streamItems(stream *userFeeds, keys kilium.RiverKeyList) ([]greaderItemJSON, error) {
+	keys, items, err := stream.loadItems(g.con, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]greaderItemJSON, 0, len(items))
+	for i, item := range items {
+		sub, state := stream.subs[keys[i].Feed], stream.states[keys[i].Feed]
+
+		categories := []string{greaderReadingList}
+		if state.IsRead(keys[i].ItemKey) {
+			categories = append(categories, greaderRead)
+		}
+		if state.IsStarred(keys[i].ItemKey) {
+			categories = append(categories, greaderStarred)
+		}
+		if sub.Folder != "" {
+			categories = append(categories, greaderLabelPrefix+sub.Folder)
+		}
+
+		published := itemTime(keys[i].ItemKey, item)
+		timestamp := published.UnixNano() / int64(time.Microsecond)
+		ret = append(ret, greaderItemJSON{
+			Id:            greaderItemId(keys[i].ItemKey),
+			CrawlTimeMsec: strconv.FormatInt(timestamp/1000, 10),
+			TimestampUsec: strconv.FormatInt(timestamp, 10),
+			Published:     published.Unix(),
+			Title:         item.Title,
+			Author:        item.Author,
+			Canonical:     []greaderLinkJSON{{Href: item.Url.String()}},
+			Alternate:     []greaderLinkJSON{{Href: item.Url.String(), Type: "text/html"}},
+			Summary:       greaderContentJSON{item.Content},
+			Categories:    categories,
+			Origin: greaderOriginJSON{
+				StreamId: greaderFeedStreamId(sub),
+				Title:    greaderTitle(sub, stream.feeds[keys[i].Feed]),
+				HtmlUrl:  sub.FeedUrl.String(),
+			},
+		})
+	}
+	return ret, nil
+}
+
+func (g *GReaderServer) handleStreamContents(w http.ResponseWriter, req *http.Request, user *kilium.User, streamId string) {
+	stream, keys, next, err := g.streamPage(req, user, streamId)
+	if err != nil {
+		g.writeStreamError(w, err)
+		return
+	}
+
+	items, err := g.streamItems(stream, keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page := greaderStreamJSON{Id: streamId, Updated: time.Now().Unix(), Items: items}
+	if next != nil {
+		page.Continuation = next.GetRiakKey()
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (g *GReaderServer) handleStreamItemIds(w http.ResponseWriter, req *http.Request, user *kilium.User) {
+	streamId := req.Form.Get("s")
+	if streamId == "" {
+		streamId = greaderReadingList
+	}
+	_, keys, next, err := g.streamPage(req, user, streamId)
+	if err != nil {
+		g.writeStreamError(w, err)
+		return
+	}
+
+	ids := greaderItemIdsJSON{ItemRefs: make([]greaderItemRefJSON, len(keys))}
+	for i, key := range keys {
+		ids.ItemRefs[i] = greaderItemRefJSON{
+			Id:            strconv.FormatInt(int64(key.ItemKey.Id()), 10),
+			TimestampUsec: greaderIdTimestampUsec(key.ItemKey.Id()),
+		}
+	}
+	if next != nil {
+		ids.Continuation = next.GetRiakKey()
+	}
+	writeJSON(w, http.StatusOK, ids)
+}
+
+// Finds the keys for the ids given as i among the user's subscriptions.  Unknown ids are skipped.
+func (g *GReaderServer) findItems(req *http.Request, user *kilium.User) (*userFeeds, kilium.RiverKeyList, error) {
+	stream, _, err := g.loadStream(user, greaderReadingList)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := kilium.RiverKeyList{}
+	for _, param := range req.Form["i"] {
+		id, err := parseGReaderItemId(param)
+		if err != nil {
+			return nil, nil, err
+		}
+		if key, ok := stream.findId(id); ok {
+			keys = append(keys, key)
+		}
+	}
+	return stream, keys, nil
+}
+
+func (g *GReaderServer) handleStreamItemContents(w http.ResponseWriter, req *http.Request, user *kilium.User) {
+	stream, keys, err := g.findItems(req, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items, err := g.streamItems(stream, keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, greaderStreamJSON{Id: greaderReadingList, Updated: time.Now().Unix(), Items: items})
+}
+
+func (g *GReaderServer) handleEditTag(w http.ResponseWriter, req *http.Request, user *kilium.User) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !hmac.Equal([]byte(req.Form.Get("T")), []byte(g.actionToken(user))) {
+		w.Header().Set("Google-Bad-Token", "true")
+		http.Error(w, "Bad token", http.StatusUnauthorized)
+		return
+	}
+
+	stream, keys, err := g.findItems(req, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Group the items by feed, since state is kept per feed.
+	byFeed := make(map[string]kilium.ItemKeyList)
+	for _, key := range keys {
+		feedKey := stream.feeds[key.Feed].UrlKey()
+		byFeed[feedKey] = append(byFeed[feedKey], key.ItemKey)
+	}
+
+	for _, tags := range []struct {
+		params []string
+		set    bool
+	}{{req.Form["a"], true}, {req.Form["r"], false}} {
+		for _, tag := range tags.params {
+			var mark func(*riak.Client, string, string, kilium.ItemKeyList, bool) error
+			switch normalizeStreamId(tag) {
+			case greaderRead:
+				mark = kilium.MarkItemsRead
+			case greaderStarred:
+				mark = kilium.MarkItemsStarred
+			default:
+				continue // Labels on items aren't supported.
+			}
+
+			for feedKey, itemKeys := range byFeed {
+				if err := mark(g.con, user.Name, feedKey, itemKeys, tags.set); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+	}
+
+	fmt.Fprint(w, "OK")
+}
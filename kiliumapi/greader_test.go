@@ -0,0 +1,195 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kiliumapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"strconv"
+	"strings"
+	"time"
+
+	"testing"
+
+	"github.com/MJDSystems/kilium/kilium"
+)
+
+func TestGReaderItemIds(t *testing.T) {
+	key := kilium.NewItemKey(0x123456789, []byte("hash"))
+
+	long := greaderItemId(key)
+	if long != "tag:google.com,2005:reader/item/0000000123456789" {
+		t.Errorf("Wrong long item id (%s)", long)
+	}
+	for _, id := range []string{long, strconv.FormatInt(0x123456789, 10)} {
+		if parsed, err := parseGReaderItemId(id); err != nil || parsed != key.Id() {
+			t.Errorf("Failed to parse %s (%v, %s)", id, parsed, err)
+		}
+	}
+	if _, err := parseGReaderItemId("nonsense"); err == nil {
+		t.Error("Parsed a bad item id")
+	}
+
+	found := time.Unix(1400000000, 0)
+	id := uint64(found.Unix())<<kilium.IdTimestampShift | 0xfffff
+	if usec := greaderIdTimestampUsec(id); usec != "1400000000000000" {
+		t.Errorf("Wrong timestamp for an id made at %v (%s)", found, usec)
+	}
+}
+
+func TestNormalizeStreamId(t *testing.T) {
+	for in, out := range map[string]string{
+		"user/1234/state/com.google/read": greaderRead,
+		"user/-/label/News":               "user/-/label/News",
+		"feed/http://example.com/a.rss":   "feed/http://example.com/a.rss",
+	} {
+		if got := normalizeStreamId(in); got != out {
+			t.Errorf("Normalized %s to %s, expected %s", in, got, out)
+		}
+	}
+}
+
+func TestGReaderRejectsUnauthenticated(t *testing.T) {
+	server := NewGReaderServer(nil, []byte("secret"))
+
+	if w := doRequest(t, server, "GET", "/reader/api/0/subscription/list", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Request without a token wasn't rejected (%v)", w.Code)
+	}
+	if w := doRequest(t, server, "POST", "/accounts/ClientLogin", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Empty login wasn't rejected (%v)", w.Code)
+	}
+	if w := doRequest(t, server, "GET", "/other", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Unknown path wasn't rejected (%v)", w.Code)
+	}
+}
+
+func serve(handler http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestGReaderServer(t *testing.T) {
+	con := getTestConnection(t)
+	server := NewGReaderServer(con, []byte("secret"))
+
+	name := "greader" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if _, err := kilium.CreateUser(con, name, "password"); err != nil {
+		t.Fatalf("Failed to create user (%s)", err)
+	}
+	feedUrl, _ := url.Parse("http://example.com/" + name + ".rss")
+	if err := kilium.Subscribe(con, name, *feedUrl, "Mine", "News"); err != nil {
+		t.Fatalf("Failed to subscribe (%s)", err)
+	}
+	feedKey := (&kilium.Feed{Url: *feedUrl}).UrlKey()
+	defer kilium.RssMasterHandleRemoveRequest(con, *feedUrl)
+
+	feed, err := kilium.LoadFeed(con, feedKey)
+	if err != nil {
+		t.Fatalf("Failed to load feed (%s)", err)
+	}
+	for i := 3; i > 0; i-- {
+		key := kilium.NewItemKey(uint64(i), []byte(name+strings.Repeat("-", i)))
+		if err := kilium.InsertItem(con, feedKey, key, kilium.ParsedFeedItem{Title: strings.Repeat("I", i)}); err != nil {
+			t.Fatalf("Failed to insert item (%s)", err)
+		}
+		feed.ItemKeys = append(feed.ItemKeys, key)
+	}
+	if err := feed.Save(); err != nil {
+		t.Fatalf("Failed to save feed (%s)", err)
+	}
+
+	w := doRequest(t, server, "POST", "/accounts/ClientLogin?Email="+name+"&Passwd=wrong", "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong password wasn't rejected (%v)", w.Code)
+	}
+	w = doRequest(t, server, "POST", "/accounts/ClientLogin?Email="+name+"&Passwd=password", "")
+	auth := ""
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, "Auth=") {
+			auth = strings.TrimPrefix(line, "Auth=")
+		}
+	}
+	if w.Code != http.StatusOK || auth == "" {
+		t.Fatalf("Failed to log in (%v: %s)", w.Code, w.Body.String())
+	}
+	authed := func(method, path, body string) *http.Request {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "GoogleLogin auth="+auth)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+
+	var subs struct {
+		Subscriptions []greaderSubscriptionJSON
+	}
+	decodeResponse(t, serve(server, authed("GET", "/reader/api/0/subscription/list", "")), &subs)
+	if len(subs.Subscriptions) != 1 || subs.Subscriptions[0].Title != "Mine" || subs.Subscriptions[0].Categories[0].Label != "News" {
+		t.Errorf("Wrong subscriptions (%+v)", subs)
+	}
+
+	var stream greaderStreamJSON
+	decodeResponse(t, serve(server, authed("GET", "/reader/api/0/stream/contents/user/-/label/News?n=2", "")), &stream)
+	if len(stream.Items) != 2 || stream.Items[0].Title != "III" || stream.Continuation == "" {
+		t.Fatalf("Wrong stream contents (%+v)", stream)
+	}
+	// The items have no dates, so they go by when they were found, like their ids do.
+	if stream.Items[0].TimestampUsec != greaderIdTimestampUsec(3) || stream.Items[0].Published != kilium.IdTimestamp(3).Unix() {
+		t.Errorf("Undated item has the wrong timestamps (%+v)", stream.Items[0])
+	}
+
+	token := serve(server, authed("GET", "/reader/api/0/token", "")).Body.String()
+	edit := url.Values{"T": {token}, "i": {stream.Items[0].Id}, "a": {greaderRead, greaderStarred}}
+	if w := serve(server, authed("POST", "/reader/api/0/edit-tag", edit.Encode())); w.Code != http.StatusOK {
+		t.Fatalf("Failed to edit tags (%v: %s)", w.Code, w.Body.String())
+	}
+	edit.Set("T", "wrong")
+	if w := serve(server, authed("POST", "/reader/api/0/edit-tag", edit.Encode())); w.Code != http.StatusUnauthorized {
+		t.Errorf("Edit with a bad token wasn't rejected (%v)", w.Code)
+	}
+
+	var ids greaderItemIdsJSON
+	decodeResponse(t, serve(server, authed("GET", "/reader/api/0/stream/items/ids?s="+greaderReadingList+"&xt="+greaderRead, "")), &ids)
+	if len(ids.ItemRefs) != 2 || ids.ItemRefs[0].Id != "2" || ids.ItemRefs[1].Id != "1" {
+		t.Errorf("Read item wasn't excluded (%+v)", ids)
+	}
+
+	decodeResponse(t, serve(server, authed("GET", "/reader/api/0/stream/contents/"+greaderStarred, "")), &stream)
+	if len(stream.Items) != 1 || stream.Items[0].Title != "III" {
+		t.Errorf("Wrong starred items (%+v)", stream)
+	}
+
+	decodeResponse(t, serve(server, authed("POST", "/reader/api/0/stream/items/contents", "i=1")), &stream)
+	if len(stream.Items) != 1 || stream.Items[0].Title != "I" {
+		t.Errorf("Wrong items by id (%+v)", stream)
+	}
+
+	// Feeds removed from under a subscription are skipped, not an error.
+	if err := kilium.RssMasterHandleRemoveRequest(con, *feedUrl); err != nil {
+		t.Fatalf("Failed to remove feed (%s)", err)
+	}
+	w = serve(server, authed("GET", "/reader/api/0/stream/contents/"+greaderReadingList, ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Stream failed after its feed was removed (%v: %s)", w.Code, w.Body.String())
+	}
+	decodeResponse(t, w, &stream)
+	if len(stream.Items) != 0 {
+		t.Errorf("Removed feed's items are still streamed (%+v)", stream)
+	}
+}
@@ -0,0 +1,749 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+// Package kiliumapi serves the feeds and items kilium stores over HTTP, as JSON.
+package kiliumapi
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+
+	"net/http"
+	"net/url"
+
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MJDSystems/kilium/kilium"
+	riak "github.com/tpjg/goriakpbc"
+)
+
+const (
+	DefaultPageSize = 50
+	MaximumPageSize = 500
+)
+
+type FeedJSON struct {
+	Key       string    `json:"key"`
+	Url       string    `json:"url"`
+	Title     string    `json:"title"`
+	LastCheck time.Time `json:"last_check"`
+	NextCheck time.Time `json:"next_check"`
+	ItemCount int       `json:"item_count"`
+}
+
+type ItemJSON struct {
+	Key        string    `json:"key"`
+	Feed       string    `json:"feed,omitempty"` // Only set in rivers.
+	Title      string    `json:"title"`
+	Author     string    `json:"author"`
+	Content    string    `json:"content"`
+	Url        string    `json:"url"`
+	PubDate    time.Time `json:"publication_date"`
+	Categories []string  `json:"categories,omitempty"`
+}
+
+type RevisionJSON struct {
+	Revision int       `json:"revision"`
+	Title    string    `json:"title"`
+	Author   string    `json:"author"`
+	Content  string    `json:"content"`
+	Url      string    `json:"url"`
+	PubDate  time.Time `json:"publication_date"`
+	Replaced time.Time `json:"replaced,omitempty"` // Unset for the current version.
+}
+
+type DiffChunkJSON struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+type RevisionDiffJSON struct {
+	From       int             `json:"from"`
+	To         int             `json:"to"`
+	Title      []DiffChunkJSON `json:"title"`
+	Author     []DiffChunkJSON `json:"author"`
+	Content    []DiffChunkJSON `json:"content"`
+	OldUrl     string          `json:"old_url"`
+	NewUrl     string          `json:"new_url"`
+	OldPubDate time.Time       `json:"old_publication_date"`
+	NewPubDate time.Time       `json:"new_publication_date"`
+}
+
+type ItemPageJSON struct {
+	Items  []ItemJSON `json:"items"`
+	Offset int        `json:"offset,omitempty"`
+	Total  int        `json:"total"`
+
+	// Cursors to pass as older_than or newer_than for the neighbouring pages.  Only set when paging
+	// by cursor, and only if there is more in that direction.
+	Older string `json:"older,omitempty"`
+	Newer string `json:"newer,omitempty"`
+}
+
+type errorJSON struct {
+	Error string `json:"error"`
+}
+
+type addFeedJSON struct {
+	Url string `json:"url"`
+}
+
+func NewFeedJSON(feed *kilium.Feed) FeedJSON {
+	return FeedJSON{
+		Key:       feed.UrlKey(),
+		Url:       feed.Url.String(),
+		Title:     feed.Title,
+		LastCheck: feed.LastCheck,
+		NextCheck: feed.NextCheck,
+		ItemCount: len(feed.ItemKeys),
+	}
+}
+
+// When the item was published, or for items without a date, when it was found.
+func itemTime(key kilium.ItemKey, item *kilium.FeedItem) time.Time {
+	if item.PubDate.IsZero() {
+		return kilium.IdTimestamp(key.Id())
+	}
+	return item.PubDate
+}
+
+func NewItemJSON(key kilium.ItemKey, item *kilium.FeedItem) ItemJSON {
+	return ItemJSON{
+		Key:        key.GetRiakKey(),
+		Title:      item.Title,
+		Author:     item.Author,
+		Content:    item.Content,
+		Url:        item.Url.String(),
+		PubDate:    item.PubDate,
+		Categories: item.Categories,
+	}
+}
+
+func NewRevisionJSON(n int, revision kilium.ItemRevision) RevisionJSON {
+	return RevisionJSON{
+		Revision: n,
+		Title:    revision.Title,
+		Author:   revision.Author,
+		Content:  revision.Content,
+		Url:      revision.Url.String(),
+		PubDate:  revision.PubDate,
+		Replaced: revision.Replaced,
+	}
+}
+
+func newDiffChunksJSON(chunks []kilium.DiffChunk) []DiffChunkJSON {
+	ret := make([]DiffChunkJSON, 0, len(chunks))
+	for _, chunk := range chunks {
+		ret = append(ret, DiffChunkJSON{chunk.Op.String(), chunk.Text})
+	}
+	return ret
+}
+
+func NewRevisionDiffJSON(from, to int, diff *kilium.RevisionDiff) RevisionDiffJSON {
+	return RevisionDiffJSON{
+		From:       from,
+		To:         to,
+		Title:      newDiffChunksJSON(diff.Title),
+		Author:     newDiffChunksJSON(diff.Author),
+		Content:    newDiffChunksJSON(diff.Content),
+		OldUrl:     diff.OldUrl.String(),
+		NewUrl:     diff.NewUrl.String(),
+		OldPubDate: diff.OldPubDate,
+		NewPubDate: diff.NewPubDate,
+	}
+}
+
+// Server exposes the feeds and items in riak, and lets feeds be added or removed through master.
+// Adding and removing feeds needs an "Authorization: Bearer {token}" header with the admin token the
+// server was made with.  Without an admin token, feeds can't be changed through the server at all.
+//
+//	GET    /feeds                  Lists every feed.
+//	POST   /feeds                  Adds the feed given as {"url": ...}.
+//	GET    /feeds/{key}            Gets a feed.
+//	DELETE /feeds/{key}            Removes a feed and its items.
+//	GET    /feeds/{key}/items      Pages through a feed's items, newest first.  Takes a limit, and
+//	                               either an offset or an older_than or newer_than cursor.  Cursors
+//	                               stay stable as new items arrive, offsets don't.
+//	GET    /items/{key}            Gets an item.
+//	GET    /items/{key}/revisions  Lists an item's kept versions, oldest first, ending with the
+//	                               current one.
+//	GET    /items/{key}/diff       Diffs two versions, given as from and to revision numbers.  They
+//	                               default to the previous and current versions.
+//	GET    /river?feeds={key},...  Pages through the given feeds' items merged together, newest
+//	                               first.  Takes a limit and an optional older_than or newer_than
+//	                               cursor.
+//	GET    /search?q={query}       Searches every item, newest first.  Takes a limit.  See
+//	                               kilium.ParseSearchQuery for what queries can hold.
+//	GET    /republish              Republishes the newest items of several feeds as one feed.  The
+//	                               feeds are given as feeds={key},..., or as user and folder for a
+//	                               user's folder, which needs the user's name and password through
+//	                               HTTP basic authentication.  q keeps only items with all of its
+//	                               words, format is rss, atom or json, and title names the new feed.
+type Server struct {
+	con        *riak.Client
+	master     kilium.RssMaster
+	adminToken string
+	mux        *http.ServeMux
+}
+
+func NewServer(con *riak.Client, master kilium.RssMaster, adminToken string) *Server {
+	s := &Server{
+		con:        con,
+		master:     master,
+		adminToken: adminToken,
+		mux:        http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("/feeds", s.handleFeeds)
+	s.mux.HandleFunc("/feeds/", s.handleFeed)
+	s.mux.HandleFunc("/items/", s.handleItem)
+	s.mux.HandleFunc("/river", s.handleRiver)
+	s.mux.HandleFunc("/search", s.handleSearch)
+	s.mux.HandleFunc("/republish", s.handleRepublish)
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mux.ServeHTTP(w, req)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorJSON{err.Error()})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeJSON(w, http.StatusMethodNotAllowed, errorJSON{"Method not allowed"})
+}
+
+// Checks the request carries the admin token, writing the appropriate error if it doesn't.
+func (s *Server) authorizeChange(w http.ResponseWriter, req *http.Request) bool {
+	if s.adminToken == "" {
+		writeJSON(w, http.StatusForbidden, errorJSON{"Feeds can't be changed through this server"})
+		return false
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !hmac.Equal([]byte(token), []byte(s.adminToken)) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, errorJSON{"Unauthorized"})
+		return false
+	}
+	return true
+}
+
+// Loads the feed named by key, writing the appropriate error if it can't be.
+func (s *Server) loadFeed(w http.ResponseWriter, key string) *kilium.Feed {
+	feed, err := kilium.LoadFeed(s.con, key)
+	if err == kilium.FeedNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return nil
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil
+	}
+	return feed
+}
+
+// Reads an integer query parameter, falling back to def when it is missing.
+func intParam(req *http.Request, name string, def int) (int, error) {
+	value := req.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func pageSize(req *http.Request) (int, error) {
+	limit, err := intParam(req, "limit", DefaultPageSize)
+	if err != nil {
+		return 0, err
+	}
+	if limit < 1 {
+		limit = 1
+	} else if limit > MaximumPageSize {
+		limit = MaximumPageSize
+	}
+	return limit, nil
+}
+
+func (s *Server) handleFeeds(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		keys, err := kilium.ListFeedKeys(s.con)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		feeds := make([]FeedJSON, 0, len(keys))
+		for _, key := range keys {
+			feed, err := kilium.LoadFeed(s.con, key)
+			if err == kilium.FeedNotFound {
+				continue // Removed while listing.
+			} else if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			feeds = append(feeds, NewFeedJSON(feed))
+		}
+		writeJSON(w, http.StatusOK, feeds)
+	case "POST":
+		if !s.authorizeChange(w, req) {
+			return
+		}
+		var add addFeedJSON
+		if err := json.NewDecoder(req.Body).Decode(&add); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		Url, err := url.Parse(add.Url)
+		if err != nil || !Url.IsAbs() {
+			writeJSON(w, http.StatusBadRequest, errorJSON{"A feed needs an absolute url"})
+			return
+		}
+
+		responseCh := make(chan error, 1)
+		s.master.AddRequestCh <- kilium.AddFeedRequest{Url: *Url, ResponseCh: responseCh}
+		if err := <-responseCh; err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		if feed := s.loadFeed(w, (&kilium.Feed{Url: *Url}).UrlKey()); feed != nil {
+			writeJSON(w, http.StatusCreated, NewFeedJSON(feed))
+		}
+	default:
+		writeMethodNotAllowed(w, "GET, POST")
+	}
+}
+
+func (s *Server) handleFeed(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/feeds/"), "/")
+	if len(parts) == 2 && parts[1] == "items" {
+		s.handleFeedItems(w, req, parts[0])
+		return
+	} else if len(parts) != 1 || parts[0] == "" {
+		writeJSON(w, http.StatusNotFound, errorJSON{"Not found"})
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		if feed := s.loadFeed(w, parts[0]); feed != nil {
+			writeJSON(w, http.StatusOK, NewFeedJSON(feed))
+		}
+	case "DELETE":
+		if !s.authorizeChange(w, req) {
+			return
+		}
+		feed := s.loadFeed(w, parts[0])
+		if feed == nil {
+			return
+		}
+
+		responseCh := make(chan error, 1)
+		s.master.RemoveRequestCh <- kilium.RemoveFeedRequest{Url: feed.Url, ResponseCh: responseCh}
+		if err := <-responseCh; err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, "GET, DELETE")
+	}
+}
+
+func (s *Server) handleFeedItems(w http.ResponseWriter, req *http.Request, key string) {
+	if req.Method != "GET" {
+		writeMethodNotAllowed(w, "GET")
+		return
+	}
+
+	offset, err := intParam(req, "offset", 0)
+	if err != nil || offset < 0 {
+		writeJSON(w, http.StatusBadRequest, errorJSON{"Bad offset"})
+		return
+	}
+	limit, err := pageSize(req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorJSON{"Bad limit"})
+		return
+	}
+
+	query := req.URL.Query()
+	if query.Get("older_than") != "" || query.Get("newer_than") != "" {
+		s.handleFeedItemsByCursor(w, req, key, limit)
+		return
+	}
+
+	feed := s.loadFeed(w, key)
+	if feed == nil {
+		return
+	}
+
+	// ItemKeys is kept newest first, so just walk it.
+	keys := kilium.ItemKeyList{}
+	if offset < len(feed.ItemKeys) {
+		keys = feed.ItemKeys[offset:]
+		if len(keys) > limit {
+			keys = keys[:limit]
+		}
+	}
+
+	items, err := kilium.LoadFeedItems(s.con, keys)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	page := ItemPageJSON{Items: make([]ItemJSON, 0, len(items)), Offset: offset, Total: len(feed.ItemKeys)}
+	for i, item := range items {
+		if item != nil {
+			page.Items = append(page.Items, NewItemJSON(keys[i], item))
+		}
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// Reads the older_than or newer_than cursor.  With neither, paging starts from the newest item.
+func cursorParams(req *http.Request) (kilium.ItemKey, kilium.PageDirection, error) {
+	direction, cursorParam := kilium.Older, req.URL.Query().Get("older_than")
+	if cursorParam == "" {
+		direction, cursorParam = kilium.Newer, req.URL.Query().Get("newer_than")
+	}
+	if cursorParam == "" {
+		return nil, kilium.Older, nil
+	}
+	cursor, err := kilium.ParseItemKey(cursorParam)
+	return cursor, direction, err
+}
+
+func (s *Server) handleFeedItemsByCursor(w http.ResponseWriter, req *http.Request, key string, limit int) {
+	cursor, direction, err := cursorParams(req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorJSON{"Bad cursor"})
+		return
+	}
+
+	feed := s.loadFeed(w, key)
+	if feed == nil {
+		return
+	}
+
+	page, err := kilium.LoadItemPage(s.con, feed, cursor, direction, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	pageJSON := ItemPageJSON{Items: make([]ItemJSON, 0, len(page.Items)), Total: len(feed.ItemKeys)}
+	for i, item := range page.Items {
+		pageJSON.Items = append(pageJSON.Items, NewItemJSON(page.Keys[i], item))
+	}
+	if page.Older != nil {
+		pageJSON.Older = page.Older.GetRiakKey()
+	}
+	if page.Newer != nil {
+		pageJSON.Newer = page.Newer.GetRiakKey()
+	}
+	writeJSON(w, http.StatusOK, pageJSON)
+}
+
+func (s *Server) handleRiver(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeMethodNotAllowed(w, "GET")
+		return
+	}
+
+	limit, err := pageSize(req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorJSON{"Bad limit"})
+		return
+	}
+	cursor, direction, err := cursorParams(req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorJSON{"Bad cursor"})
+		return
+	}
+	feedKeys := strings.Split(req.URL.Query().Get("feeds"), ",")
+	if len(feedKeys) == 1 && feedKeys[0] == "" {
+		writeJSON(w, http.StatusBadRequest, errorJSON{"No feeds given"})
+		return
+	}
+
+	feeds, err := kilium.LoadFeeds(s.con, feedKeys)
+	if errors.Is(err, kilium.FeedNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	page, err := kilium.LoadRiverPage(s.con, feeds, cursor, direction, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	pageJSON := ItemPageJSON{Items: make([]ItemJSON, 0, len(page.Items))}
+	for i, item := range page.Items {
+		itemJSON := NewItemJSON(page.Keys[i].ItemKey, item)
+		itemJSON.Feed = feedKeys[page.Keys[i].Feed]
+		pageJSON.Items = append(pageJSON.Items, itemJSON)
+	}
+	for _, feed := range feeds {
+		pageJSON.Total += len(feed.ItemKeys)
+	}
+	if page.Older != nil {
+		pageJSON.Older = page.Older.GetRiakKey()
+	}
+	if page.Newer != nil {
+		pageJSON.Newer = page.Newer.GetRiakKey()
+	}
+	writeJSON(w, http.StatusOK, pageJSON)
+}
+
+func (s *Server) handleItem(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeMethodNotAllowed(w, "GET")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/items/"), "/")
+	if len(parts) > 2 || (len(parts) == 2 && parts[1] != "revisions" && parts[1] != "diff") {
+		writeJSON(w, http.StatusNotFound, errorJSON{"Not found"})
+		return
+	}
+
+	itemKey, err := kilium.ParseItemKey(parts[0])
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorJSON{"Bad item key"})
+		return
+	}
+
+	item := &kilium.FeedItem{}
+	if err := s.con.LoadModel(itemKey.GetRiakKey(), item); err == riak.NotFound {
+		writeJSON(w, http.StatusNotFound, errorJSON{"Item not found"})
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if len(parts) == 1 {
+		writeJSON(w, http.StatusOK, NewItemJSON(itemKey, item))
+	} else if parts[1] == "revisions" {
+		revisions := make([]RevisionJSON, 0, len(item.Revisions)+1)
+		for i := 0; i <= len(item.Revisions); i++ {
+			revision, _ := item.Revision(i)
+			revisions = append(revisions, NewRevisionJSON(i, revision))
+		}
+		writeJSON(w, http.StatusOK, revisions)
+	} else {
+		s.handleItemDiff(w, req, item)
+	}
+}
+
+func (s *Server) handleItemDiff(w http.ResponseWriter, req *http.Request, item *kilium.FeedItem) {
+	from, to := len(item.Revisions)-1, len(item.Revisions)
+	if from < 0 {
+		from = 0
+	}
+	for name, value := range map[string]*int{"from": &from, "to": &to} {
+		if raw := req.URL.Query().Get(name); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, errorJSON{"Bad " + name})
+				return
+			}
+			*value = n
+		}
+	}
+
+	diff, err := item.DiffRevisions(from, to)
+	if err == kilium.RevisionOutOfRange {
+		writeJSON(w, http.StatusNotFound, errorJSON{err.Error()})
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, NewRevisionDiffJSON(from, to, diff))
+}
+
+func (s *Server) handleSearch(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeMethodNotAllowed(w, "GET")
+		return
+	}
+
+	limit, err := pageSize(req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorJSON{"Bad limit"})
+		return
+	}
+	query, err := kilium.ParseSearchQuery(req.URL.Query().Get("q"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	keys, err := query.Run(s.con, limit)
+	if errors.Is(err, kilium.FeedNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	items, err := kilium.LoadFeedItems(s.con, keys)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	page := ItemPageJSON{Items: make([]ItemJSON, 0, len(items)), Total: len(keys)}
+	for i, item := range items {
+		if item != nil {
+			page.Items = append(page.Items, NewItemJSON(keys[i], item))
+		}
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// Where the server logs to.  Servers without a running master use DefaultLogger.
+func (s *Server) logger() kilium.Logger {
+	if logger := s.master.Logger(); logger != nil {
+		return logger
+	}
+	return kilium.DefaultLogger
+}
+
+// The keys of the feeds in the folder of the user's subscriptions.  Only the user may see them, so the
+// request must carry the user's name and password through basic authentication.  Unknown users are
+// refused like wrong passwords, so names can't be guessed.  ok is false if an error was written instead.
+func (s *Server) folderFeedKeys(w http.ResponseWriter, req *http.Request, name, folder string) (keys []string, ok bool) {
+	refuse := func() {
+		w.Header().Set("WWW-Authenticate", `Basic realm="kilium"`)
+		writeJSON(w, http.StatusUnauthorized, errorJSON{"Unauthorized"})
+	}
+	username, password, given := req.BasicAuth()
+	if !given || username != name {
+		refuse()
+		return nil, false
+	}
+	user, err := kilium.LoadUser(s.con, name)
+	if err == kilium.UserNotFound {
+		refuse()
+		return nil, false
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	if !user.CheckPassword(password) {
+		refuse()
+		return nil, false
+	}
+
+	feeds, err := loadUserFeeds(s.con, user, func(sub kilium.Subscription) bool { return sub.Folder == folder })
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return feeds.keys, true
+}
+
+func (s *Server) handleRepublish(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeMethodNotAllowed(w, "GET")
+		return
+	}
+
+	query := req.URL.Query()
+	format, err := kilium.ParseRepublishFormat(query.Get("format"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := pageSize(req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorJSON{"Bad limit"})
+		return
+	}
+
+	var feedKeys []string
+	if query.Get("user") != "" {
+		var ok bool
+		if feedKeys, ok = s.folderFeedKeys(w, req, query.Get("user"), query.Get("folder")); !ok {
+			return
+		}
+	} else if feedKeys = strings.Split(query.Get("feeds"), ","); len(feedKeys) == 1 && feedKeys[0] == "" {
+		writeJSON(w, http.StatusBadRequest, errorJSON{"No feeds given"})
+		return
+	}
+
+	sources, err := kilium.LoadFeeds(s.con, feedKeys)
+	if errors.Is(err, kilium.FeedNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	filter := kilium.RepublishFilter{Keywords: strings.Fields(query.Get("q"))}
+	keys, items, err := kilium.LoadRepublishedItems(s.con, sources, filter, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	title := query.Get("title")
+	if title == "" {
+		title = "Kilium"
+	}
+	// RequestURI is what the client asked for, before any prefix the server is mounted under was
+	// stripped.  Requests that didn't come in over the network don't have one.
+	requestUri := req.RequestURI
+	if requestUri == "" {
+		requestUri = req.URL.RequestURI()
+	}
+	link, err := url.ParseRequestURI(requestUri)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	link.Scheme, link.Host = "http", req.Host
+	if req.TLS != nil {
+		link.Scheme = "https"
+	}
+
+	w.Header().Set("Content-Type", format.ContentType())
+	if err := kilium.WriteRepublishedFeed(w, kilium.BuildRepublishedFeed(title, *link, sources, keys, items), format); err != nil {
+		// The response has started, so the client can only be told by the feed being cut short.
+		s.logger().Log(kilium.LogWarn, "Failed to write republished feed", kilium.LogField{"url", link.String()}, kilium.ErrorField(err))
+	}
+}
@@ -0,0 +1,305 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kiliumapi
+
+import (
+	"encoding/json"
+
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"strconv"
+	"strings"
+	"time"
+
+	"testing"
+
+	"github.com/MJDSystems/kilium/kilium"
+	riak "github.com/tpjg/goriakpbc"
+)
+
+var staticTestCon *riak.Client
+
+func getTestConnection(t *testing.T) *riak.Client {
+	if staticTestCon == nil {
+		var err error
+		staticTestCon, err = kilium.GetDatabaseConnection("localhost:8087")
+		if err != nil {
+			t.Fatalf("Failed to get db connection (%s)", err)
+		}
+	}
+	return staticTestCon
+}
+
+// Gives a master whose requests are handled directly, without any polling.
+func newTestMaster(con *riak.Client) (kilium.RssMaster, func()) {
+	addCh := make(chan kilium.AddFeedRequest)
+	removeCh := make(chan kilium.RemoveFeedRequest)
+	go func() {
+		for {
+			select {
+			case next, ok := <-addCh:
+				if !ok {
+					return
+				}
+				next.ResponseCh <- kilium.RssMasterHandleAddRequest(con, next.Url)
+			case next := <-removeCh:
+				next.ResponseCh <- kilium.RssMasterHandleRemoveRequest(con, next.Url)
+			}
+		}
+	}()
+	return kilium.RssMaster{AddRequestCh: addCh, RemoveRequestCh: removeCh}, func() { close(addCh) }
+}
+
+const testAdminToken = "test-admin-token"
+
+func doRequest(t *testing.T, handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to make request (%s)", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder, into interface{}) {
+	if err := json.Unmarshal(w.Body.Bytes(), into); err != nil {
+		t.Fatalf("Failed to decode response %q (%s)", w.Body.String(), err)
+	}
+}
+
+func TestServerRejectsBadRequests(t *testing.T) {
+	server := NewServer(nil, kilium.RssMaster{}, testAdminToken)
+
+	if w := doRequest(t, server, "PUT", "/feeds", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT on feeds wasn't rejected (%v)", w.Code)
+	}
+	if w := doRequest(t, server, "POST", "/feeds", `{"url": "not/absolute"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Relative feed url wasn't rejected (%v)", w.Code)
+	}
+	if w := doRequest(t, server, "GET", "/feeds/key/items?offset=-1", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Negative offset wasn't rejected (%v)", w.Code)
+	}
+	if w := doRequest(t, server, "GET", "/feeds/key/other", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Unknown path wasn't rejected (%v)", w.Code)
+	}
+	if w := doRequest(t, server, "GET", "/feeds/key/items?older_than=!!!", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Bad cursor wasn't rejected (%v)", w.Code)
+	}
+	if w := doRequest(t, server, "GET", "/river", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("River without feeds wasn't rejected (%v)", w.Code)
+	}
+	if w := doRequest(t, server, "GET", "/items/!!!", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Bad item key wasn't rejected (%v)", w.Code)
+	}
+	if w := doRequest(t, server, "GET", "/republish?feeds=key&format=xml", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Unknown republishing format wasn't rejected (%v)", w.Code)
+	}
+	if w := doRequest(t, server, "GET", "/search?q=-only", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Search without anything to find wasn't rejected (%v)", w.Code)
+	}
+	if w := doRequest(t, server, "GET", "/republish", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Republishing without feeds wasn't rejected (%v)", w.Code)
+	}
+}
+
+func TestServerGuardsChanges(t *testing.T) {
+	request := func(server *Server, method, path, token string) int {
+		req, _ := http.NewRequest(method, path, strings.NewReader(`{"url": "http://example.com/feed.rss"}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	server := NewServer(nil, kilium.RssMaster{}, testAdminToken)
+	if code := request(server, "POST", "/feeds", ""); code != http.StatusUnauthorized {
+		t.Errorf("Adding a feed without a token wasn't rejected (%v)", code)
+	}
+	if code := request(server, "DELETE", "/feeds/key", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Removing a feed with the wrong token wasn't rejected (%v)", code)
+	}
+
+	server = NewServer(nil, kilium.RssMaster{}, "")
+	if code := request(server, "POST", "/feeds", ""); code != http.StatusForbidden {
+		t.Errorf("Adding a feed without an admin token configured wasn't refused (%v)", code)
+	}
+
+	// A user's folders are private, whatever the admin token.
+	if code := request(server, "GET", "/republish?user=reader&folder=news", testAdminToken); code != http.StatusUnauthorized {
+		t.Errorf("Republishing a folder without the user's password wasn't rejected (%v)", code)
+	}
+}
+
+func TestItemTime(t *testing.T) {
+	found := time.Unix(1400000000, 0)
+	key := kilium.NewItemKey(uint64(found.Unix())<<kilium.IdTimestampShift, []byte("hash"))
+
+	if when := itemTime(key, &kilium.FeedItem{}); !when.Equal(found) {
+		t.Errorf("Undated item should go by when it was found, not %v", when)
+	}
+	published := found.Add(-time.Hour)
+	if when := itemTime(key, &kilium.FeedItem{PubDate: published}); !when.Equal(published) {
+		t.Errorf("Dated item should go by its date, not %v", when)
+	}
+}
+
+func TestServerFeedsAndItems(t *testing.T) {
+	con := getTestConnection(t)
+	master, stop := newTestMaster(con)
+	defer stop()
+	server := NewServer(con, master, testAdminToken)
+
+	feedUrl := "http://example.com/" + strconv.FormatInt(time.Now().UnixNano(), 10) + "/api.rss"
+	w := doRequest(t, server, "POST", "/feeds", `{"url": "`+feedUrl+`"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to add feed (%v: %s)", w.Code, w.Body.String())
+	}
+	var added FeedJSON
+	decodeResponse(t, w, &added)
+	if added.Url != feedUrl || added.Key == "" {
+		t.Errorf("Added feed doesn't match (%+v)", added)
+	}
+	defer doRequest(t, server, "DELETE", "/feeds/"+added.Key, "")
+
+	// Give the feed some items, newest first.
+	feed, err := kilium.LoadFeed(con, added.Key)
+	if err != nil {
+		t.Fatalf("Failed to load added feed (%s)", err)
+	}
+	for i := 5; i > 0; i-- {
+		key := kilium.NewItemKey(uint64(i), []byte(added.Key+strings.Repeat("-", i)))
+		if err := kilium.InsertItem(con, added.Key, key, kilium.ParsedFeedItem{Title: strings.Repeat("I", i)}); err != nil {
+			t.Fatalf("Failed to insert item (%s)", err)
+		}
+		feed.ItemKeys = append(feed.ItemKeys, key)
+	}
+	if err := feed.Save(); err != nil {
+		t.Fatalf("Failed to save feed (%s)", err)
+	}
+
+	var got FeedJSON
+	decodeResponse(t, doRequest(t, server, "GET", "/feeds/"+added.Key, ""), &got)
+	if got.ItemCount != 5 {
+		t.Errorf("Feed has the wrong item count (%+v)", got)
+	}
+
+	var page ItemPageJSON
+	decodeResponse(t, doRequest(t, server, "GET", "/feeds/"+added.Key+"/items?offset=1&limit=2", ""), &page)
+	if page.Total != 5 || len(page.Items) != 2 || page.Items[0].Title != "IIII" || page.Items[1].Title != "III" {
+		t.Errorf("Wrong page of items (%+v)", page)
+	}
+
+	var cursorPage ItemPageJSON
+	decodeResponse(t, doRequest(t, server, "GET", "/feeds/"+added.Key+"/items?limit=2&older_than="+page.Items[0].Key, ""), &cursorPage)
+	if len(cursorPage.Items) != 2 || cursorPage.Items[0].Title != "III" || cursorPage.Items[1].Title != "II" {
+		t.Errorf("Wrong page of items by cursor (%+v)", cursorPage)
+	}
+	if cursorPage.Newer != cursorPage.Items[0].Key || cursorPage.Older != cursorPage.Items[1].Key {
+		t.Errorf("Wrong cursors for page (%+v)", cursorPage)
+	}
+	decodeResponse(t, doRequest(t, server, "GET", "/feeds/"+added.Key+"/items?limit=2&newer_than="+cursorPage.Newer, ""), &cursorPage)
+	if len(cursorPage.Items) != 2 || cursorPage.Items[0].Title != "IIIII" || cursorPage.Newer != "" {
+		t.Errorf("Wrong page of newer items by cursor (%+v)", cursorPage)
+	}
+
+	var river ItemPageJSON
+	decodeResponse(t, doRequest(t, server, "GET", "/river?limit=3&feeds="+added.Key, ""), &river)
+	if len(river.Items) != 3 || river.Items[0].Title != "IIIII" || river.Items[0].Feed != added.Key || river.Older != river.Items[2].Key {
+		t.Errorf("Wrong river page (%+v)", river)
+	}
+
+	if w := doRequest(t, server, "GET", "/search?q=iiii+feed:missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Searching an unknown feed wasn't not found (%v: %s)", w.Code, w.Body.String())
+	}
+
+	w = doRequest(t, server, "GET", "/republish?format=atom&q=iiii&feeds="+added.Key, "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/atom+xml" {
+		t.Errorf("Failed to republish feed (%v: %s)", w.Code, w.Body.String())
+	} else if body := w.Body.String(); !strings.Contains(body, ">IIII<") || strings.Contains(body, "IIIII") || strings.Contains(body, ">III<") {
+		t.Errorf("Republished feed wasn't filtered (%s)", body)
+	}
+
+	// Folders need their user's password.
+	user := "republisher" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if _, err := kilium.CreateUser(con, user, "password"); err != nil {
+		t.Fatalf("Failed to create user (%s)", err)
+	}
+	parsedUrl, _ := url.Parse(feedUrl)
+	if err := kilium.Subscribe(con, user, *parsedUrl, "", "news"); err != nil {
+		t.Fatalf("Failed to subscribe (%s)", err)
+	}
+	republishFolder := func(password string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/republish?user="+user+"&folder=news", nil)
+		req.SetBasicAuth(user, password)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w
+	}
+	if w := republishFolder("password"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), ">IIIII<") {
+		t.Errorf("Failed to republish folder (%v: %s)", w.Code, w.Body.String())
+	}
+	if w := republishFolder("wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Republishing a folder with the wrong password wasn't rejected (%v)", w.Code)
+	}
+
+	// Mounted under a prefix, the republished feed still links to itself.
+	req, _ := http.NewRequest("GET", "/api/republish?feeds="+added.Key, nil)
+	req.RequestURI = "/api/republish?feeds=" + added.Key
+	w = httptest.NewRecorder()
+	http.StripPrefix("/api", server).ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), "/api/republish?feeds="+added.Key) {
+		t.Errorf("Republished feed doesn't link to where it is served (%s)", w.Body.String())
+	}
+
+	var item ItemJSON
+	decodeResponse(t, doRequest(t, server, "GET", "/items/"+page.Items[0].Key, ""), &item)
+	if item.Title != "IIII" || item.Key != page.Items[0].Key {
+		t.Errorf("Wrong item (%+v)", item)
+	}
+
+	var feeds []FeedJSON
+	decodeResponse(t, doRequest(t, server, "GET", "/feeds", ""), &feeds)
+	found := false
+	for _, listed := range feeds {
+		found = found || listed.Key == added.Key
+	}
+	if !found {
+		t.Errorf("Added feed isn't listed (%+v)", feeds)
+	}
+
+	if w := doRequest(t, server, "DELETE", "/feeds/"+added.Key, ""); w.Code != http.StatusNoContent {
+		t.Errorf("Failed to remove feed (%v: %s)", w.Code, w.Body.String())
+	}
+	if w := doRequest(t, server, "GET", "/feeds/"+added.Key, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Removed feed is still there (%v)", w.Code)
+	}
+	if w := doRequest(t, server, "GET", "/items/"+page.Items[0].Key, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Removed feed's item is still there (%v)", w.Code)
+	}
+	if w := doRequest(t, server, "GET", "/river?feeds="+added.Key, ""); w.Code != http.StatusNotFound {
+		t.Errorf("River of a removed feed wasn't missing (%v)", w.Code)
+	}
+	if w := doRequest(t, server, "GET", "/republish?feeds="+added.Key, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Republishing a removed feed wasn't missing (%v)", w.Code)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package kiliumapi
+
+import (
+	"sort"
+
+	"github.com/MJDSystems/kilium/kilium"
+	riak "github.com/tpjg/goriakpbc"
+)
+
+// Some of a user's subscriptions, with their feeds and the user's state for each.  The slices line
+// up, so RiverKey.Feed indexes all of them.
+type userFeeds struct {
+	user   *kilium.User
+	keys   []string
+	feeds  []*kilium.Feed
+	subs   []kilium.Subscription
+	states []*kilium.UserFeedState
+}
+
+// Loads the user's active subscriptions that include accepts, sorted by feed key so they always come
+// out in the same order.  Subscriptions to feeds that have since been removed are left out, so the user
+// can still get at everything else and unsubscribe from them.
+func loadUserFeeds(con *riak.Client, user *kilium.User, include func(kilium.Subscription) bool) (*userFeeds, error) {
+	subs := user.ActiveSubscriptions()
+
+	var keys []string
+	for key, sub := range subs {
+		if include(sub) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	feeds := make([]*kilium.Feed, len(keys))
+	errCh := make(chan error)
+	for i, key := range keys {
+		go func(i int, key string) {
+			var err error
+			if feeds[i], err = kilium.LoadFeed(con, key); err == kilium.FeedNotFound {
+				err = nil
+			}
+			errCh <- err
+		}(i, key)
+	}
+	var errs []error
+	for range keys {
+		if err := <-errCh; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		return nil, kilium.MultiError(errs)
+	}
+
+	u := &userFeeds{user: user}
+	for i, key := range keys {
+		if feeds[i] != nil {
+			u.keys = append(u.keys, key)
+			u.feeds = append(u.feeds, feeds[i])
+			u.subs = append(u.subs, subs[key])
+		}
+	}
+
+	var err error
+	u.states = make([]*kilium.UserFeedState, len(u.keys))
+	for i, key := range u.keys {
+		if u.states[i], err = kilium.LoadUserFeedState(con, user.Name, key); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// Finds the key made with id in any of the feeds.
+func (u *userFeeds) findId(id uint64) (kilium.RiverKey, bool) {
+	for feed := range u.feeds {
+		if i := u.feeds[feed].ItemKeys.FindId(id); i != -1 {
+			return kilium.RiverKey{ItemKey: u.feeds[feed].ItemKeys[i], Feed: feed}, true
+		}
+	}
+	return kilium.RiverKey{}, false
+}
+
+// Loads the items for keys.  Items that have gone missing are left out of both returned slices.
+func (u *userFeeds) loadItems(con *riak.Client, keys kilium.RiverKeyList) (kilium.RiverKeyList, []*kilium.FeedItem, error) {
+	itemKeys := make(kilium.ItemKeyList, len(keys))
+	for i, key := range keys {
+		itemKeys[i] = key.ItemKey
+	}
+	items, err := kilium.LoadFeedItems(con, itemKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	foundKeys, found := kilium.RiverKeyList{}, []*kilium.FeedItem{}
+	for i, item := range items {
+		if item != nil {
+			foundKeys = append(foundKeys, keys[i])
+			found = append(found, item)
+		}
+	}
+	return foundKeys, found, nil
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright (C) 2013 Matthew Dawson <matthew@mjdsystems.ca>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+// Command kiliumctl runs maintenance tasks against kilium's riak database.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/MJDSystems/kilium/kilium"
+	riak "github.com/tpjg/goriakpbc"
+)
+
+var (
+	riakAddr = flag.String("riak", "localhost:10017", "Address of riak's protocol buffers interface.")
+	logLevel = flag.String("log-level", "info", "Least important messages to log: debug, info, warn or error.")
+)
+
+// Where commands log their progress to, set up from -log-level.
+var logger kilium.Logger
+
+type command struct {
+	usage string
+	run   func(con *riak.Client, args []string) error
+}
+
+var commands = map[string]command{
+	"backup":    {"Writes every feed and item to an archive: [-gzip] FILE, or - for stdout.", backup},
+	"restore":   {"Restores an archive into an empty store: FILE, or - for stdin.", restore},
+	"fsck":      {"Checks the feeds and items for damage: [-repair].", fsck},
+	"reindex":   {"Rebuilds the search index from every stored item.", reindex},
+	"retention": {"Sets a feed's retention policy: FEED [-max-items N] [-max-age D] [-keep-starred] [-global].", retention},
+	"sweep":     {"Removes every item the retention policies no longer keep, skipping feeds a fetcher holds: -max-items N -max-age D -keep-starred=B, as given to the fetcher.", sweep},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] command [args]\n\nCommands:\n", os.Args[0])
+	for name, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, cmd.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	level, err := kilium.ParseLogLevel(*logLevel)
+	if err != nil {
+		log.Fatalln("Bad log level:", *logLevel)
+	}
+	logger = kilium.NewTextLogger(os.Stderr, level)
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	con, err := kilium.GetDatabaseConnection(*riakAddr)
+	if err != nil {
+		log.Fatalln("Failed to connect to riak:", err)
+	}
+	if err := cmd.run(con, flag.Args()[1:]); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func reindex(con *riak.Client, args []string) error {
+	return kilium.RebuildSearchIndex(con, logger)
+}
+
+func retention(con *riak.Client, args []string) error {
+	flags := flag.NewFlagSet("retention", flag.ExitOnError)
+	maxItems := flags.Int("max-items", 0, "How many items the feed keeps.  0 keeps every item.")
+	maxAge := flags.Duration("max-age", 0, "How long the feed keeps items.  0 keeps items forever.")
+	keepStarred := flags.Bool("keep-starred", false, "Keep starred items, whatever their age or count.")
+	global := flags.Bool("global", false, "Go back to the global policy instead.")
+	if len(args) == 0 {
+		return fmt.Errorf("retention needs a feed key")
+	}
+	flags.Parse(args[1:])
+
+	if *global {
+		return kilium.SetFeedRetention(con, args[0], nil)
+	}
+	return kilium.SetFeedRetention(con, args[0], &kilium.RetentionPolicy{MaxItems: *maxItems, MaxAge: *maxAge, KeepStarred: *keepStarred})
+}
+
+func sweep(con *riak.Client, args []string) error {
+	// Feeds without their own policy use the fetcher's default, which only its flags know.  Guessing it
+	// would delete items the fetcher keeps, so every part must be given.
+	flags := flag.NewFlagSet("sweep", flag.ExitOnError)
+	maxItems := flags.Int("max-items", 0, "The fetcher's -max-items.")
+	maxAge := flags.Duration("max-age", 0, "The fetcher's -max-age.")
+	keepStarred := flags.Bool("keep-starred", false, "The fetcher's -keep-starred.")
+	flags.Parse(args)
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for _, name := range []string{"max-items", "max-age", "keep-starred"} {
+		if !given[name] {
+			return fmt.Errorf("sweep needs -%s, as given to the fetcher", name)
+		}
+	}
+	kilium.GlobalRetentionPolicy = kilium.RetentionPolicy{MaxItems: *maxItems, MaxAge: *maxAge, KeepStarred: *keepStarred}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return kilium.SweepRetention(con, fmt.Sprintf("kiliumctl@%s:%d", hostname, os.Getpid()), time.Now(), logger)
+}
+
+func fsck(con *riak.Client, args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "Fix what is found.  Stop the fetcher first.")
+	flags.Parse(args)
+
+	report, err := kilium.CheckConsistency(con, *repair)
+	if report != nil {
+		fmt.Printf("Checked %d feeds and %d items.\n", report.FeedsChecked, report.ItemsChecked)
+		for _, key := range report.OrphanedItems {
+			fmt.Println("Orphaned item:", key.GetRiakKey())
+		}
+		for feedKey, keys := range report.DanglingItemKeys {
+			for _, key := range keys {
+				fmt.Println("Dangling item key:", feedKey, key.GetRiakKey())
+			}
+		}
+		for _, feedKey := range report.UnfinishedFeeds {
+			fmt.Println("Unfinished update:", feedKey)
+		}
+		for feedKey, keys := range report.UnindexedItems {
+			for _, key := range keys {
+				fmt.Println("Unindexed item:", feedKey, key.GetRiakKey())
+			}
+		}
+		for _, explosion := range report.SiblingExplosions {
+			fmt.Printf("Sibling explosion: %s/%s has %d siblings\n", explosion.Bucket, explosion.Key, explosion.Siblings)
+		}
+		if report.Repaired {
+			fmt.Println("Repaired.")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if !report.Consistent() && !report.Repaired {
+		return fmt.Errorf("Inconsistencies found, run with -repair to fix them")
+	}
+	return nil
+}
+
+func backup(con *riak.Client, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	compress := flags.Bool("gzip", false, "Compress the archive.")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("backup needs a file to write to")
+	}
+
+	if flags.Arg(0) == "-" {
+		return kilium.ExportArchive(con, os.Stdout, *compress)
+	}
+	file, err := os.Create(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := kilium.ExportArchive(con, file, *compress); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func restore(con *riak.Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("restore needs a file to read from")
+	}
+
+	if args[0] == "-" {
+		return kilium.ImportArchive(con, os.Stdin)
+	}
+	file, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return kilium.ImportArchive(con, file)
+}